@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"ShowroomDBlib"
+)
+
+/*
+	Bench()
+	ServerConfig.ymlで指定したデータベースに貢献ランキングを保存する時間を、一つのinsertで追加する行数を変えて計測します。
+	一行ずつ追加する（-batch 1）ときと複数行をまとめて追加するときを比較するためのものです。
+
+	確認用のイベント（bench-{時刻}）のデータを作成し、終わったら削除します。
+	稼働しているデータベースで計測するためのもので、SQLiteの一時的なデータベースで計測するときは
+	ShowroomDBlibのBenchmarkSaveSnapshot（go test -bench SaveSnapshot）を使ってください。
+
+	使い方
+
+		% 実行モジュール名 bench [-sizes 100,500,2000] [-batch 1,100] [-repeat 5]
+
+		-sizes		貢献ランキングのリスナーの数（カンマ区切り）
+		-batch		一つのinsertで追加する行数（カンマ区切り、最初のものを基準に比較する）
+		-repeat		それぞれの組み合わせで保存する回数
+
+	戻り値
+	status		int	0: 正常終了、負: エラー
+*/
+func Bench(args []string, store *ShowroomDBlib.Store) (status int) {
+
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	sizesflag := fs.String("sizes", "100,500,2000", "number of listeners in a snapshot")
+	batchflag := fs.String("batch", "1,"+strconv.Itoa(store.BatchSize()), "rows per insert")
+	repeat := fs.Int("repeat", 5, "snapshots saved for each combination")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		fmt.Println("Usage: bench [-sizes 100,500,2000] [-batch 1,100] [-repeat 5]")
+		return -1
+	}
+	sizes, err := parseInts(*sizesflag)
+	if err != nil {
+		fmt.Printf("-sizes: %s\n", err.Error())
+		return -1
+	}
+	batches, err := parseInts(*batchflag)
+	if err != nil {
+		fmt.Printf("-batch: %s\n", err.Error())
+		return -1
+	}
+	if *repeat < 1 {
+		*repeat = 1
+	}
+
+	ctx := context.Background()
+	eventid := fmt.Sprintf("bench-%d", time.Now().UnixNano())
+	defer func() {
+		if err := store.DeleteEvent(ctx, eventid); err != nil {
+			fmt.Printf("cleanup: %s\n", err.Error())
+		}
+	}()
+	defer store.SetBatchSize(store.BatchSize())
+
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	m := 0
+
+	fmt.Printf("%s: %d snapshot(s) for each size and batch\n", store.Dialect(), *repeat)
+	fmt.Printf("%8s %8s %12s %12s %8s\n", "size", "batch", "ms/snapshot", "rows/s", "speedup")
+	for _, size := range sizes {
+		eventranking := benchRanking(size)
+
+		//	最初に保存するときだけlistenerテーブルにリスナーを追加するので、計測する前に一度保存しておく
+		//	（そうしないと最初のbatchの計測にだけ追加の時間が含まれ、以後のbatchが速く見えてしまう）
+		m++
+		seed := ShowroomDBlib.Sample{Eventid: eventid, Userid: size, Sampletm1: base.Add(time.Duration(m) * time.Minute)}
+		if err = store.SaveSnapshot(ctx, seed, seed.Sampletm1, eventranking); err != nil {
+			fmt.Printf("SaveSnapshot() size=%d: %s\n", size, err.Error())
+			return -2
+		}
+
+		var first time.Duration
+		for i, batch := range batches {
+			store.SetBatchSize(batch)
+			start := time.Now()
+			for r := 0; r < *repeat; r++ {
+				m++
+				sample := ShowroomDBlib.Sample{Eventid: eventid, Userid: size, Sampletm1: base.Add(time.Duration(m) * time.Minute)}
+				if err = store.SaveSnapshot(ctx, sample, sample.Sampletm1, eventranking); err != nil {
+					fmt.Printf("SaveSnapshot() size=%d batch=%d: %s\n", size, batch, err.Error())
+					return -2
+				}
+			}
+			elapsed := time.Since(start) / time.Duration(*repeat)
+			if i == 0 {
+				first = elapsed
+			}
+			fmt.Printf("%8d %8d %12.1f %12.0f %7.1fx\n", size, store.BatchSize(),
+				float64(elapsed)/float64(time.Millisecond),
+				float64(size)/elapsed.Seconds(),
+				float64(first)/float64(elapsed))
+		}
+	}
+	return 0
+}
+
+//	benchRanking はsize人のリスナーの貢献ランキングを作ります。
+func benchRanking(size int) (eventranking ShowroomDBlib.EventRanking) {
+	for i := 0; i < size; i++ {
+		eventranking = append(eventranking, ShowroomDBlib.EventRank{
+			Order:       i + 1,
+			Rank:        i + 1,
+			Listner:     fmt.Sprintf("ベンチマーク%04d", i+1),
+			LsnID:       1000000 + i,
+			Avatar:      fmt.Sprintf("https://image.showroom-cdn.com/showroom-prod/image/avatar/%d.png", i+1),
+			T_LsnID:     i + 1,
+			Point:       (size - i) * 100,
+			Incremental: (size - i) * 10,
+		})
+	}
+	return
+}
+
+func parseInts(s string) (values []int, err error) {
+	for _, f := range strings.Split(s, ",") {
+		v, cerr := strconv.Atoi(strings.TrimSpace(f))
+		if cerr != nil || v < 1 {
+			return nil, fmt.Errorf("<%s> is not a positive number", f)
+		}
+		values = append(values, v)
+	}
+	return
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"ShowroomDBlib"
+)
+
+/*
+	Migrate()
+	データベースのスキーマ（timetable、eventrank、contpageなど）を作成し、このプログラムが必要とする版まで更新します。
+	新しく設置するときも、プログラムを更新したときもこれを実行してください。
+
+	使い方
+
+		% 実行モジュール名 migrate [-status] [-baseline N]
+
+		-status		現在の版と適用されていない版を表示する（更新はしない）
+		-baseline N	版Nまで適用済みとして記録する（SQLは実行しない）
+				これまで手でテーブルを作成、更新してきたデータベースで、どこまで適用済みかがわかっているときに使う。
+				（わからないときは指定せずに実行してもかまいません。すでにあるテーブルやカラムは適用済みとして扱います）
+
+	戻り値
+	status		int	0: 正常終了
+*/
+func Migrate(args []string, store *ShowroomDBlib.Store) (status int) {
+
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	showstatus := fs.Bool("status", false, "show the schema version and pending migrations")
+	baseline := fs.Int("baseline", -1, "record versions up to N as applied without running them")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		fmt.Println("Usage: migrate [-status] [-baseline N]")
+		return -1
+	}
+
+	ctx := context.Background()
+
+	latest, err := store.LatestSchemaVersion()
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return -2
+	}
+
+	if *showstatus {
+		version, err := store.SchemaVersion(ctx)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			version = 0
+		}
+		fmt.Printf("schema version %d, required %d\n", version, latest)
+		migrations, _ := store.Migrations()
+		for _, m := range migrations {
+			if m.Version > version {
+				fmt.Printf("  pending %04d %s\n", m.Version, m.Name)
+			}
+		}
+		return 0
+	}
+
+	if *baseline >= 0 {
+		if err = store.Baseline(ctx, *baseline); err != nil {
+			fmt.Printf("%s\n", err.Error())
+			return -3
+		}
+		fmt.Printf("versions up to %d are recorded as applied.\n", *baseline)
+	}
+
+	logf := func(format string, args ...interface{}) {
+		fmt.Printf(format, args...)
+		log.Printf(format, args...)
+	}
+	from, to, err := store.Migrate(ctx, logf)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return -4
+	}
+	if from == to {
+		fmt.Printf("schema is up to date (version %d).\n", to)
+	} else {
+		fmt.Printf("schema is migrated from version %d to %d.\n", from, to)
+	}
+	return 0
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ShowroomDBlib"
+)
+
+// PageArchive は取得した貢献ランキングのページ（HTML）をそのまま保存しておく場所です。
+// 突き合わせの結果がおかしいときに、そのときSHOWROOMが実際に返したページを確認するためのものです。
+// ページはgzipで圧縮し、イベントID、ルームID、サンプリングの時刻（timetableのsampletm1、eventrankのsampletm1と同じもの）をキーにして保存します。
+//
+//	"dir"	ArchiveDirの下に {eventid}/{roomid}/{yyyymmddhhmmss}.html.gz として保存します（DirPageArchive）
+//	"db"	contpageテーブルに保存します（DbPageArchive）
+//
+// どちらを使うかはEnvironment.ymlのarchivepagesで指定します（指定しなければ保存しません）
+type PageArchive interface {
+	Save(eventid, roomid string, sampletm time.Time, page []byte) error
+	//	sampletmがbeforeより前のページを削除し、削除した数を返します。
+	Purge(before time.Time) (n int, err error)
+
+	//	保存してあるページのsampletmを古い順に返します。
+	List(eventid, roomid string) (sampletms []time.Time, err error)
+	//	保存してあるページを（展開して）返します。
+	Load(eventid, roomid string, sampletm time.Time) (page []byte, err error)
+}
+
+// NewPageArchive はEnvironmentの設定にしたがってPageArchiveを作ります。保存しないときはnilを返します。
+func NewPageArchive(environment *Environment, store *ShowroomDBlib.Store) (pagearchive PageArchive, err error) {
+
+	switch environment.ArchivePages {
+	case "":
+	case "dir":
+		if environment.ArchiveDir == "" {
+			err = fmt.Errorf("NewPageArchive(): archivedir is not specified")
+			return
+		}
+		pagearchive = &DirPageArchive{Dir: environment.ArchiveDir}
+	case "db":
+		pagearchive = &DbPageArchive{Store: store}
+	default:
+		err = fmt.Errorf("NewPageArchive(): unknown archivepages <%s>", environment.ArchivePages)
+	}
+	return
+}
+
+const archiveTimeLayout = "20060102150405"
+
+func gzipPage(page []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(page); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipPage(zpage []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(zpage))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// DirPageArchive はページをディレクトリに保存します。
+type DirPageArchive struct {
+	Dir string
+}
+
+func (d *DirPageArchive) Save(eventid, roomid string, sampletm time.Time, page []byte) (err error) {
+
+	dir := filepath.Join(d.Dir, eventid, roomid)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	zpage, err := gzipPage(page)
+	if err != nil {
+		return
+	}
+
+	filename := filepath.Join(dir, sampletm.Format(archiveTimeLayout)+".html.gz")
+	return ioutil.WriteFile(filename, zpage, 0644)
+}
+
+func (d *DirPageArchive) List(eventid, roomid string) (sampletms []time.Time, err error) {
+
+	files, err := filepath.Glob(filepath.Join(d.Dir, eventid, roomid, "*.html.gz"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		sampletm, perr := time.ParseInLocation(archiveTimeLayout, strings.TrimSuffix(filepath.Base(file), ".html.gz"), time.Local)
+		if perr != nil {
+			continue
+		}
+		sampletms = append(sampletms, sampletm)
+	}
+	sort.Slice(sampletms, func(i, j int) bool { return sampletms[i].Before(sampletms[j]) })
+	return
+}
+
+func (d *DirPageArchive) Load(eventid, roomid string, sampletm time.Time) (page []byte, err error) {
+
+	zpage, err := ioutil.ReadFile(filepath.Join(d.Dir, eventid, roomid, sampletm.Format(archiveTimeLayout)+".html.gz"))
+	if err != nil {
+		return
+	}
+	return gunzipPage(zpage)
+}
+
+func (d *DirPageArchive) Purge(before time.Time) (n int, err error) {
+
+	err = filepath.Walk(d.Dir, func(path string, info os.FileInfo, werr error) error {
+		if werr != nil || info.IsDir() || !strings.HasSuffix(path, ".html.gz") {
+			return werr
+		}
+		sampletm, perr := time.ParseInLocation(archiveTimeLayout, strings.TrimSuffix(info.Name(), ".html.gz"), time.Local)
+		if perr != nil || !sampletm.Before(before) {
+			return nil
+		}
+		if rerr := os.Remove(path); rerr != nil {
+			return rerr
+		}
+		n++
+		return nil
+	})
+	return
+}
+
+// DbPageArchive はページをcontpageテーブルに保存します。
+type DbPageArchive struct {
+	Store *ShowroomDBlib.Store
+}
+
+func (d *DbPageArchive) Save(eventid, roomid string, sampletm time.Time, page []byte) (err error) {
+
+	userno, err := strconv.Atoi(roomid)
+	if err != nil {
+		return
+	}
+
+	zpage, err := gzipPage(page)
+	if err != nil {
+		return
+	}
+
+	return d.Store.SavePage(context.Background(), eventid, userno, sampletm, zpage)
+}
+
+func (d *DbPageArchive) Purge(before time.Time) (n int, err error) {
+
+	return d.Store.DeletePagesBefore(context.Background(), before)
+}
+
+func (d *DbPageArchive) List(eventid, roomid string) (sampletms []time.Time, err error) {
+
+	userno, err := strconv.Atoi(roomid)
+	if err != nil {
+		return
+	}
+
+	return d.Store.PageTimes(context.Background(), eventid, userno)
+}
+
+func (d *DbPageArchive) Load(eventid, roomid string, sampletm time.Time) (page []byte, err error) {
+
+	userno, err := strconv.Atoi(roomid)
+	if err != nil {
+		return
+	}
+
+	zpage, err := d.Store.Page(context.Background(), eventid, userno, sampletm)
+	if err != nil {
+		return
+	}
+	return gunzipPage(zpage)
+}
+
+//	PurgePages は保存期間（日）を過ぎたページを削除します。
+func PurgePages(pagearchive PageArchive, retention int) {
+
+	if pagearchive == nil || retention <= 0 {
+		return
+	}
+
+	before := time.Now().AddDate(0, 0, -retention)
+	n, err := pagearchive.Purge(before)
+	if err != nil {
+		log.Printf(" PurgePages() err=%s\n", err.Error())
+		return
+	}
+	log.Printf(" PurgePages() %d page(s) before %s were deleted.\n", n, before.Format("2006/1/2 15:04:05"))
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RankingSource は貢献ランキングのページ（HTML）の取得元です。
+// GetPointsCont()はここから得たページを解析してイベント貢献ランキングを作ります。
+//
+//	"web"		SHOWROOMのサイトから取得します（WebRankingSource、通常はこちら）
+//	"fixture"	あらかじめ保存しておいたHTMLファイルから取得します（FixtureRankingSource）
+//
+// どちらを使うかはEnvironment.ymlのrankingsourceで指定します。
+type RankingSource interface {
+	ReadRankingPage(ctx context.Context, eventid, roomid string) (page []byte, err error)
+}
+
+// NewRankingSource はEnvironmentの設定にしたがってRankingSourceを作ります。
+func NewRankingSource(environment *Environment) (rankingsource RankingSource, err error) {
+
+	switch environment.RankingSource {
+	case "", "web":
+		rankingsource = NewWebRankingSource(environment)
+	case "fixture":
+		if environment.FixtureDir == "" {
+			err = fmt.Errorf("NewRankingSource(): fixturedir is not specified")
+			return
+		}
+		rankingsource = &FixtureRankingSource{Dir: environment.FixtureDir}
+	default:
+		err = fmt.Errorf("NewRankingSource(): unknown rankingsource <%s>", environment.RankingSource)
+	}
+	return
+}
+
+// WebRankingSource はSHOWROOMのサイトから貢献ランキングのページを取得します。
+//
+// レスポンスが返ってこないときはTimeoutで打ち切り、通信エラー、5xx、429のときは
+// 指数的に間隔を延ばしながら（ジッターつき）MaxAttempts回まで取得を繰り返します。
+// それでも取得できないときは*FetchErrorを返します。
+type WebRankingSource struct {
+	BaseURL     string        //	空のときは https://www.showroom-live.com
+	UserAgent   string        //	空のときはGoのデフォルト
+	MaxAttempts int           //	最大試行回数
+	Backoff     time.Duration //	一回目のリトライまでの待ち時間（以後倍々にしていく）
+	MaxBackoff  time.Duration //	リトライまでの待ち時間の上限
+	Limiter     *RateLimiter  //	アクセスの間隔の制限（nilのときは制限しない）
+
+	client *http.Client
+}
+
+// NewWebRankingSource はEnvironmentのHTTP関連の設定からWebRankingSourceを作ります。
+// 指定がない項目はデフォルト値（タイムアウト30秒、3回まで、1秒から30秒まで）とします。
+func NewWebRankingSource(environment *Environment) *WebRankingSource {
+
+	w := &WebRankingSource{
+		UserAgent:   environment.UserAgent,
+		MaxAttempts: environment.HttpMaxAttempts,
+		Backoff:     time.Duration(environment.HttpBackoff) * time.Millisecond,
+		MaxBackoff:  time.Duration(environment.HttpMaxBackoff) * time.Millisecond,
+	}
+	if w.MaxAttempts <= 0 {
+		w.MaxAttempts = 3
+	}
+	if w.Backoff <= 0 {
+		w.Backoff = 1 * time.Second
+	}
+	if w.MaxBackoff <= 0 {
+		w.MaxBackoff = 30 * time.Second
+	}
+	w.Limiter = NewRateLimiter(time.Duration(environment.FetchInterval) * time.Millisecond)
+
+	timeout := time.Duration(environment.HttpTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	w.client = &http.Client{Timeout: timeout}
+
+	return w
+}
+
+// FetchError は貢献ランキングのページが取得できなかったことを示します。
+type FetchError struct {
+	URL        string
+	StatusCode int //	最後に受け取ったHTTPのステータスコード（レスポンスがなかったときは0）
+	Attempts   int //	試行回数
+	Err        error
+}
+
+func (e *FetchError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("fetch %s: status %d after %d attempt(s)", e.URL, e.StatusCode, e.Attempts)
+	}
+	return fmt.Sprintf("fetch %s: %v after %d attempt(s)", e.URL, e.Err, e.Attempts)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+func (w *WebRankingSource) ReadRankingPage(ctx context.Context, eventid, roomid string) (page []byte, err error) {
+
+	baseurl := w.BaseURL
+	if baseurl == "" {
+		baseurl = "https://www.showroom-live.com"
+	}
+	_url := baseurl + "/event/contribution/" + eventid + "?room_id=" + roomid
+
+	client := w.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	maxattempts := w.MaxAttempts
+	if maxattempts <= 0 {
+		maxattempts = 1
+	}
+
+	ferr := &FetchError{URL: _url}
+	for attempt := 1; ; attempt++ {
+		ferr.Attempts = attempt
+
+		var wait time.Duration
+		var retryable bool
+		page, wait, retryable, err = w.readOnce(ctx, client, _url, ferr)
+		if err == nil {
+			return page, nil
+		}
+		ferr.Err = err
+
+		if !retryable || attempt >= maxattempts || ctx.Err() != nil {
+			return nil, ferr
+		}
+
+		if wait <= 0 {
+			wait = w.backoff(attempt)
+		}
+		log.Printf(" ReadRankingPage() attempt %d/%d failed (%v), retry after %v\n", attempt, maxattempts, err, wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			ferr.Err = ctx.Err()
+			return nil, ferr
+		case <-timer.C:
+		}
+	}
+}
+
+//	readOnce はページの取得を一回だけ行います。
+//	retryable はリトライすれば取得できる可能性があるか、wait はサーバーから指示された（Retry-After、MaxBackoffで頭打ち）待ち時間です。
+func (w *WebRankingSource) readOnce(
+	ctx context.Context,
+	client *http.Client,
+	_url string,
+	ferr *FetchError,
+) (
+	page []byte,
+	wait time.Duration,
+	retryable bool,
+	err error,
+) {
+
+	//	ワーカーがいくつあってもSHOWROOMへのアクセスの間隔は一定以上にする（リトライも含む）
+	if err = w.Limiter.Wait(ctx); err != nil {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", _url, nil)
+	if err != nil {
+		return
+	}
+	if w.UserAgent != "" {
+		req.Header.Set("User-Agent", w.UserAgent)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		//	タイムアウトを含む通信エラーはリトライの対象とする（キャンセルされたときを除く）
+		retryable = ctx.Err() == nil
+		return
+	}
+	defer resp.Body.Close()
+
+	ferr.StatusCode = resp.StatusCode
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s", resp.Status)
+		retryable = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		wait = retryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if wait > w.MaxBackoff && w.MaxBackoff > 0 {
+			wait = w.MaxBackoff
+		}
+		return
+	}
+
+	page, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		//	途中で切れたときもリトライの対象とする。
+		retryable = ctx.Err() == nil
+	}
+	return
+}
+
+//	retryAfter はRetry-Afterヘッダーの値（秒数またはHTTPの日付）から待ち時間を求めます。
+//	値がないとき、読めないとき、日付が過ぎているときは0を返します。
+func retryAfter(value string, now time.Time) time.Duration {
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(value); err == nil {
+		if s <= 0 {
+			return 0
+		}
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+//	backoff はattempt回目の失敗のあとの待ち時間を返します。
+//	Backoff * 2^(attempt-1) をMaxBackoffで頭打ちにし、その1/2から1倍の間でばらつかせます。
+func (w *WebRankingSource) backoff(attempt int) time.Duration {
+
+	d := w.Backoff
+	for i := 1; i < attempt && (w.MaxBackoff <= 0 || d < w.MaxBackoff); i++ {
+		d *= 2
+	}
+	if w.MaxBackoff > 0 && d > w.MaxBackoff {
+		d = w.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// RateLimiter は複数のゴルーチンから行われる処理の開始の間隔を一定以上にします。
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time //	次に開始してよい時刻
+}
+
+// NewRateLimiter はintervalの間隔で処理を開始させるRateLimiterを作ります。intervalが0以下のときはnilを返します（制限しません）
+func NewRateLimiter(interval time.Duration) *RateLimiter {
+	if interval <= 0 {
+		return nil
+	}
+	return &RateLimiter{interval: interval}
+}
+
+// Wait は処理を開始してよい時刻になるまで待ちます。待っている間にctxがキャンセルされたときはそのエラーを返します。
+func (r *RateLimiter) Wait(ctx context.Context) error {
+
+	if r == nil {
+		return ctx.Err()
+	}
+
+	r.mu.Lock()
+	now := time.Now()
+	start := r.next
+	if start.Before(now) {
+		start = now
+	}
+	r.next = start.Add(r.interval)
+	r.mu.Unlock()
+
+	wait := time.Until(start)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// FixtureRankingSource はディレクトリに置いたHTMLファイルを貢献ランキングのページとして返します。
+// SHOWROOMのサイトにアクセスせずに（オフラインやCIで）処理全体を動かすためのものです。
+//
+// ファイルは次のどちらかの形で置きます。
+//
+//	Dir/{eventid}_{roomid}.html		いつも同じページを返します。
+//	Dir/{eventid}_{roomid}/*.html	ファイル名の順に一つずつ返し、最後のファイルのあとはそれを返し続けます。
+//					（配信ごとにランキングが変わっていく様子を再現するためのものです）
+type FixtureRankingSource struct {
+	Dir string
+
+	mu     sync.Mutex
+	served map[string]int //	{eventid}_{roomid}ごとの返したファイルの数
+}
+
+func (f *FixtureRankingSource) ReadRankingPage(ctx context.Context, eventid, roomid string) (page []byte, err error) {
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	key := eventid + "_" + roomid
+
+	files, err := filepath.Glob(filepath.Join(f.Dir, key, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		filename := filepath.Join(f.Dir, key+".html")
+		if _, err = os.Stat(filename); err != nil {
+			return nil, fmt.Errorf("no fixture for %s in %s: %w", key, f.Dir, err)
+		}
+		files = []string{filename}
+	}
+	sort.Strings(files)
+
+	f.mu.Lock()
+	if f.served == nil {
+		f.served = make(map[string]int)
+	}
+	n := f.served[key]
+	if n >= len(files) {
+		n = len(files) - 1
+	}
+	f.served[key] = n + 1
+	f.mu.Unlock()
+
+	log.Printf(" FixtureRankingSource: %s\n", strings.TrimPrefix(files[n], f.Dir))
+	return ioutil.ReadFile(files[n])
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"ShowroomDBlib"
+	"matching"
+)
+
+//	ReplaySample は突き合わせを再実行するときの一回分の貢献ランキングです。
+type ReplaySample struct {
+	Ts      time.Time //	配信（timetableのsampletm1、以前のページは取得した時刻）
+	Ranking ShowroomDBlib.EventRanking
+}
+
+/*
+	Replay()
+	保存してある貢献ランキングのページ（またはeventrankのデータ）を古い順にCompareEventRanking()にかけなおし、
+	現在の設定（Environment.ymlのmatching）で突き合わせを行ったときの結果を確認します。
+	一致度の閾値などを変更したとき、過去のデータでリスナーの追跡がどう変わるかを調べるためのものです。
+
+	使い方
+
+		% 実行モジュール名 replay [-source archive|eventrank] [-out diff|scratch|compare] [-mode greedy|assignment] eventid roomid
+
+		-source archive		保存してあるページ（Environment.ymlのarchivepages）を使う（デフォルト）
+		-source eventrank	eventrankに保存されているデータを使う（ランキング外になったリスナーを除いたものを入力とする）
+		-out diff		eventrankに保存されている結果との差異を出力する（デフォルト）
+		-out scratch		結果をeventrank_replayテーブルに保存する
+		-out compare		greedyとassignmentで判定が異なるリスナーを出力する（次の回の入力は-modeの方法の結果）
+		-mode			突き合わせの方法（指定しなければEnvironment.ymlのmatchingのmode）
+
+	戻り値
+	status		int	0: 正常終了（差異がない）、1: 差異がある（-out diff、-out compare）、負: エラー
+*/
+func Replay(args []string, environment *Environment, store *ShowroomDBlib.Store, pagearchive PageArchive) (status int) {
+
+	ctx := context.Background()
+
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	source := fs.String("source", "archive", "archive or eventrank")
+	out := fs.String("out", "diff", "diff, scratch or compare")
+	mode := fs.String("mode", "", "greedy or assignment")
+	if err := fs.Parse(args); err != nil {
+		return -1
+	}
+	if fs.NArg() != 2 || (*source != "archive" && *source != "eventrank") || (*out != "diff" && *out != "scratch" && *out != "compare") ||
+		(*mode != "" && *mode != matching.ModeGreedy && *mode != matching.ModeAssignment) {
+		fmt.Println("Usage: replay [-source archive|eventrank] [-out diff|scratch|compare] [-mode greedy|assignment] eventid roomid")
+		return -1
+	}
+	eventid := fs.Arg(0)
+	roomid := fs.Arg(1)
+	var userno int
+	if _, err := fmt.Sscanf(roomid, "%d", &userno); err != nil {
+		fmt.Printf("roomid <%s> is not a number.\n", roomid)
+		return -1
+	}
+
+	var samples []ReplaySample
+	var err error
+	if *source == "archive" {
+		if pagearchive == nil {
+			fmt.Println("archivepages is not specified in Environment.yml.")
+			return -1
+		}
+		samples, err = ReplaySamplesFromArchive(pagearchive, eventid, roomid)
+	} else {
+		samples, err = ReplaySamplesFromEventrank(ctx, store, eventid, userno)
+	}
+	if err != nil {
+		fmt.Printf("Can't read samples: %s\n", err.Error())
+		return -2
+	}
+	fmt.Printf("replay %s %s: %d sample(s) from %s\n", eventid, roomid, len(samples), *source)
+
+	var storedts []time.Time
+	if *out == "diff" {
+		if storedts, err = store.SnapshotTimes(ctx, eventid, userno); err != nil {
+			fmt.Printf("Can't read stored snapshots: %s\n", err.Error())
+			return -3
+		}
+	} else if *out == "scratch" {
+		if err = store.DeleteReplay(ctx, eventid, userno); err != nil {
+			fmt.Printf("Can't clear eventrank_replay: %s\n", err.Error())
+			return -4
+		}
+	}
+
+	params := environment.Matching.ParamsFor(eventid)
+	if *mode != "" {
+		params.Mode = *mode
+	}
+	fmt.Printf("matchparams: %s\n", params.String())
+	matcher := NewMatcher(params)
+	greedy := &matching.Greedy{Params: params}
+	assignment := &matching.Assignment{Params: params}
+
+	ndiff := 0
+	last_eventranking := make(ShowroomDBlib.EventRanking, 0)
+	nexttlsnid := 1
+	for _, sample := range samples {
+
+		log.Printf("------------------- replay %s --------------------\n", sample.Ts.Format("2006/1/2 15:04:05"))
+		final_eventranking, totalincremental := CompareEventRanking(matcher, last_eventranking, sample.Ranking)
+		//	新たに現れたリスナーのT_LsnIDはここで振る（eventrankに保存するときはStoreが振る）
+		for i := range final_eventranking {
+			if final_eventranking[i].T_LsnID == 0 {
+				final_eventranking[i].T_LsnID = nexttlsnid
+				nexttlsnid++
+			}
+		}
+
+		switch *out {
+		case "diff":
+			ndiff += DiffEventRanking(ctx, store, eventid, userno, sample.Ts, storedts, final_eventranking)
+		case "compare":
+			differences := matching.Differences(greedy.Match(last_eventranking, sample.Ranking), assignment.Match(last_eventranking, sample.Ranking))
+			for _, d := range differences {
+				fmt.Printf("%s  greedy/assignment %s\n", sample.Ts.Format("2006/01/02 15:04"), d.Format(last_eventranking, sample.Ranking))
+			}
+			ndiff += len(differences)
+		default:
+			if err = store.SaveReplaySnapshot(ctx, ShowroomDBlib.Sample{Eventid: eventid, Userid: userno, Sampletm1: sample.Ts}, final_eventranking); err != nil {
+				fmt.Printf("Can't save to eventrank_replay: %s\n", err.Error())
+				return -5
+			}
+			fmt.Printf("%s %4d listener(s) totalincremental=%d\n", sample.Ts.Format("2006/01/02 15:04"), len(final_eventranking), totalincremental)
+		}
+
+		//	次の回の入力はeventrankから読み込んだときと同じ状態にしておく。
+		last_eventranking = make(ShowroomDBlib.EventRanking, len(final_eventranking))
+		copy(last_eventranking, final_eventranking)
+		for i := range last_eventranking {
+			last_eventranking[i].Status = 0
+		}
+	}
+
+	if *out != "scratch" {
+		fmt.Printf("%d difference(s) in %d sample(s)\n", ndiff, len(samples))
+	}
+
+	if ndiff > 0 {
+		return 1
+	}
+	return 0
+}
+
+//	ReplaySamplesFromArchive は保存してあるページを解析して古い順に返します。解析できないページは飛ばします。
+func ReplaySamplesFromArchive(pagearchive PageArchive, eventid, roomid string) (samples []ReplaySample, err error) {
+
+	sampletms, err := pagearchive.List(eventid, roomid)
+	if err != nil {
+		return
+	}
+
+	for _, sampletm := range sampletms {
+		page, lerr := pagearchive.Load(eventid, roomid, sampletm)
+		if lerr != nil {
+			err = lerr
+			return
+		}
+		_, _, eventranking, perr := ParseRankingPage(page)
+		if perr != nil {
+			log.Printf(" ReplaySamplesFromArchive() %s skipped: %s\n", sampletm.Format("2006/1/2 15:04:05"), perr.Error())
+			continue
+		}
+		samples = append(samples, ReplaySample{Ts: sampletm, Ranking: eventranking})
+	}
+	return
+}
+
+//	ReplaySamplesFromEventrank はeventrankに保存されているデータから、その時点で貢献ランキングに載っていたリスナーを取り出して古い順に返します。
+func ReplaySamplesFromEventrank(ctx context.Context, store *ShowroomDBlib.Store, eventid string, userno int) (samples []ReplaySample, err error) {
+
+	tslist, err := store.SnapshotTimes(ctx, eventid, userno)
+	if err != nil {
+		return
+	}
+
+	for _, ts := range tslist {
+		stored, serr := store.Snapshot(ctx, eventid, userno, ts)
+		if serr != nil {
+			err = serr
+			return
+		}
+		var eventranking ShowroomDBlib.EventRanking
+		for _, evr := range stored {
+			if evr.Point < 0 {
+				continue
+			}
+			eventranking = append(eventranking, ShowroomDBlib.EventRank{
+				Order:   evr.Order,
+				Rank:    evr.Rank,
+				Listner: evr.Listner,
+				LsnID:   evr.LsnID,
+				Avatar:  evr.Avatar,
+				Point:   evr.Point,
+			})
+		}
+		sort.SliceStable(eventranking, func(i, j int) bool { return eventranking[i].Order < eventranking[j].Order })
+		samples = append(samples, ReplaySample{Ts: ts, Ranking: eventranking})
+	}
+	return
+}
+
+/*
+	DiffEventRanking()
+	突き合わせを再実行した結果とeventrankに保存されている結果を比較し、差異を出力します。
+	比較するのはその時点で貢献ランキングに載っていたリスナーの前回の名前（Lastname）と増分（Incremental）です。
+	比較するのはsampletm1が同じもので、ないときは前後2分以内でもっとも近いものと比較します
+	（以前のeventrankのtsとページの時刻はどちらも処理した時刻なので、1分程度ずれることがあります）
+	同じ名前のリスナーがいることがあるので、名前とその名前の何番目のリスナーか（Order順）の組で対応させます。
+
+	戻り値
+	ndiff		int	差異のあったリスナーの数
+*/
+func DiffEventRanking(
+	ctx context.Context,
+	store *ShowroomDBlib.Store,
+	eventid string,
+	userno int,
+	ts time.Time,
+	storedts []time.Time,
+	replayed ShowroomDBlib.EventRanking,
+) (
+	ndiff int,
+) {
+
+	sts := time.Time{}
+	for _, t := range storedts {
+		d := absDuration(t.Sub(ts))
+		if d <= 2*time.Minute && (sts.IsZero() || d < absDuration(sts.Sub(ts))) {
+			sts = t
+		}
+	}
+	header := ts.Format("2006/01/02 15:04")
+	if sts.IsZero() {
+		fmt.Printf("%s  no stored snapshot\n", header)
+		return
+	}
+
+	stored, err := store.Snapshot(ctx, eventid, userno, sts)
+	if err != nil {
+		fmt.Printf("%s  can't read stored snapshot (%s)\n", header, err.Error())
+		return
+	}
+
+	storedkeys := listenerKeys(stored)
+	storedmap := make(map[listenerKey]ShowroomDBlib.EventRank)
+	for i, evr := range stored {
+		if evr.Point >= 0 {
+			storedmap[storedkeys[i]] = evr
+		}
+	}
+
+	for i, key := range listenerKeys(replayed) {
+		evr := replayed[i]
+		if evr.Point < 0 {
+			continue
+		}
+		s, ok := storedmap[key]
+		if !ok {
+			fmt.Printf("%s  【%s】 only in replay\n", header, key)
+			ndiff++
+			continue
+		}
+		delete(storedmap, key)
+		if s.Lastname != evr.Lastname || s.Incremental != evr.Incremental {
+			fmt.Printf("%s  【%s】 stored:【%s】%d  replay:【%s】%d\n", header, key, s.Lastname, s.Incremental, evr.Lastname, evr.Incremental)
+			ndiff++
+		}
+	}
+	for i, s := range stored {
+		if _, ok := storedmap[storedkeys[i]]; ok && s.Point >= 0 {
+			fmt.Printf("%s  【%s】 only in stored\n", header, storedkeys[i])
+			ndiff++
+		}
+	}
+
+	return
+}
+
+//	listenerKey は貢献ランキングの中でリスナーを区別するためのもので、名前とその名前の何番目のリスナーか（1から）の組です。
+type listenerKey struct {
+	name string
+	nth  int
+}
+
+func (k listenerKey) String() string {
+	if k.nth == 1 {
+		return k.name
+	}
+	return fmt.Sprintf("%s (%d)", k.name, k.nth)
+}
+
+//	listenerKeys は貢献ランキングに載っているリスナー（Point >= 0）のlistenerKeyを返します（載っていないものはnthを0とします）
+//	何番目かは表示の順（Order）で数えます。
+func listenerKeys(eventranking ShowroomDBlib.EventRanking) []listenerKey {
+
+	idx := make([]int, 0, len(eventranking))
+	for i, evr := range eventranking {
+		if evr.Point >= 0 {
+			idx = append(idx, i)
+		}
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return eventranking[idx[a]].Order < eventranking[idx[b]].Order })
+
+	keys := make([]listenerKey, len(eventranking))
+	count := make(map[string]int)
+	for _, i := range idx {
+		name := eventranking[i].Listner
+		count[name]++
+		keys[i] = listenerKey{name: name, nth: count[name]}
+	}
+	return keys
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
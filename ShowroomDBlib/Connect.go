@@ -0,0 +1,322 @@
+package ShowroomDBlib
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+/*
+	OpenStore()
+	DBConfigにしたがってデータベースをオープンし、接続できることを確認（Ping）してからStoreを作ります。
+	設定が誤っているときは最初のクエリーではなくここでエラーになります。
+
+	Dbdriver	"mysql"（指定しないときも）	Dbhost、Dbname、Dbuser、Dbpw のMySQLに接続します。
+			"sqlite"			Dbpath のファイルをSQLiteのデータベースとして使います（なければ作成します）
+							MySQLサーバーなしで動かしたり、試したりするためのものです。
+			"postgres"			Dbhost、Dbname、Dbuser、Dbpw のPostgreSQLに接続します。
+
+	MySQL、PostgreSQLでは次のものも指定できます（SQLiteでは使いません）
+
+	Dbport			ポート番号（指定しないときは3306、5432）
+	Dbsocket		Unixドメインソケット（MySQLはソケットのファイル、PostgreSQLはソケットのあるディレクトリ）
+				指定したときはDbhostは使いません（PostgreSQLではDbportはソケットのファイル名に使われます）
+	Dbtls			TLSを使うかどうか
+				""		ドライバーのデフォルト（MySQLは使わない、PostgreSQLはrequire）
+				"disable"	使わない
+				"preferred"	サーバーが対応していれば使う（MySQLのみ、PostgreSQLのドライバーlib/pqにはsslmode=preferがないのでエラーにします）
+				"require"	使う（サーバーの証明書は検証しない）
+				"verify-ca"	使う（サーバーの証明書をDbcaで検証する）
+				"verify-full"	使う（サーバーの証明書をDbcaで検証し、ホスト名も確認する）
+	Dbsslmode		Dbtlsの以前の名前（PostgreSQLのsslmode）で、Dbtlsを指定しないときはこれを使います（"prefer"は"preferred"とします）
+				Dbtlsと異なるものを指定したときはエラーにします。
+	Dbca			サーバーの証明書を検証するCAの証明書（PEM）のファイル、指定しないときはシステムのもの
+	Dbtimezone		時刻を読み書きするタイムゾーン（指定しないときはAsia/Tokyo）
+	Dbtimeout		接続とPingのタイムアウト（秒、指定しないときは10秒）
+	Dbmaxopenconns		接続の最大数（指定しないときは制限しない）
+	Dbmaxidleconns		アイドル状態で残しておく接続の最大数（指定しないときはdatabase/sqlのデフォルト）
+	Dbconnmaxlifetime	接続を使い続ける最大の時間（秒、指定しないときは制限しない）
+
+	次のものはどのデータベースでも指定できます。
+
+	Dbbatchsize		貢献ランキングを保存するときに一つのinsertで追加する行数（指定しないときは100、最大1000）
+
+	MySQLでは時刻をdatetimeに保存するので、Dbtimezone（DSNのloc）のタイムゾーンの時刻として読み書きします。
+	PostgreSQLでは時刻をtimestamp with time zoneに保存するので、どのタイムゾーンで書き込んでも同じ時刻として扱われます。
+	読み出した時刻がDbtimezoneのものになるように、セッションのタイムゾーンをDbtimezoneにします。
+
+	MySQLへの接続はDSNの文字列を組み立てずにドライバーの設定（mysql.Config）から作るので、
+	パスワードに"@"や"/"が含まれていてもかまいません。
+*/
+func OpenStore(dbconfig *DBConfig) (store *Store, err error) {
+
+	var db *sql.DB
+
+	if dbconfig, err = resolveTLS(dbconfig); err != nil {
+		return nil, fmt.Errorf("OpenStore(): %w", err)
+	}
+
+	switch dbconfig.Dbdriver {
+	case "", "mysql":
+		cfg, cerr := mysqlConfig(dbconfig)
+		if cerr != nil {
+			return nil, fmt.Errorf("OpenStore(): %w", cerr)
+		}
+		connector, cerr := mysql.NewConnector(cfg)
+		if cerr != nil {
+			return nil, fmt.Errorf("OpenStore(): %w", cerr)
+		}
+		db = sql.OpenDB(connector)
+		store = &Store{db: db, dialect: "mysql"}
+
+	case "sqlite":
+		if dbconfig.Dbpath == "" {
+			return nil, fmt.Errorf("OpenStore(): Dbpath is not specified")
+		}
+		//	時刻は文字列として比較するので、書式をそろえておく（_time_format=sqlite）
+		//	SQLiteは同時に一つしか書き込めないので、接続は一つにし、ロックされているときは待つようにする。
+		dsn := "file:" + dbconfig.Dbpath + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_time_format=sqlite"
+		if db, err = sql.Open("sqlite", dsn); err != nil {
+			return nil, fmt.Errorf("OpenStore(): %w", err)
+		}
+		db.SetMaxOpenConns(1)
+		store = &Store{db: db, dialect: "sqlite"}
+
+	case "postgres":
+		dsn, derr := postgresDSN(dbconfig)
+		if derr != nil {
+			return nil, fmt.Errorf("OpenStore(): %w", derr)
+		}
+		if db, err = sql.Open("postgres", dsn); err != nil {
+			return nil, fmt.Errorf("OpenStore(): %w", err)
+		}
+		store = &Store{db: db, dialect: "postgres"}
+
+	default:
+		return nil, fmt.Errorf("OpenStore(): unknown Dbdriver <%s>", dbconfig.Dbdriver)
+	}
+
+	store.SetBatchSize(dbconfig.Dbbatchsize)
+
+	if store.dialect != "sqlite" {
+		if dbconfig.Dbmaxopenconns > 0 {
+			db.SetMaxOpenConns(dbconfig.Dbmaxopenconns)
+		}
+		if dbconfig.Dbmaxidleconns > 0 {
+			db.SetMaxIdleConns(dbconfig.Dbmaxidleconns)
+		}
+		if dbconfig.Dbconnmaxlifetime > 0 {
+			db.SetConnMaxLifetime(time.Duration(dbconfig.Dbconnmaxlifetime) * time.Second)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout(dbconfig))
+	defer cancel()
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("OpenStore(): ping %s: %w", store.dialect, err)
+	}
+	return store, nil
+}
+
+func dbTimeout(dbconfig *DBConfig) time.Duration {
+	if dbconfig.Dbtimeout > 0 {
+		return time.Duration(dbconfig.Dbtimeout) * time.Second
+	}
+	return 10 * time.Second
+}
+
+func dbTimezone(dbconfig *DBConfig) string {
+	if dbconfig.Dbtimezone != "" {
+		return dbconfig.Dbtimezone
+	}
+	return "Asia/Tokyo"
+}
+
+/*
+	resolveTLS()
+	以前の名前のDbsslmodeをDbtlsにしたDBConfig（コピー）を返します。
+	DbsslmodeだけのときにDbtlsを指定していないものとして扱うと、TLSを使わずに接続してしまうことがあるためです。
+*/
+func resolveTLS(dbconfig *DBConfig) (*DBConfig, error) {
+
+	if dbconfig.Dbsslmode == "" {
+		return dbconfig, nil
+	}
+	sslmode := dbconfig.Dbsslmode
+	if sslmode == "prefer" {
+		sslmode = "preferred"
+	}
+	if dbconfig.Dbtls != "" && dbconfig.Dbtls != sslmode {
+		return nil, fmt.Errorf("Dbsslmode <%s> conflicts with Dbtls <%s> (Dbsslmode is the old name of Dbtls)", dbconfig.Dbsslmode, dbconfig.Dbtls)
+	}
+	resolved := *dbconfig
+	resolved.Dbtls = sslmode
+	resolved.Dbsslmode = ""
+	return &resolved, nil
+}
+
+//	mysqlConfig はDBConfigからMySQLのドライバーの設定を作ります。
+func mysqlConfig(dbconfig *DBConfig) (cfg *mysql.Config, err error) {
+
+	cfg = mysql.NewConfig()
+	cfg.User = dbconfig.Dbuser
+	cfg.Passwd = dbconfig.Dbpw
+	cfg.DBName = dbconfig.Dbname
+	cfg.ParseTime = true
+	cfg.Timeout = dbTimeout(dbconfig)
+
+	if cfg.Loc, err = time.LoadLocation(dbTimezone(dbconfig)); err != nil {
+		return nil, fmt.Errorf("Dbtimezone: %w", err)
+	}
+
+	host := dbconfig.Dbhost
+	if host == "" {
+		host = "localhost"
+	}
+	if dbconfig.Dbsocket != "" {
+		cfg.Net = "unix"
+		cfg.Addr = dbconfig.Dbsocket
+	} else {
+		port := dbconfig.Dbport
+		if port == 0 {
+			port = 3306
+		}
+		cfg.Net = "tcp"
+		cfg.Addr = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	switch dbconfig.Dbtls {
+	case "":
+		if dbconfig.Dbca != "" {
+			return nil, fmt.Errorf("Dbca is specified but Dbtls is not")
+		}
+	case "disable":
+		cfg.TLSConfig = "false"
+	case "preferred":
+		cfg.TLSConfig = "preferred"
+	case "require":
+		cfg.TLSConfig = "skip-verify"
+	case "verify-ca", "verify-full":
+		tlsconfig, terr := verifyingTLSConfig(dbconfig.Dbca, host, dbconfig.Dbtls == "verify-full")
+		if terr != nil {
+			return nil, terr
+		}
+		//	RegisterTLSConfig()で登録した名前でDSNから参照される。
+		name := "ShowroomDBlib-" + dbconfig.Dbtls
+		if err = mysql.RegisterTLSConfig(name, tlsconfig); err != nil {
+			return nil, fmt.Errorf("Dbtls: %w", err)
+		}
+		cfg.TLSConfig = name
+	default:
+		return nil, fmt.Errorf("unknown Dbtls <%s>", dbconfig.Dbtls)
+	}
+	return cfg, nil
+}
+
+/*
+	verifyingTLSConfig()
+	サーバーの証明書をcafile（指定しないときはシステムのもの）のCAで検証するTLSの設定を作ります。
+	verifyhostがfalseのときは証明書の検証だけを行い、ホスト名は確認しません。
+*/
+func verifyingTLSConfig(cafile, host string, verifyhost bool) (*tls.Config, error) {
+
+	var roots *x509.CertPool
+	if cafile != "" {
+		pem, err := ioutil.ReadFile(cafile)
+		if err != nil {
+			return nil, fmt.Errorf("Dbca: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Dbca: no certificate in %s", cafile)
+		}
+	}
+
+	if verifyhost {
+		return &tls.Config{RootCAs: roots, ServerName: host}, nil
+	}
+
+	//	ホスト名を確認しないときは標準の検証を止め、証明書のチェーンだけを検証する。
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawcerts [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, len(rawcerts))
+			for i, raw := range rawcerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs[i] = cert
+			}
+			if len(certs) == 0 {
+				return fmt.Errorf("no server certificate")
+			}
+			opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(opts)
+			return err
+		},
+	}, nil
+}
+
+//	postgresDSN はDBConfigからPostgreSQLの接続文字列（key=value形式）を作ります。
+func postgresDSN(dbconfig *DBConfig) (string, error) {
+
+	params := [][2]string{
+		{"dbname", dbconfig.Dbname},
+		{"user", dbconfig.Dbuser},
+		{"password", dbconfig.Dbpw},
+		{"timezone", dbTimezone(dbconfig)},
+		{"connect_timeout", strconv.Itoa(int(dbTimeout(dbconfig) / time.Second))},
+	}
+	if dbconfig.Dbsocket != "" {
+		params = append(params, [2]string{"host", dbconfig.Dbsocket})
+	} else if dbconfig.Dbhost != "" {
+		params = append(params, [2]string{"host", dbconfig.Dbhost})
+	}
+	if dbconfig.Dbport != 0 {
+		params = append(params, [2]string{"port", strconv.Itoa(dbconfig.Dbport)})
+	}
+
+	switch dbconfig.Dbtls {
+	case "":
+	case "disable", "require", "verify-ca", "verify-full":
+		params = append(params, [2]string{"sslmode", dbconfig.Dbtls})
+	case "preferred":
+		//	lib/pqはsslmode=preferに対応していない（接続するときに "unsupported sslmode" になる）
+		return "", fmt.Errorf("Dbtls <preferred> (Dbsslmode <prefer>) is not supported by postgres, use require or disable")
+	default:
+		return "", fmt.Errorf("Dbtls <%s> is not supported by postgres", dbconfig.Dbtls)
+	}
+	if dbconfig.Dbca != "" {
+		if dbconfig.Dbtls != "verify-ca" && dbconfig.Dbtls != "verify-full" {
+			return "", fmt.Errorf("Dbca requires Dbtls verify-ca or verify-full")
+		}
+		params = append(params, [2]string{"sslrootcert", dbconfig.Dbca})
+	}
+
+	kv := make([]string, len(params))
+	for i, p := range params {
+		kv[i] = p[0] + "=" + pqQuote(p[1])
+	}
+	return strings.Join(kv, " "), nil
+}
+
+//	pqQuote はPostgreSQLの接続文字列の値を引用符で囲みます。
+func pqQuote(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
@@ -0,0 +1,331 @@
+package ShowroomDBlib
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+	listenerテーブルには、ルームの貢献ランキングに現れたリスナー（T_LsnID）ごとに一行を保存します。
+
+	t_lsnid		このプログラムが振ったリスナーのID
+	listner		最後に現れたときの名前（lsnid、avatarも同じ）
+	firstseen	最初に現れた配信（sampletm1）
+	lastseen	最後に現れた配信（sampletm1）
+	state		ListenerPresent、ListenerDropped
+
+	eventrankには配信のときに貢献ランキングに載っていたリスナーだけを保存します。
+	以前は貢献ランキングに載らなくなったリスナーも（Point = -1、Order = 999として）以後のすべての配信に保存していたので、
+	イベントの期間が長いとeventrankの行数が配信の数の二乗に比例して増えていました。
+	突き合わせ（CompareEventRanking()）には、前の配信の貢献ランキングにlistenerテーブルから
+	貢献ランキングに載らなくなったリスナーを加えたもの（PreviousRanking()）を渡します。
+
+	T_LsnIDはルームごとに1から順に振ります。次に振るものはlistener_seqテーブルに保存し、
+	貢献ランキングを保存するトランザクションの中で更新するので、複数のプロセスが同時に保存しても重複しません。
+	以前は Order + idx*1000（idxはそれまでの最大値から求めたもの）としていましたが、貢献ランキングが1000人を超えたり、
+	配信の数が多くなったりすると重複するおそれがありました。以前のT_LsnIDは振りなおし、対応をtlsnid_mapテーブルに残してあります。
+*/
+const (
+	ListenerPresent = 0 //	最後の配信の貢献ランキングに載っている
+	ListenerDropped = 1 //	最後の配信の貢献ランキングに載っていない
+)
+
+// Listener はlistenerテーブルの一つの行です。
+type Listener struct {
+	T_LsnID   int
+	Listner   string
+	LsnID     int
+	Avatar    string
+	Firstseen time.Time
+	Lastseen  time.Time
+	State     int
+}
+
+// Listeners はルームのリスナーをT_LsnIDの順に返します。
+func (s *Store) Listeners(ctx context.Context, eventid string, userid int) (listeners []Listener, err error) {
+	return s.selectListeners(ctx, s.db, eventid, userid)
+}
+
+func (s *Store) selectListeners(ctx context.Context, q dbtx, eventid string, userid int) (listeners []Listener, err error) {
+
+	query := "select t_lsnid, listner, lsnid, avatar, firstseen, lastseen, state from listener where eventid = ? and userid = ? order by t_lsnid"
+	rows, err := q.QueryContext(ctx, s.rebind(query), eventid, userid)
+	if err != nil {
+		return nil, fmt.Errorf("Listeners() eventid=%s userid=%d: %w", eventid, userid, err)
+	}
+	defer rows.Close()
+
+	var l Listener
+	for rows.Next() {
+		if err = rows.Scan(&l.T_LsnID, &l.Listner, &l.LsnID, &l.Avatar, &l.Firstseen, &l.Lastseen, &l.State); err != nil {
+			return nil, fmt.Errorf("Listeners() scan: %w", err)
+		}
+		listeners = append(listeners, l)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Listeners() rows: %w", err)
+	}
+	return listeners, nil
+}
+
+/*
+	PreviousRanking()
+	sampleの突き合わせの相手になる貢献ランキングを返します。
+	前の配信の貢献ランキング（PreviousSnapshot()）に、sampleより前に現れたがそこに載っていないリスナーを
+	Point = -1、Incremental = -1、Order = 999 として加えたものです（以前のeventrankに保存されていたものと同じ形）
+	どちらもないときは ErrNoSnapshot を返します。
+*/
+func (s *Store) PreviousRanking(ctx context.Context, sample Sample) (sampletm1 time.Time, eventranking EventRanking, err error) {
+
+	sampletm1, eventranking, err = s.PreviousSnapshot(ctx, sample)
+	if err != nil && !errors.Is(err, ErrNoSnapshot) {
+		return
+	}
+
+	listeners, err := s.Listeners(ctx, sample.Eventid, sample.Userid)
+	if err != nil {
+		return
+	}
+	present := make(map[int]bool, len(eventranking))
+	for _, evr := range eventranking {
+		present[evr.T_LsnID] = true
+	}
+	for _, l := range listeners {
+		if present[l.T_LsnID] || !l.Firstseen.Before(sample.Sampletm1) {
+			continue
+		}
+		eventranking = append(eventranking, EventRank{
+			Order:       999,
+			Listner:     l.Listner,
+			LsnID:       l.LsnID,
+			Avatar:      l.Avatar,
+			T_LsnID:     l.T_LsnID,
+			Point:       -1,
+			Incremental: -1,
+		})
+	}
+
+	if len(eventranking) == 0 {
+		return sampletm1, nil, ErrNoSnapshot
+	}
+	return sampletm1, eventranking, nil
+}
+
+/*
+	updateListeners()
+	突き合わせの結果の貢献ランキング（貢献ランキングに載らなくなったリスナーを含む）でlistenerテーブルを更新します。
+	遅れて処理した配信（sampletm1がlastseenより前のもの）では名前や状態を古いもので上書きしないようにします。
+
+	ほとんどのリスナーはlastseenが変わるだけなので、それはまとめて一つのupdateで更新します。
+*/
+func (s *Store) updateListeners(ctx context.Context, q dbtx, sample Sample, eventranking EventRanking) error {
+
+	listeners, err := s.selectListeners(ctx, q, sample.Eventid, sample.Userid)
+	if err != nil {
+		return err
+	}
+	existing := make(map[int]Listener, len(listeners))
+	for _, l := range listeners {
+		existing[l.T_LsnID] = l
+	}
+
+	t := sample.Sampletm1
+	var inserts, updates []Listener
+	var seen, dropped []interface{}
+	for _, evr := range eventranking {
+		l, ok := existing[evr.T_LsnID]
+		if !ok {
+			state := ListenerPresent
+			if evr.Point < 0 {
+				state = ListenerDropped
+			}
+			inserts = append(inserts, Listener{T_LsnID: evr.T_LsnID, Listner: evr.Listner, LsnID: evr.LsnID, Avatar: evr.Avatar, Firstseen: t, Lastseen: t, State: state})
+			existing[evr.T_LsnID] = inserts[len(inserts)-1]
+			continue
+		}
+		if evr.Point < 0 {
+			if l.State == ListenerPresent && t.After(l.Lastseen) {
+				dropped = append(dropped, evr.T_LsnID)
+			}
+			continue
+		}
+
+		changed := false
+		if t.Before(l.Firstseen) {
+			l.Firstseen = t
+			changed = true
+		}
+		if !t.Before(l.Lastseen) {
+			if l.Listner != evr.Listner || l.LsnID != evr.LsnID || l.Avatar != evr.Avatar {
+				l.Listner, l.LsnID, l.Avatar = evr.Listner, evr.LsnID, evr.Avatar
+				changed = true
+			}
+			l.Lastseen = t
+			l.State = ListenerPresent
+			if !changed {
+				seen = append(seen, evr.T_LsnID)
+			}
+		}
+		if changed {
+			updates = append(updates, l)
+		}
+	}
+
+	if err = s.insertListeners(ctx, q, sample, inserts); err != nil {
+		return err
+	}
+	query := "update listener set lastseen = ?, state = ? where eventid = ? and userid = ? and t_lsnid in "
+	if err = s.updateIn(ctx, q, query, []interface{}{t, ListenerPresent, sample.Eventid, sample.Userid}, seen); err != nil {
+		return err
+	}
+	query = "update listener set state = ? where eventid = ? and userid = ? and t_lsnid in "
+	if err = s.updateIn(ctx, q, query, []interface{}{ListenerDropped, sample.Eventid, sample.Userid}, dropped); err != nil {
+		return err
+	}
+
+	query = "update listener set listner = ?, lsnid = ?, avatar = ?, firstseen = ?, lastseen = ?, state = ? where eventid = ? and userid = ? and t_lsnid = ?"
+	for _, l := range updates {
+		_, err = q.ExecContext(ctx, s.rebind(query), l.Listner, l.LsnID, l.Avatar, l.Firstseen, l.Lastseen, l.State, sample.Eventid, sample.Userid, l.T_LsnID)
+		if err != nil {
+			return fmt.Errorf("update listener eventid=%s userid=%d t_lsnid=%d: %w", sample.Eventid, sample.Userid, l.T_LsnID, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) insertListeners(ctx context.Context, q dbtx, sample Sample, listeners []Listener) error {
+
+	batchsize := s.rowsPerInsert()
+	const row = "(?,?,?,?,?,?,?,?,?)"
+	for start := 0; start < len(listeners); start += batchsize {
+		end := start + batchsize
+		if end > len(listeners) {
+			end = len(listeners)
+		}
+		chunk := listeners[start:end]
+
+		query := "insert into listener (eventid, userid, t_lsnid, listner, lsnid, avatar, firstseen, lastseen, state)"
+		query += " values" + strings.Repeat(row+",", len(chunk)-1) + row
+		args := make([]interface{}, 0, len(chunk)*9)
+		for _, l := range chunk {
+			args = append(args, sample.Eventid, sample.Userid, l.T_LsnID, l.Listner, l.LsnID, l.Avatar, l.Firstseen, l.Lastseen, l.State)
+		}
+		if _, err := q.ExecContext(ctx, s.rebind(query), args...); err != nil {
+			return fmt.Errorf("insert into listener eventid=%s userid=%d: %w", sample.Eventid, sample.Userid, err)
+		}
+	}
+	return nil
+}
+
+//	updateIn はqueryの末尾に "(?,?,...)" を加え、idsをbatchsize個ずつに分けて実行します。
+func (s *Store) updateIn(ctx context.Context, q dbtx, query string, args []interface{}, ids []interface{}) error {
+
+	batchsize := s.rowsPerInsert()
+	for start := 0; start < len(ids); start += batchsize {
+		end := start + batchsize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		in := "(" + strings.Repeat("?,", end-start-1) + "?)"
+		if _, err := q.ExecContext(ctx, s.rebind(query+in), append(append([]interface{}{}, args...), ids[start:end]...)...); err != nil {
+			return fmt.Errorf("update listener: %w", err)
+		}
+	}
+	return nil
+}
+
+/*
+	AllocateTLsnIDs()
+	ルームのリスナーのT_LsnIDをn個振り、最初のものを返します（first、first+1、...、first+n-1）
+*/
+func (s *Store) AllocateTLsnIDs(ctx context.Context, eventid string, userid int, n int) (first int, err error) {
+	err = s.inTx(ctx, func(tx *sql.Tx) error {
+		first, err = s.allocateTLsnIDs(ctx, tx, eventid, userid, n, 1)
+		return err
+	})
+	return
+}
+
+//	allocateTLsnIDs はT_LsnIDをn個振ります。floorより小さいものは振りません（すでに使われているT_LsnIDを避けるため）
+func (s *Store) allocateTLsnIDs(ctx context.Context, q dbtx, eventid string, userid int, n int, floor int) (first int, err error) {
+
+	//	はじめてのルームならlistener_seqの行を作る（listenerにあるものがあればその次から）
+	//	二つのトランザクションが同時に作ろうとしても、一方が作り他方は何もしない（主キーが重複してエラーになることはない）
+	var nextid int
+	query := "select nextid from listener_seq where eventid = ? and userid = ?"
+	err = q.QueryRowContext(ctx, s.rebind(query), eventid, userid).Scan(&nextid)
+	if errors.Is(err, sql.ErrNoRows) {
+		var maxid int
+		query = "select coalesce(max(t_lsnid), 0) from listener where eventid = ? and userid = ?"
+		if err = q.QueryRowContext(ctx, s.rebind(query), eventid, userid).Scan(&maxid); err != nil {
+			return 0, fmt.Errorf("select max(t_lsnid) eventid=%s userid=%d: %w", eventid, userid, err)
+		}
+		nextid = maxid + 1
+		if nextid < floor {
+			nextid = floor
+		}
+		query = "insert into listener_seq (eventid, userid, nextid) values (?, ?, ?)"
+		if s.dialect == "mysql" {
+			query += " on duplicate key update nextid = nextid"
+		} else {
+			query += " on conflict (eventid, userid) do nothing"
+		}
+		if _, err = q.ExecContext(ctx, s.rebind(query), eventid, userid, nextid); err != nil {
+			return 0, fmt.Errorf("insert into listener_seq eventid=%s userid=%d: %w", eventid, userid, err)
+		}
+	} else if err != nil {
+		return 0, fmt.Errorf("select listener_seq eventid=%s userid=%d: %w", eventid, userid, err)
+	}
+
+	//	更新して行をロックし、他のトランザクションが同じものを振らないようにする。
+	query = "update listener_seq set nextid = nextid + ? where eventid = ? and userid = ?"
+	if _, err = q.ExecContext(ctx, s.rebind(query), n, eventid, userid); err != nil {
+		return 0, fmt.Errorf("update listener_seq eventid=%s userid=%d: %w", eventid, userid, err)
+	}
+	query = "select nextid from listener_seq where eventid = ? and userid = ?"
+	if err = q.QueryRowContext(ctx, s.rebind(query), eventid, userid).Scan(&nextid); err != nil {
+		return 0, fmt.Errorf("select listener_seq eventid=%s userid=%d: %w", eventid, userid, err)
+	}
+
+	first = nextid - n
+	if first < floor {
+		first = floor
+		query = "update listener_seq set nextid = ? where eventid = ? and userid = ?"
+		if _, err = q.ExecContext(ctx, s.rebind(query), first+n, eventid, userid); err != nil {
+			return 0, fmt.Errorf("update listener_seq eventid=%s userid=%d: %w", eventid, userid, err)
+		}
+	}
+	return first, nil
+}
+
+//	assignTLsnIDs はT_LsnIDが0のリスナー（新たに現れたもの）にT_LsnIDを振ります。
+func (s *Store) assignTLsnIDs(ctx context.Context, q dbtx, sample Sample, eventranking EventRanking) error {
+
+	n, floor := 0, 1
+	for _, evr := range eventranking {
+		if evr.T_LsnID == 0 {
+			n++
+		} else if evr.T_LsnID >= floor {
+			floor = evr.T_LsnID + 1
+		}
+	}
+	if n == 0 && floor == 1 {
+		return nil
+	}
+
+	first, err := s.allocateTLsnIDs(ctx, q, sample.Eventid, sample.Userid, n, floor)
+	if err != nil {
+		return err
+	}
+	for i := range eventranking {
+		if eventranking[i].T_LsnID == 0 {
+			eventranking[i].T_LsnID = first
+			first++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package ShowroomDBlib
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+/*
+	スキーマ（テーブル、カラム、インデックス）の作成と更新
+
+	schema/{dialect}/NNNN_name.sql に番号順に適用するSQLを置き、実行モジュールに埋め込みます。
+	適用したものはschema_versionテーブルに記録し、まだ適用していないものだけを適用します。
+	作成済みのテーブルにこれまでの版のコメントにあるalter tableを手で実行していた場合も、
+	「すでに存在する」というエラーになった文は適用済みとみなすので、そのままMigrate()で最新にできます。
+
+	スキーマの版を上げたときは、ここにSQLを追加し、それを使うコードと一緒にリリースしてください。
+	起動時にCheckSchema()でスキーマが最新であることを確認します（古いときは migrate を実行するよう促して止まります）
+*/
+
+//go:embed schema
+var schemaFS embed.FS
+
+var (
+	ErrSchemaMissing  = errors.New("ShowroomDBlib: schema_version table does not exist")
+	ErrSchemaOutdated = errors.New("ShowroomDBlib: schema is older than this program (run migrate)")
+	ErrSchemaTooNew   = errors.New("ShowroomDBlib: schema is newer than this program")
+)
+
+// Migration はスキーマの一つの版です。
+type Migration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+// Migrations は埋め込まれているdialectのスキーマの版を古い順に返します。
+func Migrations(dialect string) (migrations []Migration, err error) {
+
+	dir := path.Join("schema", dialect)
+	entries, err := fs.ReadDir(schemaFS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("Migrations(): unknown dialect <%s>: %w", dialect, err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		i := strings.Index(name, "_")
+		if i < 0 {
+			return nil, fmt.Errorf("Migrations(): bad file name <%s>", name)
+		}
+		version, cerr := strconv.Atoi(name[:i])
+		if cerr != nil {
+			return nil, fmt.Errorf("Migrations(): bad file name <%s>", name)
+		}
+		content, rerr := fs.ReadFile(schemaFS, path.Join(dir, name))
+		if rerr != nil {
+			return nil, rerr
+		}
+		migrations = append(migrations, Migration{
+			Version:    version,
+			Name:       strings.TrimSuffix(name[i+1:], ".sql"),
+			Statements: splitStatements(string(content)),
+		})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("Migrations(): version %d is missing", i+1)
+		}
+	}
+	return migrations, nil
+}
+
+//	splitStatements はSQLのファイルを文に分けます。"--"で始まる行はコメントとして除き、行末の";"で区切ります。
+func splitStatements(content string) (statements []string) {
+
+	var buf strings.Builder
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(buf.String()), ";"))
+			buf.Reset()
+		}
+	}
+	if s := strings.TrimSpace(buf.String()); s != "" {
+		statements = append(statements, s)
+	}
+	return
+}
+
+// Migrations はStoreのデータベースに適用するスキーマの版を古い順に返します。
+func (s *Store) Migrations() ([]Migration, error) {
+	return Migrations(s.dialect)
+}
+
+// LatestSchemaVersion はこのプログラムが必要とするスキーマの版を返します。
+func (s *Store) LatestSchemaVersion() (int, error) {
+	migrations, err := s.Migrations()
+	if err != nil {
+		return 0, err
+	}
+	return len(migrations), nil
+}
+
+// SchemaVersion はデータベースのスキーマの版を返します。schema_versionテーブルがないときは ErrSchemaMissing を返します。
+func (s *Store) SchemaVersion(ctx context.Context) (version int, err error) {
+
+	err = s.db.QueryRowContext(ctx, "select coalesce(max(version), 0) from schema_version").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrSchemaMissing, err)
+	}
+	return version, nil
+}
+
+// CheckSchema はデータベースのスキーマがこのプログラムが必要とする版であることを確認します。
+func (s *Store) CheckSchema(ctx context.Context) error {
+
+	latest, err := s.LatestSchemaVersion()
+	if err != nil {
+		return err
+	}
+	version, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case version < latest:
+		return fmt.Errorf("%w: version %d, required %d", ErrSchemaOutdated, version, latest)
+	case version > latest:
+		return fmt.Errorf("%w: version %d, required %d", ErrSchemaTooNew, version, latest)
+	}
+	return nil
+}
+
+func (s *Store) createSchemaVersion(ctx context.Context) error {
+
+	applied := "datetime"
+	if s.dialect == "postgres" {
+		applied = "timestamp with time zone"
+	}
+	query := "create table if not exists schema_version (version int not null primary key, name varchar(255) not null, applied " + applied + " not null)"
+	if _, err := s.db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("create table schema_version: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) recordVersion(ctx context.Context, q dbtx, m Migration) error {
+
+	query := "insert into schema_version (version, name, applied) values (?, ?, ?)"
+	if _, err := q.ExecContext(ctx, s.rebind(query), m.Version, m.Name, time.Now()); err != nil {
+		return fmt.Errorf("insert into schema_version version=%d: %w", m.Version, err)
+	}
+	return nil
+}
+
+/*
+	Migrate()
+	まだ適用していないスキーマの版を順に適用し、適用前と適用後の版を返します。
+	logfは適用する版と文を記録するためのものです（nilでもかまいません）
+
+	一つの版の文とschema_versionへの記録は一つのトランザクションで実行します。
+	SQLite、PostgreSQLでは版の途中で失敗したときはその版の文はすべて取り消されます。
+	MySQLではcreate table、alter tableはトランザクションの中でも自動的にコミットされるので、
+	版の途中で失敗したときはそれまでの文が残ることがあります（insert、updateだけの版は取り消されます）
+	原因を取り除いてもう一度実行してください（適用済みの文は「すでに存在する」というエラーになり、適用済みとみなされます）
+	PostgreSQLではエラーになるとトランザクションの以後の文が実行できないので、PostgreSQLの版は「if not exists」などで
+	エラーにならないように書いてください。
+*/
+func (s *Store) Migrate(ctx context.Context, logf func(format string, args ...interface{})) (from, to int, err error) {
+
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+
+	migrations, err := Migrations(s.dialect)
+	if err != nil {
+		return
+	}
+	if err = s.createSchemaVersion(ctx); err != nil {
+		return
+	}
+	if from, err = s.SchemaVersion(ctx); err != nil {
+		return
+	}
+	to = from
+
+	for _, m := range migrations {
+		if m.Version <= from {
+			continue
+		}
+		logf("migrate: %04d %s\n", m.Version, m.Name)
+		err = s.inTx(ctx, func(tx *sql.Tx) error {
+			for _, stmt := range m.Statements {
+				logf("  %s\n", strings.Join(strings.Fields(stmt), " "))
+				if _, eerr := tx.ExecContext(ctx, stmt); eerr != nil {
+					if s.alreadyApplied(eerr) {
+						logf("  (already applied: %v)\n", eerr)
+						continue
+					}
+					return fmt.Errorf("migrate %04d %s: %w", m.Version, m.Name, eerr)
+				}
+			}
+			return s.recordVersion(ctx, tx, m)
+		})
+		if err != nil {
+			return
+		}
+		to = m.Version
+	}
+	return
+}
+
+/*
+	Baseline()
+	スキーマの版をversionまで適用済みとして記録します（SQLは実行しません）
+	手でテーブルを作成、更新してきたデータベースで、どこまで適用済みかがわかっているときに使います。
+*/
+func (s *Store) Baseline(ctx context.Context, version int) error {
+
+	migrations, err := Migrations(s.dialect)
+	if err != nil {
+		return err
+	}
+	if version < 0 || version > len(migrations) {
+		return fmt.Errorf("Baseline(): version %d is out of range (0-%d)", version, len(migrations))
+	}
+	if err = s.createSchemaVersion(ctx); err != nil {
+		return err
+	}
+	current, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if current >= version {
+		return nil
+	}
+	for _, m := range migrations[current:version] {
+		if err = s.recordVersion(ctx, s.db, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//	alreadyApplied はエラーが「すでに存在する」（削除するものは「存在しない」）というものであるかを判定します。
+func (s *Store) alreadyApplied(err error) bool {
+
+	switch s.dialect {
+	case "mysql":
+		var merr *mysql.MySQLError
+		if errors.As(err, &merr) {
+			switch merr.Number {
+			case 1050, //	ER_TABLE_EXISTS_ERROR
+				1060, //	ER_DUP_FIELDNAME
+				1061, //	ER_DUP_KEYNAME
+				1068, //	ER_MULTIPLE_PRI_KEY
+				1091: //	ER_CANT_DROP_FIELD_OR_KEY（削除済み）
+				return true
+			}
+		}
+	case "postgres":
+		var perr *pq.Error
+		if errors.As(err, &perr) {
+			switch perr.Code {
+			case "42P07", //	duplicate_table
+				"42701", //	duplicate_column
+				"42710": //	duplicate_object
+				return true
+			}
+		}
+	case "sqlite":
+		msg := err.Error()
+		return strings.Contains(msg, "duplicate column name") || strings.Contains(msg, "already exists")
+	}
+	return false
+}
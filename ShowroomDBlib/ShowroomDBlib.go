@@ -1,7 +1,8 @@
 package ShowroomDBlib
 
 import (
-	//	"fmt"
+	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"time"
@@ -20,21 +21,126 @@ import (
 	20A00	結果をDBで保存する。Excel保存の機能は残存。次に向けての作り込み少々。
 	2.0B00		データ取得のタイミングをtimetableから得る。Excelへのデータの保存をやめる。
 	2.0B01	timetableの更新で処理が終わっていないものを処理済みにしていた問題を修正する。
+	2.1A00	貢献ランキングの取得に失敗したtimetableの行をリトライ待ちとし、一定回数失敗したら保留にする。
+	2.1B00	取得した貢献ランキングのページをcontpageテーブルに保存できるようにする。
+	2.1C00	保存したページやeventrankのデータから突き合わせを再実行（replay）するための関数を追加する。
+	2.1D00	リスナーのID（lsnid）に加えてアバター（avatar）を保存する。
+			alter table eventrank add column avatar varchar(255) not null default '';
+			（eventrank_replayにも同じカラムを追加します）
+	2.1E00	貢献ランキングのポイントの合計、ページに表示されたルームのポイント、その検証結果をtimetableに保存する。
+	2.1F00	貢献ランキングを取得すべきtimetableの行をまとめて取得する関数を追加する（複数のワーカーで並行して処理するため）
+			DBのエラーをパッケージ変数Errではなくローカル変数で扱う（OpenDb()を除く）
+	2.1G00	timetableの行を確保（status = 3、worker、leaseexpiry）してから処理する。複数のプロセスで同じ配信を処理しないようにする。
+	2.2A00	データベースへのアクセスをStore（Store.go）にまとめる。Storeのメソッドはcontextを受け取りerrorを返す。
+			以前からの関数はStoreを呼び出してstatusを返すものとして残す。
+	2.2B00	貢献ランキングの保存とtimetableの更新を一つのトランザクションで行う（CommitSample()）
+			同じ時刻の貢献ランキングは置き換える。
+			alter table eventrank add unique key eventrank_snapshot (eventid, userid, ts, t_lsnid);
+	2.2C00	スキーマ（schema/mysql/*.sql）を埋め込み、版を管理して作成、更新する（Migrate.go）
+			これまでの版のコメントにあるalter tableはMigrate()で適用されます（手で実行する必要はありません）
+	2.2D00	SQLite（modernc.org/sqlite）を使えるようにする（ServerConfig.ymlで Dbdriver: sqlite、Dbpath を指定する）
+	2.2E00	PostgreSQL（github.com/lib/pq）を使えるようにする（ServerConfig.ymlで Dbdriver: postgres を指定する）
+			スキーマは schema/postgres/*.sql で、時刻はtimestamp with time zoneに保存する。
+	2.2F00	接続の設定（ポート、ソケット、TLS、タイムゾーン、接続数、タイムアウト）をServerConfig.ymlで指定できるようにする。
+			MySQLのDSNを文字列で組み立てるのをやめ、mysql.Configから作る。オープンしたときにPingで接続を確認する。
+			Dbsslmode は Dbtls に変更する。
+	2.2G00	eventrankの貢献ランキングをtimetableの行（sampletm1）をキーにして保存する。取得した時刻はfetchtmに保存する。
+			以前の貢献ランキングとしてsampletm1がその前のものを使えるようにする（PreviousSnapshot()）
+	2.2H00	貢献ランキングを複数行のinsertでまとめて保存する（一つのinsertの行数はServerConfig.ymlのDbbatchsize）
+	2.2I00	リスナーごとの名前、最初と最後に現れた配信、状態をlistenerテーブルに保存する（Listener.go）
+			eventrankには貢献ランキングに載っているリスナーだけを保存する。
+	2.2J00	T_LsnIDをルームごとに1から順に振るAllocateTLsnIDs()を追加する（次に振るものはlistener_seqテーブルに保存する）
+			SaveSnapshot()、CommitSample()はT_LsnIDが0のリスナーにT_LsnIDを振る。
+			スキーマの版を上げるときは、版ごとに一つのトランザクションで実行する。
+	2.2K00	突き合わせの判定に使った値をtimetableのmatchparamsに保存する（SampleResult.Matchparams、MatchParams()）
+	2.2L00	EventRankにPrevname、Method、Distanceを追加し、eventrank、eventrank_replayに保存する。
+	2.2M00	獲得ポイントを監視しているプロセスがtimetableにポイント（earnedpoint）を記録するための
+			InsertIntoTimetable()、UpdateEarnedpointInTimetable()（StoreのInsertSample()、RecordEarnedPoint()）を追加する。
+			これまでearnedpointを記録するものがなかったため、貢献ランキングのポイントの合計との比較は行われていなかった。
+	2.2M01	OpenDb()する前に以前からの関数を呼んでもパニックせず、それぞれのエラーの値を返すようにする。
+	2.2M02	以前からの関数はOpenDb()でオープンしたStoreを使う（これまではSQLite、PostgreSQLでもMySQLとして扱い、Dbbatchsizeも無視していた）
+	2.2M03	InsertIntoEventrank()は取得した時刻（sampletm2）ではなく、その配信のsampletm1をキーにして保存する（SampleFetchedAt()）
+			同じ配信を取得しなおしたときに別のスナップショットとして保存されていた。
+	2.2M04	スキーマの版0007で一意キーを追加する前に、重複して保存されている貢献ランキングの行を削除する
+			（これまでは重複している行があると版0007が失敗し、スキーマを更新できなかった）
+	2.2M05	Dbtlsの以前の名前のDbsslmodeも読み込む（Dbtlsを指定していないときに使う、異なるものを指定したときはエラーにする）
+			これまではDbsslmodeを無視していたので、書き換えていない設定ではTLSを使わずに接続していた。
+			PostgreSQLでもDbtls: preferred（sslmode=prefer）を使えるようにする。
+	2.2M06	はじめてのルームでT_LsnIDを同時に振ったときに主キーが重複してエラーになることがあったのを修正する
+			batchsizeが0のStore（SetBatchSize()を通さずに作ったもの）でもリスナーを保存できるようにする
+	2.2M07	PostgreSQLでDbtls: preferred（Dbsslmode: prefer）を指定したときは設定の誤りとする
+			（2.2M05ではsslmode=preferとしていたが、lib/pqは対応していないので接続できなかった）
+	2.2M08	InsertIntoEventrank()で保留（status = 9）の配信を貢献ランキングを取得した配信としない
+			（古い配信が保留になっているルームでは、新しい貢献ランキングがその配信のものとして保存されていた）
 
 */
 
-const Version = "20B01"
+const Version = "22M08"
+
+/*
+	timetableのstatus
+
+	TimetableWaiting	0	貢献ランキングの取得待ち（獲得ポイントを監視しているプロセスが登録する）
+	TimetableDone		1	処理済み
+	TimetableRetry		2	取得に失敗したのでnextretryになったら再度取得する
+	TimetableClaimed	3	処理中（workerが処理している、leaseexpiryを過ぎたら他のworkerが処理してよい）
+	TimetableParked		9	規定の回数取得に失敗したので保留にしている（確認後statusを0に戻せば再度取得する）
+
+	TimetableRetry、TimetableParkedのために timetable に次のカラムが必要です。
+
+		alter table timetable add column attempts int not null default 0;
+		alter table timetable add column lasterror varchar(255);
+		alter table timetable add column nextretry datetime;
+
+	TimetableClaimedのために timetable に次のカラムが必要です。
+
+		alter table timetable add column worker varchar(64);
+		alter table timetable add column leaseexpiry datetime;
+*/
+const (
+	TimetableWaiting = 0
+	TimetableDone    = 1
+	TimetableRetry   = 2
+	TimetableClaimed = 3
+	TimetableParked  = 9
+)
+
+/*
+	timetableに保存するルームのポイント
+
+	earnedpoint	獲得ポイントを監視しているプロセスが記録した配信終了時点のルームのポイント（記録されていなければnull）
+	sumpoint	貢献ランキングのポイントの合計
+	disppoint	貢献ランキングのページに表示されていたルームのポイント（表示されていなければ-1）
+	pointcheck	sumpoint、disppointとearnedpointを比較した結果
+			PointCheckNone		-1	earnedpointがないので比較していない
+			PointCheckOK		0	許容範囲内
+			PointCheckDiverged	1	許容範囲を超えて異なる
+
+		alter table timetable add column earnedpoint int;
+		alter table timetable add column sumpoint int not null default 0;
+		alter table timetable add column disppoint int not null default -1;
+		alter table timetable add column pointcheck int not null default -1;
+*/
+const (
+	PointCheckNone     = -1
+	PointCheckOK       = 0
+	PointCheckDiverged = 1
+)
 
 type EventRank struct {
 	Order       int
 	Rank        int
 	Listner     string
-	Lastname    string
-	LsnID       int
+	Lastname    string //	表示用（"前回の名前 [3A 0.512]" など）、調べるときはPrevname、Method、Distanceを使う
+	LsnID       int    //	リスナーのID（わからないときは0）
+	Avatar      string //	アバターのURL
 	T_LsnID     int
 	Point       int
 	Incremental int
 	Status      int
+	Prevname    string  //	前回の名前（名前が変わっていないときは""）
+	Method      string  //	突き合わせの判定の方法（id、exact、unique-higher、3A、3B、3C、new、lost）
+	Distance    float64 //	名前の距離（3A、3B、3Cのとき）
 }
 
 // 構造体のスライス
@@ -64,6 +170,21 @@ type DBConfig struct {
 	Dbname    string `yaml:"Dbname"`
 	Dbuser    string `yaml:"Dbuser"`
 	Dbpw      string `yaml:"Dbpw"`
+	Dbdriver  string `yaml:"Dbdriver"` //	"mysql"（デフォルト）、"sqlite" または "postgres"
+	Dbpath    string `yaml:"Dbpath"`   //	SQLiteのデータベースファイル
+
+	//	以下はOpenStore()を参照
+	Dbport            int    `yaml:"Dbport"`
+	Dbsocket          string `yaml:"Dbsocket"`
+	Dbtls             string `yaml:"Dbtls"`
+	Dbsslmode         string `yaml:"Dbsslmode"` //	Dbtlsの以前の名前
+	Dbca              string `yaml:"Dbca"`
+	Dbtimezone        string `yaml:"Dbtimezone"`
+	Dbtimeout         int    `yaml:"Dbtimeout"`
+	Dbmaxopenconns    int    `yaml:"Dbmaxopenconns"`
+	Dbmaxidleconns    int    `yaml:"Dbmaxidleconns"`
+	Dbconnmaxlifetime int    `yaml:"Dbconnmaxlifetime"`
+	Dbbatchsize       int    `yaml:"Dbbatchsize"`
 }
 
 var Db *sql.DB
@@ -89,22 +210,48 @@ func LoadConfig(filePath string) (dbconfig *DBConfig, err error) {
 	return result, nil
 }
 
+/*
+	以下は以前からの関数です。パッケージ変数Dbを使うStoreを呼び出し、結果をstatus（0: 正常終了、負: エラー）で返します。
+	新しく書くものはStoreのメソッドを使ってください。
+*/
+
+//	dbstore はOpenDb()でオープンしたStoreです（以前からの関数はこれを使います）
+var dbstore *Store
+
+//	compat は以前からの関数が使うStoreを返します。
+//	OpenDb()でオープンしたもの（ServerConfig.ymlのDbdriver、Dbbatchsizeにしたがったもの）を返し、
+//	Dbを直接設定しているときはDbを使うStore（MySQL）を返します。
+//	OpenDb()していない（Dbがnil）ときは ErrNotOpen を返します（呼び出したもの（caller）はそれぞれのエラーの値を返してください）
+func compat(caller string) (*Store, error) {
+	if Db == nil {
+		log.Printf("%s() err=[%s]\n", caller, ErrNotOpen.Error())
+		return nil, ErrNotOpen
+	}
+	if dbstore != nil && dbstore.db == Db {
+		return dbstore, nil
+	}
+	return NewStore(Db), nil
+}
+
 func OpenDb(dbconfig *DBConfig) (status int) {
 
 	status = 0
 
-	if dbconfig.Dbhost == "" {
-		Db, Err = sql.Open("mysql", (*dbconfig).Dbuser+":"+(*dbconfig).Dbpw+"@/"+(*dbconfig).Dbname+"?parseTime=true&loc=Asia%2FTokyo")
-	} else {
-		Db, Err = sql.Open("mysql", (*dbconfig).Dbuser+":"+(*dbconfig).Dbpw+"@tcp("+(*dbconfig).Dbhost+":3306)/"+(*dbconfig).Dbname+"?parseTime=true&loc=Asia%2FTokyo")
-	}
-
+	var store *Store
+	store, Err = OpenStore(dbconfig)
 	if Err != nil {
 		status = -1
+		return
 	}
+	Db = store.DB()
+	dbstore = store
 	return
 }
 
+//	InsertIntoEventrank はsampletm2に取得した貢献ランキングを、その配信（timetableの行、StoreのSampleFetchedAt()）のものとして保存します。
+//	保存するキーは配信のsampletm1なので、同じ配信を取得しなおして保存したときは置き換えられます。
+//	timetableに行がないときはsampletm2の配信のものとします。
+//	timetableの行がわかっているときはStoreのCommitSample()、SaveSnapshot()を使ってください。
 func InsertIntoEventrank(
 	eventid	string,
 	userno	int,
@@ -114,30 +261,21 @@ func InsertIntoEventrank(
 	status int,
 ) {
 
-	status = 0
-
-	ts := time.Now().Truncate(time.Minute)
-
-	var row *sql.Stmt
-	sql := "INSERT INTO eventrank(eventid, userid, ts, listner, lastname, lsnid, t_lsnid, norder, nrank, point, increment, status)"
-	sql += " VALUES(?,?,?,?,?,?,?,?,?,?,?,?)"
-	row, Err = Db.Prepare(sql)
-	if Err != nil {
-		log.Printf("InsertIntoPoints() prepare() err=[%s]\n", Err.Error())
-		status = -1
+	store, err := compat("InsertIntoEventrank")
+	if err != nil {
+		return -1
 	}
-	defer row.Close()
-
-	for _, evr := range eventranking {
-
-		_, Err = row.Exec(eventid, userno, ts, evr.Listner, evr.Lastname, evr.LsnID, evr.T_LsnID, evr.Order, evr.Rank, evr.Point, evr.Incremental, 0)
-
-		if Err != nil {
-			log.Printf("InsertIntoEventrank() exec() err=[%s]\n", Err.Error())
-			status = -1
-		}
+	sample, err := store.SampleFetchedAt(context.Background(), eventid, userno, sampletm2)
+	if errors.Is(err, ErrNoSample) {
+		sample.Sampletm1 = sampletm2
+	} else if err != nil {
+		log.Printf("InsertIntoEventrank() err=[%s]\n", err.Error())
+		return -1
+	}
+	if err := store.SaveSnapshot(context.Background(), sample, sampletm2, eventranking); err != nil {
+		log.Printf("InsertIntoEventrank() err=[%s]\n", err.Error())
+		status = -1
 	}
-
 	return
 }
 
@@ -149,33 +287,21 @@ func SelectMaxTsFromEventrank(
 	maxts	time.Time,
 ) {
 
-//	獲得ポイントのデータが何セットあるか調べる。
-	sql := "select count(ts) from (select distinct(ts) from eventrank where eventid = ? and userid = ? ) tmptable"
-	Err = Db.QueryRow(sql, eventid, userid).Scan(&ndata)
-
-	if Err != nil {
-		log.Printf("select count(ts) from (select distinct(ts) from eventrank  where eventid = %s and userid = %d ) tmptable ==> %d\n", eventid, userid, ndata)
-		log.Printf("err=[%s]\n", Err.Error())
+	store, err := compat("SelectMaxTsFromEventrank")
+	if err != nil {
+		return -1, maxts
+	}
+	tslist, err := store.SnapshotTimes(context.Background(), eventid, userid)
+	if err != nil {
+		log.Printf("SelectMaxTsFromEventrank() err=[%s]\n", err.Error())
 		ndata = -1
 		return
 	}
-	if ndata == 0 {
-		return
+	ndata = len(tslist)
+	if ndata > 0 {
+		maxts = tslist[ndata-1]
 	}
-
-//	直近の獲得ポイントデータのタイムスタンプを取得する。
-	sql = "select max(ts) from eventrank where eventid = ? and userid = ? "
-	Err = Db.QueryRow(sql, eventid, userid).Scan(&maxts)
-
-	if Err != nil {
-		log.Printf("error [select max(ts) from eventrank where eventid = %s and userid = %d]\n", eventid, userid)
-		log.Printf("err=[%s]\n", Err.Error())
-		ndata -= 1000
-		return
-	}
-	log.Printf("select max(ts) from eventrank where eventid = %s and userid = %d ==> %v\n", eventid, userid, maxts)
 	return
-
 }
 
 func SelectEidUidFromTimetable() (
@@ -185,36 +311,86 @@ func SelectEidUidFromTimetable() (
 	sampletm1	time.Time,
 ) {
 
-//
-	sql := "select count(*) from timetable where sampletm1 < ? and status = 0"
-	tnow := time.Now()
-	Err = Db.QueryRow(sql, tnow).Scan(&ndata)
-
-	if Err != nil {
-		log.Printf("error [select count(*) from timetable where sampletm1 < %v and status = 0 ]\n", tnow)
-		log.Printf("err=[%s]\n", Err.Error())
-		ndata = -1
-		return
+	store, err := compat("SelectEidUidFromTimetable")
+	if err != nil {
+		return -1, "", 0, sampletm1
 	}
-	if ndata == 0 {
+	ndata, sample, err := store.PendingSample(context.Background())
+	if errors.Is(err, ErrNoPendingSample) {
+		return 0, "", 0, sampletm1
+	} else if err != nil {
+		log.Printf("SelectEidUidFromTimetable() err=[%s]\n", err.Error())
+		if ndata == 0 {
+			ndata = -1
+		} else {
+			ndata -= 1000
+		}
 		return
 	}
+	return ndata, sample.Eventid, sample.Userid, sample.Sampletm1
+}
 
-//	獲得ポイントデータを取得すべきイベント、ユーザーIDを取得する。
-	sql = "select eventid, userid, sampletm1 from timetable where status = 0 and sampletm1 = (select min(sampletm1) from timetable where status = 0)"
-	Err = Db.QueryRow(sql).Scan(&eventid, &userid, &sampletm1)
+func ClaimSamplesFromTimetable(
+	worker	string,
+	limit	int,
+	lease	time.Duration,
+) (
+	samples	[]Sample,
+	status	int,
+) {
 
-	if Err != nil {
-		log.Printf("error [select eventid, userid, sampletm1 from timetable where status = 0 and sampletm1 = (select min(sampletm1) from timetable where status = 0)]\n")
-		log.Printf("err=[%s]\n", Err.Error())
-		ndata -= 1000
-		return
+	store, err := compat("ClaimSamplesFromTimetable")
+	if err != nil {
+		return nil, -1
+	}
+	samples, err = store.ClaimSamples(context.Background(), worker, limit, lease)
+	if err != nil {
+		log.Printf("ClaimSamplesFromTimetable() err=[%s]\n", err.Error())
+		status = -1
 	}
-	log.Printf("select eventid, userid, sampletm1 from timetable where status = 0 and sampletm1 = (select min(sampletm1) from timetable where status = 0) ==> %s %d %v\n", eventid, userid, sampletm1 )
 	return
+}
 
+func RenewLease(
+	worker	string,
+	sample	Sample,
+	lease	time.Duration,
+) (
+	held	bool,
+	status	int,
+) {
+
+	store, err := compat("RenewLease")
+	if err != nil {
+		return false, -1
+	}
+	err = store.RenewLease(context.Background(), worker, sample, lease)
+	if errors.Is(err, ErrNotClaimed) {
+		return false, 0
+	} else if err != nil {
+		log.Printf("RenewLease() err=[%s]\n", err.Error())
+		return false, -1
+	}
+	return true, 0
 }
 
+func ReleaseSample(
+	worker	string,
+	sample	Sample,
+) (
+	status	int,
+) {
+
+	store, err := compat("ReleaseSample")
+	if err != nil {
+		return -1
+	}
+	if err := store.ReleaseSample(context.Background(), worker, sample); err != nil {
+		log.Printf("ReleaseSample() err=[%s]\n", err.Error())
+		status = -1
+	}
+	return
+}
 
 func SelectMaxTlsnidFromEventranking(
 	eventid	string,
@@ -223,52 +399,144 @@ func SelectMaxTlsnidFromEventranking(
 	maxtlsnid	int,
 ) {
 
-//
-	sql := "select max(t_lsnid) from eventrank where eventid =  ? and userid = ? "
-	Err = Db.QueryRow(sql, eventid, userid).Scan(&maxtlsnid)
-
-	if Err != nil {
-		log.Printf("error [select max(t_lsnid) from eventrank where eventid =  %s and userid = %d ]\n", eventid, userid)
-		log.Printf("err=[%s]\n", Err.Error())
+	store, err := compat("SelectMaxTlsnidFromEventranking")
+	if err != nil {
+		return -1000
+	}
+	maxtlsnid, err = store.MaxTLsnID(context.Background(), eventid, userid)
+	if err != nil {
+		log.Printf("SelectMaxTlsnidFromEventranking() err=[%s]\n", err.Error())
 		maxtlsnid = -1000
 	}
 	return
 }
 
-
 func UpdateTimetable(
+	worker	string,
 	eventid	string,
 	userid	int,
 	sampletm1	time.Time,
 	sampletm2	time.Time,
 	totalpoint int,
+	sumpoint	int,
+	disppoint	int,
+	pointcheck	int,
 ) (
 	status int,
 ) {
 
-	var row *sql.Stmt
+	sample := Sample{Eventid: eventid, Userid: userid, Sampletm1: sampletm1}
+	result := SampleResult{Sampletm2: sampletm2, Totalpoint: totalpoint, Sumpoint: sumpoint, Disppoint: disppoint, Pointcheck: pointcheck}
+	store, err := compat("UpdateTimetable")
+	if err != nil {
+		return -2
+	}
+	err = store.CompleteSample(context.Background(), worker, sample, result)
+	if errors.Is(err, ErrNotClaimed) {
+		log.Printf("UpdateTimetable() eventid = %s userid = %d sampletm1 = %v is not claimed by %s\n", eventid, userid, sampletm1, worker)
+		status = -3
+	} else if err != nil {
+		log.Printf("UpdateTimetable() err=[%s]\n", err.Error())
+		status = -2
+	}
+	return
+}
 
-	status = 0
+func SelectEarnedpointFromTimetable(
+	eventid	string,
+	userid	int,
+	sampletm1	time.Time,
+) (
+	earnedpoint	int,
+	status	int,
+) {
 
-	sql := "update timetable set sampletm2 = ?, totalpoint = ?, status = 1 where eventid = ? and userid = ? and sampletm1 = ? and status = 0"
-	row, Err = Db.Prepare(sql)
-	if Err != nil {
-		log.Printf("update timetable set sampletm2 = %v, totalpoint = %d, status = 1 where eventid = %s and userid = %d and sampletm1 = %v and status = 0 error (Update/Prepare) err=%s\n", sampletm2, totalpoint, eventid, userid, sampletm1, Err.Error())
+	store, err := compat("SelectEarnedpointFromTimetable")
+	if err != nil {
+		return -1, -1
+	}
+	earnedpoint, err = store.EarnedPoint(context.Background(), Sample{Eventid: eventid, Userid: userid, Sampletm1: sampletm1})
+	if err != nil {
+		log.Printf("SelectEarnedpointFromTimetable() err=[%s]\n", err.Error())
 		status = -1
-		return
 	}
+	return
+}
 
-	_, Err = row.Exec(sampletm2, totalpoint, eventid, userid, sampletm1)
+//	InsertIntoTimetable は貢献ランキングを取得すべき配信を登録します（獲得ポイントを監視しているプロセスが使います）
+//	earnedpointは配信終了時点のルームのポイントで、わからないときは-1とします。
+func InsertIntoTimetable(
+	eventid	string,
+	userid	int,
+	sampletm1	time.Time,
+	earnedpoint	int,
+) (
+	status int,
+) {
 
-	if Err != nil {
-		log.Printf("update timetable set sampletm2 = %v, totalpoint = %d, status = 1 where eventid = %s and userid = %d and sampletm1 = %v and status = 0 error (Update/Prepare) err=%s\n", sampletm2, totalpoint, eventid, userid,sampletm1,  Err.Error())
-		status = -2
+	sample := Sample{Eventid: eventid, Userid: userid, Sampletm1: sampletm1}
+	store, err := compat("InsertIntoTimetable")
+	if err != nil {
+		return -1
+	}
+	if err := store.InsertSample(context.Background(), sample, earnedpoint); err != nil {
+		log.Printf("InsertIntoTimetable() err=[%s]\n", err.Error())
+		status = -1
 	}
+	return
+}
 
+//	UpdateEarnedpointInTimetable は登録済みの配信にルームのポイントを記録します（獲得ポイントを監視しているプロセスが使います）
+func UpdateEarnedpointInTimetable(
+	eventid	string,
+	userid	int,
+	sampletm1	time.Time,
+	earnedpoint	int,
+) (
+	status int,
+) {
+
+	sample := Sample{Eventid: eventid, Userid: userid, Sampletm1: sampletm1}
+	store, err := compat("UpdateEarnedpointInTimetable")
+	if err != nil {
+		return -1
+	}
+	err = store.RecordEarnedPoint(context.Background(), sample, earnedpoint)
+	if errors.Is(err, ErrNoSample) {
+		log.Printf("UpdateEarnedpointInTimetable() eventid = %s userid = %d sampletm1 = %v is not in timetable\n", eventid, userid, sampletm1)
+		status = -2
+	} else if err != nil {
+		log.Printf("UpdateEarnedpointInTimetable() err=[%s]\n", err.Error())
+		status = -1
+	}
 	return
 }
 
+func UpdateTimetableFailed(
+	worker	string,
+	eventid	string,
+	userid	int,
+	sampletm1	time.Time,
+	lasterror	string,
+	maxattempts	int,
+	retryinterval	time.Duration,
+) (
+	parked	bool,
+	status	int,
+) {
 
+	sample := Sample{Eventid: eventid, Userid: userid, Sampletm1: sampletm1}
+	store, err := compat("UpdateTimetableFailed")
+	if err != nil {
+		return false, -1
+	}
+	parked, err = store.FailSample(context.Background(), worker, sample, lasterror, maxattempts, retryinterval)
+	if err != nil {
+		log.Printf("UpdateTimetableFailed() err=[%s]\n", err.Error())
+		status = -1
+	}
+	return
+}
 
 func SelectEventRankingFromEventrank(
 	eventid	string,
@@ -279,49 +547,152 @@ func SelectEventRankingFromEventrank(
 	status int,
 ) {
 
-	var stmt *sql.Stmt
-	var rows *sql.Rows
+	store, err := compat("SelectEventRankingFromEventrank")
+	if err != nil {
+		return nil, -1
+	}
+	eventranking, err = store.Snapshot(context.Background(), eventid, userid, ts)
+	if err != nil {
+		log.Printf("SelectEventRankingFromEventrank() err=[%s]\n", err.Error())
+		status = -1
+	}
+	return
+}
 
-	status = 0
+func InsertIntoContpage(
+	eventid	string,
+	userid	int,
+	ts	time.Time,
+	page	[]byte,
+) (
+	status int,
+) {
 
+	store, err := compat("InsertIntoContpage")
+	if err != nil {
+		return -1
+	}
+	if err := store.SavePage(context.Background(), eventid, userid, ts, page); err != nil {
+		log.Printf("InsertIntoContpage() err=[%s]\n", err.Error())
+		status = -1
+	}
+	return
+}
 
-//	直近の獲得ポイントデータを読み込む
-	sql := "SELECT listner, lastname, lsnid, t_lsnid, norder, nrank, point, increment, status "
-	sql += " FROM eventrank WHERE eventid = ? and userid = ? and ts = ? order by norder"
+func DeleteFromContpage(
+	before	time.Time,
+) (
+	ndata	int,
+	status	int,
+) {
 
-	stmt, Err = Db.Prepare(sql)
-	if Err != nil {
-		log.Printf("err=[%s]\n", Err.Error())
+	store, err := compat("DeleteFromContpage")
+	if err != nil {
+		return 0, -1
+	}
+	ndata, err = store.DeletePagesBefore(context.Background(), before)
+	if err != nil {
+		log.Printf("DeleteFromContpage() err=[%s]\n", err.Error())
 		status = -1
-		return
 	}
-	defer stmt.Close()
+	return
+}
 
-	rows, Err = stmt.Query(eventid, userid, ts)
-	if Err != nil {
-		log.Printf("err=[%s]\n", Err.Error())
-		status = -2
-		return
+func SelectTsFromContpage(
+	eventid	string,
+	userid	int,
+) (
+	tslist	[]time.Time,
+	status	int,
+) {
+
+	store, err := compat("SelectTsFromContpage")
+	if err != nil {
+		return nil, -1
 	}
-	defer rows.Close()
+	tslist, err = store.PageTimes(context.Background(), eventid, userid)
+	if err != nil {
+		log.Printf("SelectTsFromContpage() err=[%s]\n", err.Error())
+		status = -1
+	}
+	return
+}
 
-	var evr EventRank
+func SelectPageFromContpage(
+	eventid	string,
+	userid	int,
+	ts	time.Time,
+) (
+	page	[]byte,
+	status	int,
+) {
 
-	for rows.Next() {
-		Err = rows.Scan(&evr.Listner, &evr.Lastname, &evr.LsnID, &evr.T_LsnID, &evr.Order, &evr.Rank, &evr.Point, &evr.Incremental, &evr.Status)
-		if Err != nil {
-			log.Printf("err=[%s]\n", Err.Error())
-			status = -3
-			return
-		}
-		eventranking = append(eventranking, evr)
+	store, err := compat("SelectPageFromContpage")
+	if err != nil {
+		return nil, -1
 	}
-	if Err = rows.Err(); Err != nil {
-		log.Printf("err=[%s]\n", Err.Error())
-		status = -4
-		return
+	page, err = store.Page(context.Background(), eventid, userid, ts)
+	if err != nil {
+		log.Printf("SelectPageFromContpage() err=[%s]\n", err.Error())
+		status = -1
+	}
+	return
+}
+
+func SelectTsListFromEventrank(
+	eventid	string,
+	userid	int,
+) (
+	tslist	[]time.Time,
+	status	int,
+) {
+
+	store, err := compat("SelectTsListFromEventrank")
+	if err != nil {
+		return nil, -1
+	}
+	tslist, err = store.SnapshotTimes(context.Background(), eventid, userid)
+	if err != nil {
+		log.Printf("SelectTsListFromEventrank() err=[%s]\n", err.Error())
+		status = -1
 	}
+	return
+}
 
+func DeleteFromEventrankReplay(
+	eventid	string,
+	userid	int,
+) (
+	status int,
+) {
+
+	store, err := compat("DeleteFromEventrankReplay")
+	if err != nil {
+		return -1
+	}
+	if err := store.DeleteReplay(context.Background(), eventid, userid); err != nil {
+		log.Printf("DeleteFromEventrankReplay() err=[%s]\n", err.Error())
+		status = -1
+	}
 	return
+}
+
+func InsertIntoEventrankReplay(
+	eventid	string,
+	userid	int,
+	ts	time.Time,
+	eventranking EventRanking,
+) (
+	status int,
+) {
 
+	store, err := compat("InsertIntoEventrankReplay")
+	if err != nil {
+		return -1
+	}
+	if err := store.SaveReplaySnapshot(context.Background(), Sample{Eventid: eventid, Userid: userid, Sampletm1: ts}, eventranking); err != nil {
+		log.Printf("InsertIntoEventrankReplay() err=[%s]\n", err.Error())
+		status = -1
+	}
+	return
 }
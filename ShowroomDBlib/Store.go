@@ -0,0 +1,791 @@
+package ShowroomDBlib
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Store はデータベース（timetable、eventrank、contpage、eventrank_replay）へのアクセスをまとめたものです。
+
+	パッケージ変数（Db、Err）を使わないので、複数のゴルーチンから同時に使うことができます。
+	メソッドはcontextを受け取り、失敗したときはerrorを返します（-1、-1000のような値は返しません）
+	該当するものがないことは次のerrorで表します（errors.Is()で判定してください）
+
+	ErrNoPendingSample	取得すべきtimetableの行がない
+	ErrNoSnapshot		eventrankにデータがない
+	ErrNotClaimed		timetableの行を（このworkerが）確保していない（leaseが切れて他のworkerに確保された）
+
+	以前からの関数（OpenDb()、SelectMaxTsFromEventrank()など）は、パッケージ変数Dbを使うStoreを呼び出すものとして残してあります。
+
+	SQLはプレースホルダを"?"で書き、実行するときにrebind()でデータベースに合わせたもの（PostgreSQLでは"$1"、"$2"、...）にします。
+*/
+type Store struct {
+	db        *sql.DB
+	dialect   string //	スキーマのSQLの種類（schema/の下のディレクトリ名）
+	batchsize int    //	貢献ランキングを保存するときに一つのinsertで追加する行数
+}
+
+const (
+	DefaultBatchSize = 100
+	MaxBatchSize     = 1000 //	プレースホルダの数の上限（SQLiteは32766）を超えないように
+)
+
+var (
+	ErrNoPendingSample = errors.New("ShowroomDBlib: no pending sample")
+	ErrNoSnapshot      = errors.New("ShowroomDBlib: no snapshot")
+	ErrNotClaimed      = errors.New("ShowroomDBlib: sample is not claimed by the worker")
+	ErrNoSample        = errors.New("ShowroomDBlib: sample is not in timetable")
+	ErrNotOpen         = errors.New("ShowroomDBlib: database is not opened (call OpenDb())")
+)
+
+// NewStore はオープン済みの*sql.DBを使うStoreを作ります。
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db, dialect: "mysql", batchsize: DefaultBatchSize}
+}
+
+/*
+	SetBatchSize()
+	貢献ランキングを保存するときに一つのinsertで追加する行数を設定します（1なら一行ずつ追加します）
+	0以下のときはDefaultBatchSize、MaxBatchSizeを超えるときはMaxBatchSizeにします。
+*/
+func (s *Store) SetBatchSize(n int) {
+	switch {
+	case n <= 0:
+		n = DefaultBatchSize
+	case n > MaxBatchSize:
+		n = MaxBatchSize
+	}
+	s.batchsize = n
+}
+
+// BatchSize は貢献ランキングを保存するときに一つのinsertで追加する行数を返します。
+func (s *Store) BatchSize() int {
+	return s.batchsize
+}
+
+//	rowsPerInsert は一つのinsertで追加する行数を返します（SetBatchSize()を通さずに作ったStoreでは0のことがあるので、そのときはDefaultBatchSize）
+func (s *Store) rowsPerInsert() int {
+	if s.batchsize <= 0 {
+		return DefaultBatchSize
+	}
+	return s.batchsize
+}
+
+//	rebind はプレースホルダ"?"をデータベースに合わせたものにします。
+func (s *Store) rebind(query string) string {
+
+	if s.dialect != "postgres" {
+		return query
+	}
+	var buf strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+		} else {
+			buf.WriteRune(c)
+		}
+	}
+	return buf.String()
+}
+
+// Dialect はStoreが使っているデータベースの種類（"mysql"、"sqlite"、"postgres"）を返します。
+func (s *Store) Dialect() string {
+	return s.dialect
+}
+
+// DB はStoreが使っている*sql.DBを返します。
+func (s *Store) DB() *sql.DB {
+	return s.db
+}
+
+// Close はデータベースをクローズします。
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Sample はtimetableの一つの行（貢献ランキングを取得すべき一つの配信）です。
+type Sample struct {
+	Eventid   string
+	Userid    int
+	Sampletm1 time.Time
+}
+
+// SampleResult は配信の処理の結果としてtimetableに保存するものです。
+type SampleResult struct {
+	Sampletm2   time.Time //	貢献ランキングを取得した時刻
+	Totalpoint  int       //	前回からの増分の合計
+	Sumpoint    int       //	貢献ランキングのポイントの合計
+	Disppoint   int       //	ページに表示されていたルームのポイント（表示されていなければ-1）
+	Pointcheck  int       //	PointCheckXXXX
+	Matchparams string    //	突き合わせの判定に使った値（matching.Params.String()、空なら記録しない）
+}
+
+/*
+	InsertSample()
+	貢献ランキングを取得すべき配信をtimetableに登録します（取得待ち、status = 0）
+	獲得ポイントを監視しているプロセスが配信の終了時に使うもので、earnedpointにはそのプロセスが記録した
+	配信終了時点のルームのポイントを渡します（貢献ランキングのポイントの合計はこれと比較されます）
+	earnedpointが負のとき（わからないとき）は記録しません。このときは比較しません（pointcheck = PointCheckNone）
+*/
+func (s *Store) InsertSample(ctx context.Context, sample Sample, earnedpoint int) error {
+
+	var ep sql.NullInt64
+	if earnedpoint >= 0 {
+		ep = sql.NullInt64{Int64: int64(earnedpoint), Valid: true}
+	}
+	query := "insert into timetable (eventid, userid, sampletm1, status, earnedpoint) values (?, ?, ?, 0, ?)"
+	if _, err := s.db.ExecContext(ctx, s.rebind(query), sample.Eventid, sample.Userid, sample.Sampletm1, ep); err != nil {
+		return fmt.Errorf("InsertSample() eventid=%s userid=%d sampletm1=%v: %w", sample.Eventid, sample.Userid, sample.Sampletm1, err)
+	}
+	return nil
+}
+
+/*
+	DeleteEvent()
+	イベントのデータをtimetable、eventrank、eventrank_replay、contpage、listener（listener_seq、tlsnid_mapを含む）からすべて削除します。
+	bench が作ったデータを片付けるためのものです。
+*/
+func (s *Store) DeleteEvent(ctx context.Context, eventid string) error {
+
+	for _, table := range []string{"timetable", "eventrank", "eventrank_replay", "contpage", "listener", "listener_seq", "tlsnid_map"} {
+		if _, err := s.db.ExecContext(ctx, s.rebind("delete from "+table+" where eventid = ?"), eventid); err != nil {
+			return fmt.Errorf("DeleteEvent() %s eventid=%s: %w", table, eventid, err)
+		}
+	}
+	return nil
+}
+
+/*
+	SampleFetchedAt()
+	fetchtmに貢献ランキングを取得したルームの配信（timetableの行）を返します。
+	fetchtm以前の配信のうち取得待ち、リトライ待ち、処理中のもっとも古いもの、それがないときはfetchtm以前の処理済みのもっとも新しいものとします
+	（貢献ランキングは古い配信から順に取得し、取得したら処理済みにするので、取得して保存するまでの間はこれがその配信になります）
+	保留（status = 9）の配信は取得しないので選びません（選ぶと新しい貢献ランキングがその配信のものとして保存されてしまいます）
+	timetableに行がないときは ErrNoSample を返します。
+*/
+func (s *Store) SampleFetchedAt(ctx context.Context, eventid string, userid int, fetchtm time.Time) (sample Sample, err error) {
+
+	sample = Sample{Eventid: eventid, Userid: userid}
+	for _, query := range []string{
+		"select sampletm1 from timetable where eventid = ? and userid = ? and sampletm1 <= ? and status in (0, 2, 3) order by sampletm1 limit 1",
+		"select sampletm1 from timetable where eventid = ? and userid = ? and sampletm1 <= ? and status = 1 order by sampletm1 desc limit 1",
+	} {
+		err = s.db.QueryRowContext(ctx, s.rebind(query), eventid, userid, fetchtm).Scan(&sample.Sampletm1)
+		if err == nil {
+			return sample, nil
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return sample, fmt.Errorf("SampleFetchedAt() eventid=%s userid=%d fetchtm=%v: %w", eventid, userid, fetchtm, err)
+		}
+	}
+	return sample, ErrNoSample
+}
+
+/*
+	PendingSample()
+	取得すべきtimetableの行の数と、そのうちもっとも古いものを返します（確保はしません）
+	ないときは ErrNoPendingSample を返します。
+*/
+func (s *Store) PendingSample(ctx context.Context) (n int, sample Sample, err error) {
+
+	tnow := time.Now()
+	query := "select count(*) from timetable where sampletm1 < ? and (status = 0 or (status = 2 and nextretry <= ?))"
+	if err = s.db.QueryRowContext(ctx, s.rebind(query), tnow, tnow).Scan(&n); err != nil {
+		return 0, sample, fmt.Errorf("PendingSample() count: %w", err)
+	}
+	if n == 0 {
+		return 0, sample, ErrNoPendingSample
+	}
+
+	query = "select eventid, userid, sampletm1 from timetable where (status = 0 or (status = 2 and nextretry <= ?)) order by sampletm1 limit 1"
+	if err = s.db.QueryRowContext(ctx, s.rebind(query), tnow).Scan(&sample.Eventid, &sample.Userid, &sample.Sampletm1); err != nil {
+		return n, sample, fmt.Errorf("PendingSample() select: %w", err)
+	}
+	return
+}
+
+/*
+	ClaimSamples()
+	貢献ランキングを取得すべきtimetableの行を古い順に最大limit件、workerが処理するものとして確保（status = 3）します。
+	確保したものはleaseの間（RenewLease()で延長できます）他のworker（他のプロセスを含む）は処理しません。
+	leaseexpiryを過ぎた行（処理中に止まったプロセスが確保していたもの）は取得待ちのものと同じように確保し直します。
+
+	同じルームのものは古いものから順に処理しなければならないので
+		・同じルームでそれより前にリトライ待ちになっている行や他のworkerが処理中の行があるものは確保しません。
+		・同じルームのものは先頭から順に確保し、他のworkerに先を越されたらそのルームのそれ以降のものは確保しません。
+
+	確保できるものがないときは空のスライスを返します（errorにはしません）
+*/
+func (s *Store) ClaimSamples(ctx context.Context, worker string, limit int, lease time.Duration) (samples []Sample, err error) {
+
+	tnow := time.Now()
+	query := "select eventid, userid, sampletm1 from timetable t where sampletm1 < ?"
+	query += " and (status = 0 or (status = 2 and nextretry <= ?) or (status = 3 and leaseexpiry < ?))"
+	query += " and not exists (select 1 from timetable p where p.eventid = t.eventid and p.userid = t.userid and p.sampletm1 < t.sampletm1"
+	query += " and (p.status = 2 or (p.status = 3 and p.leaseexpiry >= ?)))"
+	query += " order by sampletm1 limit ?"
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), tnow, tnow, tnow, tnow, limit)
+	if err != nil {
+		return nil, fmt.Errorf("ClaimSamples() query: %w", err)
+	}
+	var candidates []Sample
+	for rows.Next() {
+		var sample Sample
+		if err = rows.Scan(&sample.Eventid, &sample.Userid, &sample.Sampletm1); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("ClaimSamples() scan: %w", err)
+		}
+		candidates = append(candidates, sample)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("ClaimSamples() rows: %w", err)
+	}
+
+	//	一行ずつ状態を確認しながら確保する（確認と更新を一つのupdateで行うので、同時に確保しようとしても一つのworkerしか確保できない）
+	query = "update timetable set status = 3, worker = ?, leaseexpiry = ? where eventid = ? and userid = ? and sampletm1 = ?"
+	query += " and (status = 0 or (status = 2 and nextretry <= ?) or (status = 3 and leaseexpiry < ?))"
+	leaseexpiry := tnow.Add(lease)
+	skip := make(map[string]bool)
+	for _, sample := range candidates {
+		room := fmt.Sprintf("%s/%d", sample.Eventid, sample.Userid)
+		if skip[room] {
+			continue
+		}
+		result, err := s.db.ExecContext(ctx, s.rebind(query), worker, leaseexpiry, sample.Eventid, sample.Userid, sample.Sampletm1, tnow, tnow)
+		if err != nil {
+			//	確保できたものは返す（呼び出し側で処理するか元に戻すかする）
+			return samples, fmt.Errorf("ClaimSamples() update: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			skip[room] = true
+			continue
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+/*
+	ClaimNextSample()
+	取得すべきtimetableの行のうちもっとも古いものを一つ確保します。
+	確保できるものがないときは ErrNoPendingSample を返します。
+*/
+func (s *Store) ClaimNextSample(ctx context.Context, worker string, lease time.Duration) (sample Sample, err error) {
+
+	samples, err := s.ClaimSamples(ctx, worker, 1, lease)
+	if err != nil {
+		return
+	}
+	if len(samples) == 0 {
+		return sample, ErrNoPendingSample
+	}
+	return samples[0], nil
+}
+
+/*
+	RenewLease()
+	確保しているtimetableの行のleaseexpiryを延長します。
+	leaseが切れて他のworkerに確保されていたときは ErrNotClaimed を返します。
+*/
+func (s *Store) RenewLease(ctx context.Context, worker string, sample Sample, lease time.Duration) error {
+
+	query := "update timetable set leaseexpiry = ? where eventid = ? and userid = ? and sampletm1 = ? and status = 3 and worker = ?"
+	result, err := s.db.ExecContext(ctx, s.rebind(query), time.Now().Add(lease), sample.Eventid, sample.Userid, sample.Sampletm1, worker)
+	if err != nil {
+		return fmt.Errorf("RenewLease() eventid=%s userid=%d sampletm1=%v: %w", sample.Eventid, sample.Userid, sample.Sampletm1, err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotClaimed
+	}
+	return nil
+}
+
+/*
+	ReleaseSample()
+	確保したが処理しなかったtimetableの行を元の状態（失敗したことがあればリトライ待ち、なければ取得待ち）に戻します。
+*/
+func (s *Store) ReleaseSample(ctx context.Context, worker string, sample Sample) error {
+
+	query := "update timetable set status = case when attempts > 0 then 2 else 0 end, worker = null, leaseexpiry = null"
+	query += " where eventid = ? and userid = ? and sampletm1 = ? and status = 3 and worker = ?"
+	if _, err := s.db.ExecContext(ctx, s.rebind(query), sample.Eventid, sample.Userid, sample.Sampletm1, worker); err != nil {
+		return fmt.Errorf("ReleaseSample() eventid=%s userid=%d sampletm1=%v: %w", sample.Eventid, sample.Userid, sample.Sampletm1, err)
+	}
+	return nil
+}
+
+/*
+	CompleteSample()
+	確保しているtimetableの行を処理済み（status = 1）にし、結果を保存します。
+	leaseが切れて他のworkerに確保されていたときは ErrNotClaimed を返します。
+	貢献ランキングもあわせて保存するときはCommitSample()を使ってください。
+*/
+func (s *Store) CompleteSample(ctx context.Context, worker string, sample Sample, result SampleResult) error {
+	return s.completeSample(ctx, s.db, worker, sample, result)
+}
+
+/*
+	CommitSample()
+	突き合わせの結果の貢献ランキングをsampleのもの（fetchtmは貢献ランキングのページを取得した時刻）としてeventrankに保存し、
+	確保しているtimetableの行を処理済みにします。
+	二つは一つのトランザクションで行うので、途中で止まっても貢献ランキングの一部だけが保存されることはありません
+	（一部だけが保存されると、それが次の突き合わせの「前回の貢献ランキング」になってしまいます）
+	leaseが切れて他のworkerに確保されていたときは何も保存せずに ErrNotClaimed を返します。
+*/
+func (s *Store) CommitSample(
+	ctx context.Context,
+	worker string,
+	sample Sample,
+	fetchtm time.Time,
+	eventranking EventRanking,
+	result SampleResult,
+) error {
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		//	先にtimetableを更新する（確保していることの確認になり、同時に行がロックされる）
+		if err := s.completeSample(ctx, tx, worker, sample, result); err != nil {
+			return err
+		}
+		return s.saveSnapshot(ctx, tx, sample, fetchtm, eventranking)
+	})
+}
+
+// dbtx は*sql.DBと*sql.Txに共通のメソッドです（トランザクションの中でも外でも使う処理のためのもの）
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// inTx はfnを一つのトランザクションで実行します。fnがerrorを返したときはロールバックします。
+func (s *Store) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) completeSample(ctx context.Context, q dbtx, worker string, sample Sample, result SampleResult) error {
+
+	var matchparams sql.NullString
+	if result.Matchparams != "" {
+		matchparams = sql.NullString{String: result.Matchparams, Valid: true}
+	}
+	query := "update timetable set sampletm2 = ?, totalpoint = ?, sumpoint = ?, disppoint = ?, pointcheck = ?, matchparams = ?, status = 1, worker = null, leaseexpiry = null"
+	query += " where eventid = ? and userid = ? and sampletm1 = ? and status = 3 and worker = ?"
+	res, err := q.ExecContext(ctx, s.rebind(query), result.Sampletm2, result.Totalpoint, result.Sumpoint, result.Disppoint, result.Pointcheck, matchparams,
+		sample.Eventid, sample.Userid, sample.Sampletm1, worker)
+	if err != nil {
+		return fmt.Errorf("CompleteSample() eventid=%s userid=%d sampletm1=%v: %w", sample.Eventid, sample.Userid, sample.Sampletm1, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotClaimed
+	}
+	return nil
+}
+
+/*
+	MatchParams()
+	貢献ランキングを保存したときに突き合わせの判定に使った値を返します（記録されていないときは""）
+	どの値でリスナーを同一と判定したかを調べるためのものです。
+*/
+func (s *Store) MatchParams(ctx context.Context, sample Sample) (matchparams string, err error) {
+
+	var mp sql.NullString
+	query := "select matchparams from timetable where eventid = ? and userid = ? and sampletm1 = ?"
+	err = s.db.QueryRowContext(ctx, s.rebind(query), sample.Eventid, sample.Userid, sample.Sampletm1).Scan(&mp)
+	if err != nil {
+		return "", fmt.Errorf("MatchParams() eventid=%s userid=%d sampletm1=%v: %w", sample.Eventid, sample.Userid, sample.Sampletm1, err)
+	}
+	return mp.String, nil
+}
+
+/*
+	FailSample()
+	貢献ランキングの取得に失敗したtimetableの行をリトライ待ち（status = 2）にします。
+	失敗の回数がmaxattemptsに達したときは保留（status = 9）にし、parked = true を返します。
+	リトライの間隔は失敗の回数に比例して延ばしていきます（retryinterval、retryinterval*2、...）
+	lasterrorは255文字までを保存します。
+*/
+func (s *Store) FailSample(
+	ctx context.Context,
+	worker string,
+	sample Sample,
+	lasterror string,
+	maxattempts int,
+	retryinterval time.Duration,
+) (
+	parked bool,
+	err error,
+) {
+
+	attempts := 0
+	query := "select attempts from timetable where eventid = ? and userid = ? and sampletm1 = ? and status = 3 and worker = ?"
+	err = s.db.QueryRowContext(ctx, s.rebind(query), sample.Eventid, sample.Userid, sample.Sampletm1, worker).Scan(&attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrNotClaimed
+	} else if err != nil {
+		return false, fmt.Errorf("FailSample() select eventid=%s userid=%d sampletm1=%v: %w", sample.Eventid, sample.Userid, sample.Sampletm1, err)
+	}
+	attempts++
+
+	newstatus := TimetableRetry
+	if attempts >= maxattempts {
+		newstatus = TimetableParked
+	}
+	nextretry := time.Now().Add(retryinterval * time.Duration(attempts))
+
+	if r := []rune(lasterror); len(r) > 255 {
+		lasterror = string(r[:255])
+	}
+
+	query = "update timetable set status = ?, attempts = ?, lasterror = ?, nextretry = ?, worker = null, leaseexpiry = null"
+	query += " where eventid = ? and userid = ? and sampletm1 = ? and status = 3 and worker = ?"
+	res, err := s.db.ExecContext(ctx, s.rebind(query), newstatus, attempts, lasterror, nextretry, sample.Eventid, sample.Userid, sample.Sampletm1, worker)
+	if err != nil {
+		return false, fmt.Errorf("FailSample() update eventid=%s userid=%d sampletm1=%v: %w", sample.Eventid, sample.Userid, sample.Sampletm1, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, ErrNotClaimed
+	}
+	return newstatus == TimetableParked, nil
+}
+
+/*
+	EarnedPoint()
+	獲得ポイントを監視しているプロセスが記録したルームのポイントを返します。
+	記録されていないときは-1を返します。
+*/
+func (s *Store) EarnedPoint(ctx context.Context, sample Sample) (earnedpoint int, err error) {
+
+	var np sql.NullInt64
+	query := "select earnedpoint from timetable where eventid = ? and userid = ? and sampletm1 = ?"
+	if err = s.db.QueryRowContext(ctx, s.rebind(query), sample.Eventid, sample.Userid, sample.Sampletm1).Scan(&np); err != nil {
+		return -1, fmt.Errorf("EarnedPoint() eventid=%s userid=%d sampletm1=%v: %w", sample.Eventid, sample.Userid, sample.Sampletm1, err)
+	}
+	if !np.Valid {
+		return -1, nil
+	}
+	return int(np.Int64), nil
+}
+
+/*
+	RecordEarnedPoint()
+	登録済みの配信に獲得ポイントを監視しているプロセスが記録したルームのポイントを記録します。
+	配信を登録したときにはポイントがわからなかったときや、InsertSample()を使わずに登録しているときのためのものです。
+	貢献ランキングを取得する前（処理済みになる前）に記録してください。
+	配信が登録されていないときは ErrNoSample を返します。
+*/
+func (s *Store) RecordEarnedPoint(ctx context.Context, sample Sample, earnedpoint int) error {
+
+	var ep sql.NullInt64
+	if earnedpoint >= 0 {
+		ep = sql.NullInt64{Int64: int64(earnedpoint), Valid: true}
+	}
+	query := "update timetable set earnedpoint = ? where eventid = ? and userid = ? and sampletm1 = ?"
+	res, err := s.db.ExecContext(ctx, s.rebind(query), ep, sample.Eventid, sample.Userid, sample.Sampletm1)
+	if err != nil {
+		return fmt.Errorf("RecordEarnedPoint() eventid=%s userid=%d sampletm1=%v: %w", sample.Eventid, sample.Userid, sample.Sampletm1, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		//	MySQLは値が変わらなかった行を数えないので、行があるかどうかを確かめる。
+		if _, err = s.EarnedPoint(ctx, sample); errors.Is(err, sql.ErrNoRows) {
+			return ErrNoSample
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	eventrankの貢献ランキング（スナップショット）はtimetableの行（eventid、userid、sampletm1）をキーにして保存します。
+
+	sampletm1	timetableのsampletm1（貢献ランキングを取得すべき時刻、配信の終了時刻）
+	fetchtm		貢献ランキングのページを実際に取得した時刻
+	ts		以前からの列で、sampletm1と同じものを保存します（以前は保存したときの時刻を分単位にしたものでした）
+
+	処理した時刻ではなくsampletm1の順に並べるので、遅れて処理した配信（バックフィル）や再実行（replay）の結果も
+	配信の順に並びます。
+*/
+
+/*
+	LatestSnapshot()
+	eventrankに保存されている直近の（sampletm1がもっとも新しい）貢献ランキングとそのsampletm1を返します。
+	保存されているものがないときは ErrNoSnapshot を返します。
+*/
+func (s *Store) LatestSnapshot(ctx context.Context, eventid string, userid int) (sampletm1 time.Time, eventranking EventRanking, err error) {
+
+	query := "select sampletm1 from eventrank where eventid = ? and userid = ? order by sampletm1 desc limit 1"
+	err = s.db.QueryRowContext(ctx, s.rebind(query), eventid, userid).Scan(&sampletm1)
+	if errors.Is(err, sql.ErrNoRows) {
+		return sampletm1, nil, ErrNoSnapshot
+	} else if err != nil {
+		return sampletm1, nil, fmt.Errorf("LatestSnapshot() eventid=%s userid=%d: %w", eventid, userid, err)
+	}
+
+	eventranking, err = s.Snapshot(ctx, eventid, userid, sampletm1)
+	return
+}
+
+/*
+	PreviousSnapshot()
+	sampleより前の配信の貢献ランキング（突き合わせの相手になるもの）とそのsampletm1を返します。
+	ないときは ErrNoSnapshot を返します。
+*/
+func (s *Store) PreviousSnapshot(ctx context.Context, sample Sample) (sampletm1 time.Time, eventranking EventRanking, err error) {
+
+	query := "select sampletm1 from eventrank where eventid = ? and userid = ? and sampletm1 < ? order by sampletm1 desc limit 1"
+	err = s.db.QueryRowContext(ctx, s.rebind(query), sample.Eventid, sample.Userid, sample.Sampletm1).Scan(&sampletm1)
+	if errors.Is(err, sql.ErrNoRows) {
+		return sampletm1, nil, ErrNoSnapshot
+	} else if err != nil {
+		return sampletm1, nil, fmt.Errorf("PreviousSnapshot() eventid=%s userid=%d sampletm1=%v: %w", sample.Eventid, sample.Userid, sample.Sampletm1, err)
+	}
+
+	eventranking, err = s.Snapshot(ctx, sample.Eventid, sample.Userid, sampletm1)
+	return
+}
+
+// Snapshot はeventrankに保存されているsampletm1の配信の貢献ランキングを返します。
+func (s *Store) Snapshot(ctx context.Context, eventid string, userid int, sampletm1 time.Time) (eventranking EventRanking, err error) {
+	return s.selectSnapshot(ctx, "eventrank", eventid, userid, sampletm1)
+}
+
+func (s *Store) selectSnapshot(ctx context.Context, table, eventid string, userid int, sampletm1 time.Time) (eventranking EventRanking, err error) {
+
+	query := "select listner, lastname, lsnid, avatar, t_lsnid, norder, nrank, point, increment, status, prevname, method, distance"
+	query += " from " + table + " where eventid = ? and userid = ? and sampletm1 = ? order by norder"
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), eventid, userid, sampletm1)
+	if err != nil {
+		return nil, fmt.Errorf("Snapshot() eventid=%s userid=%d sampletm1=%v: %w", eventid, userid, sampletm1, err)
+	}
+	defer rows.Close()
+
+	var evr EventRank
+	for rows.Next() {
+		err = rows.Scan(&evr.Listner, &evr.Lastname, &evr.LsnID, &evr.Avatar, &evr.T_LsnID, &evr.Order, &evr.Rank, &evr.Point, &evr.Incremental, &evr.Status,
+			&evr.Prevname, &evr.Method, &evr.Distance)
+		if err != nil {
+			return nil, fmt.Errorf("Snapshot() scan: %w", err)
+		}
+		eventranking = append(eventranking, evr)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Snapshot() rows: %w", err)
+	}
+	return eventranking, nil
+}
+
+// SnapshotTimes はeventrankに保存されている貢献ランキングのsampletm1を古い順に返します。
+func (s *Store) SnapshotTimes(ctx context.Context, eventid string, userid int) (tslist []time.Time, err error) {
+	return s.selectTimes(ctx, "select distinct sampletm1 from eventrank where eventid = ? and userid = ? order by sampletm1", eventid, userid)
+}
+
+func (s *Store) selectTimes(ctx context.Context, query string, eventid string, userid int) (tslist []time.Time, err error) {
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), eventid, userid)
+	if err != nil {
+		return nil, fmt.Errorf("select ts eventid=%s userid=%d: %w", eventid, userid, err)
+	}
+	defer rows.Close()
+
+	var ts time.Time
+	for rows.Next() {
+		if err = rows.Scan(&ts); err != nil {
+			return nil, fmt.Errorf("select ts scan: %w", err)
+		}
+		tslist = append(tslist, ts)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("select ts rows: %w", err)
+	}
+	return tslist, nil
+}
+
+/*
+	SaveSnapshot()
+	突き合わせの結果の貢献ランキングをsampleのもの（fetchtmは貢献ランキングのページを取得した時刻）としてeventrankに保存します。
+	同じsampleのものがすでにあれば置き換えます（一つのトランザクションで削除と追加を行います）
+	同じものが重複して保存されないように、eventrankには (eventid, userid, sampletm1, t_lsnid) のユニークキーを作ってあります。
+	eventrankには貢献ランキングに載っているリスナーだけを保存し、listenerテーブルもあわせて更新します（Listener.goを参照）
+	T_LsnIDが0のリスナー（新たに現れたもの）にはT_LsnIDを振り、eventrankingのものも書き換えます。
+*/
+func (s *Store) SaveSnapshot(ctx context.Context, sample Sample, fetchtm time.Time, eventranking EventRanking) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.saveSnapshot(ctx, tx, sample, fetchtm, eventranking)
+	})
+}
+
+func (s *Store) saveSnapshot(ctx context.Context, q dbtx, sample Sample, fetchtm time.Time, eventranking EventRanking) error {
+	if err := s.assignTLsnIDs(ctx, q, sample, eventranking); err != nil {
+		return err
+	}
+	if err := s.replaceSnapshot(ctx, q, "eventrank", sample, fetchtm, eventranking); err != nil {
+		return err
+	}
+	return s.updateListeners(ctx, q, sample, eventranking)
+}
+
+/*
+	replaceSnapshot()
+	sampleの貢献ランキングを置き換えます。fetchtmがゼロのとき（再実行の結果など）はnullにします。
+	貢献ランキングに載らなくなったリスナー（Point < 0）は保存しません。
+	行はbatchsize行ずつ複数行のinsertで追加します（一行ずつExecするよりデータベースとのやりとりが少なくてすむ）
+*/
+func (s *Store) replaceSnapshot(ctx context.Context, q dbtx, table string, sample Sample, fetchtm time.Time, eventranking EventRanking) error {
+
+	query := "delete from " + table + " where eventid = ? and userid = ? and sampletm1 = ?"
+	if _, err := q.ExecContext(ctx, s.rebind(query), sample.Eventid, sample.Userid, sample.Sampletm1); err != nil {
+		return fmt.Errorf("delete from %s eventid=%s userid=%d sampletm1=%v: %w", table, sample.Eventid, sample.Userid, sample.Sampletm1, err)
+	}
+
+	var ft sql.NullTime
+	if !fetchtm.IsZero() {
+		ft = sql.NullTime{Time: fetchtm, Valid: true}
+	}
+
+	present := make(EventRanking, 0, len(eventranking))
+	for _, evr := range eventranking {
+		if evr.Point >= 0 {
+			present = append(present, evr)
+		}
+	}
+	eventranking = present
+
+	batchsize := s.rowsPerInsert()
+	const row = "(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
+
+	for start := 0; start < len(eventranking); start += batchsize {
+		end := start + batchsize
+		if end > len(eventranking) {
+			end = len(eventranking)
+		}
+		chunk := eventranking[start:end]
+
+		query = "insert into " + table + "(eventid, userid, ts, sampletm1, fetchtm, listner, lastname, lsnid, avatar, t_lsnid, norder, nrank, point, increment, status, prevname, method, distance)"
+		query += " values" + strings.Repeat(row+",", len(chunk)-1) + row
+		args := make([]interface{}, 0, len(chunk)*18)
+		for _, evr := range chunk {
+			args = append(args, sample.Eventid, sample.Userid, sample.Sampletm1, sample.Sampletm1, ft,
+				evr.Listner, evr.Lastname, evr.LsnID, evr.Avatar, evr.T_LsnID, evr.Order, evr.Rank, evr.Point, evr.Incremental, 0,
+				evr.Prevname, evr.Method, evr.Distance)
+		}
+		if _, err := q.ExecContext(ctx, s.rebind(query), args...); err != nil {
+			return fmt.Errorf("insert into %s eventid=%s userid=%d sampletm1=%v rows %d-%d: %w", table, sample.Eventid, sample.Userid, sample.Sampletm1, start+1, end, err)
+		}
+	}
+	return nil
+}
+
+/*
+	MaxTLsnID()
+	listenerテーブルに保存されているリスナーの（このプログラムが振った）IDの最大値を返します。
+	保存されているものがないときは ErrNoSnapshot を返します。
+	新たに現れたリスナーのIDはSaveSnapshot()、CommitSample()が振るので、これを使ってIDを作る必要はありません。
+*/
+func (s *Store) MaxTLsnID(ctx context.Context, eventid string, userid int) (maxtlsnid int, err error) {
+
+	var n sql.NullInt64
+	query := "select max(t_lsnid) from listener where eventid = ? and userid = ?"
+	if err = s.db.QueryRowContext(ctx, s.rebind(query), eventid, userid).Scan(&n); err != nil {
+		return 0, fmt.Errorf("MaxTLsnID() eventid=%s userid=%d: %w", eventid, userid, err)
+	}
+	if !n.Valid {
+		return 0, ErrNoSnapshot
+	}
+	return int(n.Int64), nil
+}
+
+/*
+	SavePage()
+	取得した貢献ランキングのページ（圧縮したもの）を保存します。tsはsrgpcではtimetableのsampletm1です。
+	同じイベント、ユーザー、時刻のものがあれば置き換えます（PostgreSQLにはreplace intoがないのでon conflictで更新します）
+
+	contpageテーブルは次のように作成しておきます。
+
+		create table contpage (
+			eventid	varchar(100) not null,
+			userid	int not null,
+			ts	datetime not null,
+			page	mediumblob not null,
+			primary key (eventid, userid, ts)
+		);
+*/
+func (s *Store) SavePage(ctx context.Context, eventid string, userid int, ts time.Time, page []byte) error {
+
+	query := "replace into contpage(eventid, userid, ts, page) values(?,?,?,?)"
+	if s.dialect == "postgres" {
+		query = "insert into contpage(eventid, userid, ts, page) values(?,?,?,?)"
+		query += " on conflict (eventid, userid, ts) do update set page = excluded.page"
+	}
+	if _, err := s.db.ExecContext(ctx, s.rebind(query), eventid, userid, ts, page); err != nil {
+		return fmt.Errorf("SavePage() eventid=%s userid=%d ts=%v: %w", eventid, userid, ts, err)
+	}
+	return nil
+}
+
+// DeletePagesBefore はtsがbeforeより前のページを削除し、削除した数を返します。
+func (s *Store) DeletePagesBefore(ctx context.Context, before time.Time) (n int, err error) {
+
+	result, err := s.db.ExecContext(ctx, s.rebind("delete from contpage where ts < ?"), before)
+	if err != nil {
+		return 0, fmt.Errorf("DeletePagesBefore() before=%v: %w", before, err)
+	}
+	nr, _ := result.RowsAffected()
+	return int(nr), nil
+}
+
+// PageTimes は保存してあるページの時刻を古い順に返します。
+func (s *Store) PageTimes(ctx context.Context, eventid string, userid int) (tslist []time.Time, err error) {
+	return s.selectTimes(ctx, "select ts from contpage where eventid = ? and userid = ? order by ts", eventid, userid)
+}
+
+// Page は保存してあるページ（圧縮したもの）を返します。
+func (s *Store) Page(ctx context.Context, eventid string, userid int, ts time.Time) (page []byte, err error) {
+
+	query := "select page from contpage where eventid = ? and userid = ? and ts = ?"
+	if err = s.db.QueryRowContext(ctx, s.rebind(query), eventid, userid, ts).Scan(&page); err != nil {
+		return nil, fmt.Errorf("Page() eventid=%s userid=%d ts=%v: %w", eventid, userid, ts, err)
+	}
+	return page, nil
+}
+
+/*
+	DeleteReplay()
+	SaveReplaySnapshot()
+	突き合わせを再実行（replay）した結果をsampleのものとしてeventrank_replayテーブルに保存します（fetchtmはnullになります）
+	eventrank_replayテーブルはeventrankと同じ構造で作成しておきます。
+
+		create table eventrank_replay like eventrank;
+*/
+func (s *Store) DeleteReplay(ctx context.Context, eventid string, userid int) error {
+
+	if _, err := s.db.ExecContext(ctx, s.rebind("delete from eventrank_replay where eventid = ? and userid = ?"), eventid, userid); err != nil {
+		return fmt.Errorf("DeleteReplay() eventid=%s userid=%d: %w", eventid, userid, err)
+	}
+	return nil
+}
+
+func (s *Store) SaveReplaySnapshot(ctx context.Context, sample Sample, eventranking EventRanking) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.replaceSnapshot(ctx, tx, "eventrank_replay", sample, time.Time{}, eventranking)
+	})
+}
@@ -0,0 +1,83 @@
+package ShowroomDBlib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+/*
+	BenchmarkSaveSnapshot
+	貢献ランキングを保存する時間を、リスナーの数（size）と一つのinsertで追加する行数（batch）を変えて計測します。
+	SQLiteの一時的なデータベースで計測し、store_test.goの環境変数を指定したときはMySQL、PostgreSQLでも計測します。
+
+		% go test -run XXX -bench SaveSnapshot
+
+	listenerテーブルへの追加は最初に保存するときだけ行われるので、計測を始める前に一度保存しておきます
+	（以後の保存と同じく、listenerテーブルは更新だけになります）
+*/
+func BenchmarkSaveSnapshot(b *testing.B) {
+
+	dialects := []string{"sqlite"}
+	dsns := map[string]string{}
+	for _, server := range testServers {
+		if dsn := os.Getenv(server.env); dsn != "" {
+			dialects = append(dialects, server.dialect)
+			dsns[server.dialect] = dsn
+		}
+	}
+
+	for _, dialect := range dialects {
+		for _, size := range []int{100, 500, 2000} {
+			for _, batch := range []int{1, DefaultBatchSize} {
+				name := fmt.Sprintf("%s/size=%d/batch=%d", dialect, size, batch)
+				b.Run(name, func(b *testing.B) {
+					var s *Store
+					if dialect == "sqlite" {
+						s = newTestSQLite(b)
+					} else {
+						s = newTestServer(b, dialect, dsns[dialect])
+					}
+					migrateTestStore(b, s)
+					s.SetBatchSize(batch)
+
+					ctx := context.Background()
+					eventranking := benchmarkRanking(size)
+					base := time.Now().Add(-time.Hour).Truncate(time.Second)
+					sample := Sample{Eventid: testEventid, Userid: size, Sampletm1: base}
+					if err := s.SaveSnapshot(ctx, sample, sample.Sampletm1, eventranking); err != nil {
+						b.Fatal(err)
+					}
+
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						sample.Sampletm1 = base.Add(time.Duration(i+1) * time.Minute)
+						if err := s.SaveSnapshot(ctx, sample, sample.Sampletm1, eventranking); err != nil {
+							b.Fatal(err)
+						}
+					}
+					b.ReportMetric(float64(size*b.N)/b.Elapsed().Seconds(), "rows/s")
+				})
+			}
+		}
+	}
+}
+
+//	benchmarkRanking はsize人のリスナーの貢献ランキングを作ります。
+func benchmarkRanking(size int) (eventranking EventRanking) {
+	for i := 0; i < size; i++ {
+		eventranking = append(eventranking, EventRank{
+			Order:       i + 1,
+			Rank:        i + 1,
+			Listner:     fmt.Sprintf("ベンチマーク%04d", i+1),
+			LsnID:       1000000 + i,
+			Avatar:      fmt.Sprintf("https://image.showroom-cdn.com/showroom-prod/image/avatar/%d.png", i+1),
+			T_LsnID:     i + 1,
+			Point:       (size - i) * 100,
+			Incremental: (size - i) * 10,
+		})
+	}
+	return
+}
@@ -0,0 +1,147 @@
+package ShowroomDBlib
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//	OpenDb()する前に呼ばれても、パニックせずにそれぞれのエラーの値を返すこと。
+func TestCompatNotOpen(t *testing.T) {
+	saved := Db
+	Db = nil
+	defer func() { Db = saved }()
+
+	now := time.Now()
+	sample := Sample{Eventid: testEventid, Userid: 1, Sampletm1: now}
+	cases := []struct {
+		name string
+		call func() bool
+	}{
+		{"InsertIntoEventrank", func() bool { return InsertIntoEventrank(testEventid, 1, now, nil) == -1 }},
+		{"SelectMaxTsFromEventrank", func() bool { ndata, _ := SelectMaxTsFromEventrank(testEventid, 1); return ndata == -1 }},
+		{"SelectEidUidFromTimetable", func() bool { ndata, _, _, _ := SelectEidUidFromTimetable(); return ndata == -1 }},
+		{"ClaimSamplesFromTimetable", func() bool { _, status := ClaimSamplesFromTimetable("w1", 1, time.Minute); return status == -1 }},
+		{"RenewLease", func() bool { held, status := RenewLease("w1", sample, time.Minute); return !held && status == -1 }},
+		{"ReleaseSample", func() bool { return ReleaseSample("w1", sample) == -1 }},
+		{"SelectMaxTlsnidFromEventranking", func() bool { return SelectMaxTlsnidFromEventranking(testEventid, 1) == -1000 }},
+		{"UpdateTimetable", func() bool { return UpdateTimetable("w1", testEventid, 1, now, now, 0, 0, -1, PointCheckNone) == -2 }},
+		{"SelectEarnedpointFromTimetable", func() bool {
+			earnedpoint, status := SelectEarnedpointFromTimetable(testEventid, 1, now)
+			return earnedpoint == -1 && status == -1
+		}},
+		{"InsertIntoTimetable", func() bool { return InsertIntoTimetable(testEventid, 1, now, -1) == -1 }},
+		{"UpdateEarnedpointInTimetable", func() bool { return UpdateEarnedpointInTimetable(testEventid, 1, now, 0) == -1 }},
+		{"UpdateTimetableFailed", func() bool {
+			_, status := UpdateTimetableFailed("w1", testEventid, 1, now, "", 1, 0)
+			return status == -1
+		}},
+		{"SelectEventRankingFromEventrank", func() bool { _, status := SelectEventRankingFromEventrank(testEventid, 1, now); return status == -1 }},
+		{"InsertIntoContpage", func() bool { return InsertIntoContpage(testEventid, 1, now, nil) == -1 }},
+		{"DeleteFromContpage", func() bool { _, status := DeleteFromContpage(now); return status == -1 }},
+		{"SelectTsFromContpage", func() bool { _, status := SelectTsFromContpage(testEventid, 1); return status == -1 }},
+		{"SelectPageFromContpage", func() bool { _, status := SelectPageFromContpage(testEventid, 1, now); return status == -1 }},
+		{"SelectTsListFromEventrank", func() bool { _, status := SelectTsListFromEventrank(testEventid, 1); return status == -1 }},
+		{"DeleteFromEventrankReplay", func() bool { return DeleteFromEventrankReplay(testEventid, 1) == -1 }},
+		{"InsertIntoEventrankReplay", func() bool { return InsertIntoEventrankReplay(testEventid, 1, now, nil) == -1 }},
+	}
+	for _, c := range cases {
+		if !c.call() {
+			t.Errorf("%s() did not return its error value", c.name)
+		}
+	}
+}
+
+//	以前からの関数はOpenDb()でオープンしたStore（ServerConfig.ymlにしたがったもの）を使うこと。
+func TestCompatUsesOpenedStore(t *testing.T) {
+	savedDb, savedStore := Db, dbstore
+	defer func() { Db, dbstore = savedDb, savedStore }()
+
+	dbconfig := &DBConfig{Dbdriver: "sqlite", Dbpath: filepath.Join(t.TempDir(), "test.db"), Dbbatchsize: 7}
+	if status := OpenDb(dbconfig); status != 0 {
+		t.Fatalf("OpenDb() = %d, %v", status, Err)
+	}
+	defer Db.Close()
+	migrateTestStore(t, dbstore)
+
+	s, err := compat("TestCompatUsesOpenedStore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Dialect() != "sqlite" || s.BatchSize() != 7 {
+		t.Errorf("compat() dialect=%s batchsize=%d, want sqlite, 7", s.Dialect(), s.BatchSize())
+	}
+
+	now := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if status := InsertIntoTimetable(testEventid, 1, now, 1000); status != 0 {
+		t.Fatalf("InsertIntoTimetable() = %d", status)
+	}
+	if earnedpoint, status := SelectEarnedpointFromTimetable(testEventid, 1, now); status != 0 || earnedpoint != 1000 {
+		t.Errorf("SelectEarnedpointFromTimetable() = %d, %d, want 1000, 0", earnedpoint, status)
+	}
+}
+
+//	同じ配信を時刻を変えて二度保存しても、配信のsampletm1をキーにして置き換えられること。
+func TestInsertIntoEventrankIdempotent(t *testing.T) {
+	savedDb, savedStore := Db, dbstore
+	defer func() { Db, dbstore = savedDb, savedStore }()
+
+	if status := OpenDb(&DBConfig{Dbdriver: "sqlite", Dbpath: filepath.Join(t.TempDir(), "test.db")}); status != 0 {
+		t.Fatalf("OpenDb() = %d, %v", status, Err)
+	}
+	defer Db.Close()
+	migrateTestStore(t, dbstore)
+
+	sampletm1 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if status := InsertIntoTimetable(testEventid, 1, sampletm1, -1); status != 0 {
+		t.Fatalf("InsertIntoTimetable() = %d", status)
+	}
+	for _, fetched := range []time.Duration{5 * time.Minute, 6 * time.Minute} {
+		if status := InsertIntoEventrank(testEventid, 1, sampletm1.Add(fetched), testRanking()); status != 0 {
+			t.Fatalf("InsertIntoEventrank() = %d", status)
+		}
+	}
+
+	tslist, status := SelectTsListFromEventrank(testEventid, 1)
+	if status != 0 || len(tslist) != 1 || !tslist[0].Equal(sampletm1) {
+		t.Errorf("SelectTsListFromEventrank() = %v, %d, want [%v]", tslist, status, sampletm1)
+	}
+}
+
+//	保留（status = 9）になっている古い配信があっても、新しい貢献ランキングはその配信のものとして保存しないこと。
+func TestInsertIntoEventrankSkipsParked(t *testing.T) {
+	savedDb, savedStore := Db, dbstore
+	defer func() { Db, dbstore = savedDb, savedStore }()
+
+	if status := OpenDb(&DBConfig{Dbdriver: "sqlite", Dbpath: filepath.Join(t.TempDir(), "test.db")}); status != 0 {
+		t.Fatalf("OpenDb() = %d, %v", status, Err)
+	}
+	defer Db.Close()
+	migrateTestStore(t, dbstore)
+	ctx := context.Background()
+
+	parked := Sample{Eventid: testEventid, Userid: 1, Sampletm1: time.Now().Add(-2 * time.Hour).Truncate(time.Second)}
+	if status := InsertIntoTimetable(parked.Eventid, parked.Userid, parked.Sampletm1, -1); status != 0 {
+		t.Fatalf("InsertIntoTimetable() = %d", status)
+	}
+	if _, err := dbstore.ClaimNextSample(ctx, "w1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := dbstore.FailSample(ctx, "w1", parked, "test error", 1, 0); err != nil || !ok {
+		t.Fatalf("FailSample() = %v, %v, want parked", ok, err)
+	}
+
+	sampletm1 := parked.Sampletm1.Add(time.Hour)
+	if status := InsertIntoTimetable(testEventid, 1, sampletm1, -1); status != 0 {
+		t.Fatalf("InsertIntoTimetable() = %d", status)
+	}
+	if status := InsertIntoEventrank(testEventid, 1, sampletm1.Add(5*time.Minute), testRanking()); status != 0 {
+		t.Fatalf("InsertIntoEventrank() = %d", status)
+	}
+
+	tslist, status := SelectTsListFromEventrank(testEventid, 1)
+	if status != 0 || len(tslist) != 1 || !tslist[0].Equal(sampletm1) {
+		t.Errorf("SelectTsListFromEventrank() = %v, %d, want [%v] (not the parked %v)", tslist, status, sampletm1, parked.Sampletm1)
+	}
+}
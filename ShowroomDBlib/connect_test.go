@@ -0,0 +1,80 @@
+package ShowroomDBlib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveTLS(t *testing.T) {
+	cases := []struct {
+		dbtls, dbsslmode string
+		want             string
+		wantErr          bool
+	}{
+		{"", "", "", false},
+		{"verify-full", "", "verify-full", false},
+		{"", "verify-full", "verify-full", false}, //	以前の名前だけのときも使う
+		{"", "prefer", "preferred", false},
+		{"require", "require", "require", false},
+		{"preferred", "prefer", "preferred", false},
+		{"disable", "verify-full", "", true}, //	異なるものを指定したときはエラー
+	}
+	for _, c := range cases {
+		resolved, err := resolveTLS(&DBConfig{Dbtls: c.dbtls, Dbsslmode: c.dbsslmode})
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("resolveTLS(Dbtls=%q, Dbsslmode=%q) returned no error", c.dbtls, c.dbsslmode)
+			}
+			continue
+		}
+		if err != nil || resolved.Dbtls != c.want {
+			t.Errorf("resolveTLS(Dbtls=%q, Dbsslmode=%q) = %q, %v, want %q", c.dbtls, c.dbsslmode, resolved.Dbtls, err, c.want)
+		}
+	}
+}
+
+//	Dbsslmodeだけを指定した以前の設定でもTLSを使って接続すること。
+func TestDbsslmodeIsNotDropped(t *testing.T) {
+	resolved, err := resolveTLS(&DBConfig{Dbname: "test", Dbsslmode: "verify-full"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dsn, err := postgresDSN(resolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dsn, "sslmode='verify-full'") {
+		t.Errorf("postgresDSN() = %s, want sslmode='verify-full'", dsn)
+	}
+
+	resolved, err = resolveTLS(&DBConfig{Dbname: "test", Dbsslmode: "require"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := mysqlConfig(resolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TLSConfig != "skip-verify" {
+		t.Errorf("mysqlConfig() TLSConfig = %q, want skip-verify", cfg.TLSConfig)
+	}
+}
+
+//	lib/pqにはsslmode=preferがないので、接続する前に設定の誤りとすること（以前の名前のDbsslmodeでも）
+func TestPostgresPreferred(t *testing.T) {
+	if dsn, err := postgresDSN(&DBConfig{Dbname: "test", Dbtls: "preferred"}); err == nil {
+		t.Errorf("postgresDSN() = %s, want an error for preferred", dsn)
+	}
+
+	resolved, err := resolveTLS(&DBConfig{Dbdriver: "postgres", Dbname: "test", Dbsslmode: "prefer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn, err := postgresDSN(resolved); err == nil {
+		t.Errorf("postgresDSN() = %s, want an error for Dbsslmode prefer", dsn)
+	}
+	if _, err := OpenStore(&DBConfig{Dbdriver: "postgres", Dbname: "test", Dbtls: "preferred"}); err == nil || !strings.Contains(err.Error(), "preferred") {
+		t.Errorf("OpenStore() returned %v, want the Dbtls error", err)
+	}
+}
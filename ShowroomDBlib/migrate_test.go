@@ -0,0 +1,219 @@
+package ShowroomDBlib
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+//	migrateTo は版versionまでのスキーマを作り、それより前のスキーマで保存されていたデータを試せるようにします。
+func migrateTo(t *testing.T, s *Store, version int) {
+	t.Helper()
+	ctx := context.Background()
+	migrations, err := s.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.createSchemaVersion(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations[:version] {
+		for _, stmt := range m.Statements {
+			if _, err = s.db.ExecContext(ctx, stmt); err != nil {
+				t.Fatalf("%04d %s: %v", m.Version, m.Name, err)
+			}
+		}
+	}
+	if err = s.Baseline(ctx, version); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//	0007で一意キーを追加する前の版で重複して保存されていた貢献ランキングがあっても、スキーマを更新できること。
+func TestMigrateDuplicateSnapshots(t *testing.T) {
+	forEachEmptyStore(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+		migrateTo(t, s, 6)
+
+		//	同じ分のうちに同じ配信を二度処理したときのもの（後のものを残す）
+		ts := time.Now().Add(-time.Hour).Truncate(time.Minute)
+		rows := []struct {
+			listner string
+			t_lsnid int
+			point   int
+		}{{"リスナー1", 1, 100}, {"リスナー2", 2, 50}, {"リスナー1", 1, 200}, {"リスナー2", 2, 60}, {"リスナー3", 3, 10}}
+		var err error
+		for _, table := range []string{"eventrank", "eventrank_replay"} {
+			for i, row := range rows {
+				query := "insert into " + table + " (eventid, userid, ts, listner, t_lsnid, norder, nrank, point, increment) values (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+				if _, err = s.db.ExecContext(ctx, s.rebind(query), testEventid, 1, ts, row.listner, row.t_lsnid, i+1, i+1, row.point, -1); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		if _, _, err = s.Migrate(ctx, t.Logf); err != nil {
+			t.Fatalf("Migrate() with duplicate snapshots: %v", err)
+		}
+
+		for _, table := range []string{"eventrank", "eventrank_replay"} {
+			eventranking, err := s.selectSnapshot(ctx, table, testEventid, 1, ts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			points := make(map[string]int)
+			for _, evr := range eventranking {
+				points[evr.Listner] = evr.Point
+			}
+			if len(eventranking) != 3 || points["リスナー1"] != 200 || points["リスナー2"] != 60 || points["リスナー3"] != 10 {
+				t.Errorf("%s after migrate = %+v, want the later one of each duplicate", table, eventranking)
+			}
+		}
+	})
+}
+
+//	0010〜0012で、これまでのT_LsnID（Order + idx*1000）をルームごとに最初に現れた順に1から振りなおし、
+//	対応をtlsnid_mapに残し、次に振るものをlistener_seqに入れること。
+func TestMigrateRenumberTLsnID(t *testing.T) {
+	forEachEmptyStore(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+		migrateTo(t, s, 9)
+
+		//	ルーム1: 最初の配信にリスナーA（1002）とB（1）、次の配信にC（2001）が現れた。ルーム2: X（5）
+		t0 := time.Now().Add(-2 * time.Hour).Truncate(time.Minute)
+		t1 := t0.Add(time.Hour)
+		rows := []struct {
+			userid    int
+			sampletm1 time.Time
+			listner   string
+			t_lsnid   int
+		}{
+			{1, t0, "A", 1002}, {1, t0, "B", 1},
+			{1, t1, "A", 1002}, {1, t1, "B", 1}, {1, t1, "C", 2001},
+			{2, t0, "X", 5},
+		}
+		for i, row := range rows {
+			query := "insert into eventrank (eventid, userid, ts, sampletm1, fetchtm, listner, t_lsnid, norder, nrank, point, increment) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+			if _, err := s.db.ExecContext(ctx, s.rebind(query), testEventid, row.userid, row.sampletm1, row.sampletm1, row.sampletm1, row.listner, row.t_lsnid, i+1, i+1, 100, 100); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, _, err := s.Migrate(ctx, t.Logf); err != nil {
+			t.Fatalf("Migrate(): %v", err)
+		}
+
+		//	同じ配信に現れたものは以前のT_LsnIDの順
+		want := map[int]map[string][2]int{ //	userid → 名前 → {以前のT_LsnID、振りなおしたT_LsnID}
+			1: {"B": {1, 1}, "A": {1002, 2}, "C": {2001, 3}},
+			2: {"X": {5, 1}},
+		}
+		checked := 0
+		for userid, names := range want {
+			for _, sampletm1 := range []time.Time{t0, t1} {
+				eventranking, err := s.Snapshot(ctx, testEventid, userid, sampletm1)
+				if errors.Is(err, ErrNoSnapshot) {
+					continue
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				for _, evr := range eventranking {
+					checked++
+					if evr.T_LsnID != names[evr.Listner][1] {
+						t.Errorf("eventrank userid=%d %s %s t_lsnid = %d, want %d", userid, sampletm1, evr.Listner, evr.T_LsnID, names[evr.Listner][1])
+					}
+				}
+			}
+
+			listeners, err := s.Listeners(ctx, testEventid, userid)
+			if err != nil || len(listeners) != len(names) {
+				t.Fatalf("Listeners(%d) returned %d listener(s), %v, want %d", userid, len(listeners), err, len(names))
+			}
+			for _, l := range listeners {
+				if l.T_LsnID != names[l.Listner][1] {
+					t.Errorf("listener userid=%d %s t_lsnid = %d, want %d", userid, l.Listner, l.T_LsnID, names[l.Listner][1])
+				}
+			}
+
+			for name, ids := range names {
+				var newid int
+				query := "select new_tlsnid from tlsnid_map where eventid = ? and userid = ? and old_tlsnid = ?"
+				if err = s.db.QueryRowContext(ctx, s.rebind(query), testEventid, userid, ids[0]).Scan(&newid); err != nil || newid != ids[1] {
+					t.Errorf("tlsnid_map userid=%d %s %d = %d, %v, want %d", userid, name, ids[0], newid, err, ids[1])
+				}
+			}
+
+			var nextid int
+			query := "select nextid from listener_seq where eventid = ? and userid = ?"
+			if err = s.db.QueryRowContext(ctx, s.rebind(query), testEventid, userid).Scan(&nextid); err != nil || nextid != len(names)+1 {
+				t.Errorf("listener_seq userid=%d nextid = %d, %v, want %d", userid, nextid, err, len(names)+1)
+			}
+		}
+		if checked != len(rows) {
+			t.Errorf("eventrank has %d row(s) after migrate, want %d", checked, len(rows))
+		}
+		if first, err := s.AllocateTLsnIDs(ctx, testEventid, 1, 1); err != nil || first != 4 {
+			t.Errorf("AllocateTLsnIDs() after migrate = %d, %v, want 4", first, err)
+		}
+	})
+}
+
+//	0014で、これまでのeventrankのlastnameから判定の方法、前回の名前、名前の距離を求めること。
+func TestMigrateMatchReason(t *testing.T) {
+	forEachEmptyStore(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+		migrateTo(t, s, 13)
+
+		t0 := time.Now().Add(-2 * time.Hour).Truncate(time.Minute)
+		t1 := t0.Add(time.Hour)
+		rows := []struct {
+			t_lsnid   int
+			listner   string
+			lastname  string
+			point     int
+			firstseen time.Time
+			method    string
+			prevname  string
+			distance  float64
+		}{
+			{1, "y", "x [ID]", 100, t0, "id", "x", 0},
+			{2, "y", "x [2]", 100, t0, "unique-higher", "x", 0},
+			{3, "same", "same [2]", 100, t0, "unique-higher", "", 0},
+			{4, "y", "x [3A 0.512]", 100, t0, "3A", "x", 0.512},
+			{5, "y", "x y [3C 1.050]", 100, t0, "3C", "x y", 1.05},
+			{6, "y", "", 100, t1, "new", "", 0},
+			{7, "y", "", 100, t0, "exact", "", 0},
+			{8, "y", "", -1, t0, "lost", "", 0},
+			{9, "y", "x [3B 0.700]", -1, t0, "lost", "", 0},
+		}
+		for i, row := range rows {
+			query := "insert into eventrank (eventid, userid, ts, sampletm1, fetchtm, listner, lastname, t_lsnid, norder, nrank, point, increment) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+			if _, err := s.db.ExecContext(ctx, s.rebind(query), testEventid, 1, t1, t1, t1, row.listner, row.lastname, row.t_lsnid, i+1, i+1, row.point, -1); err != nil {
+				t.Fatal(err)
+			}
+			query = "insert into listener (eventid, userid, t_lsnid, listner, firstseen, lastseen) values (?, ?, ?, ?, ?, ?)"
+			if _, err := s.db.ExecContext(ctx, s.rebind(query), testEventid, 1, row.t_lsnid, row.listner, row.firstseen, t1); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, _, err := s.Migrate(ctx, t.Logf); err != nil {
+			t.Fatalf("Migrate(): %v", err)
+		}
+
+		for _, row := range rows {
+			var method, prevname string
+			var distance float64
+			query := "select method, prevname, distance from eventrank where eventid = ? and userid = ? and t_lsnid = ?"
+			if err := s.db.QueryRowContext(ctx, s.rebind(query), testEventid, 1, row.t_lsnid).Scan(&method, &prevname, &distance); err != nil {
+				t.Fatal(err)
+			}
+			if method != row.method || prevname != row.prevname || math.Abs(distance-row.distance) > 1e-9 {
+				t.Errorf("lastname %q point %d: method=%q prevname=%q distance=%v, want %q %q %v",
+					row.lastname, row.point, method, prevname, distance, row.method, row.prevname, row.distance)
+			}
+		}
+	})
+}
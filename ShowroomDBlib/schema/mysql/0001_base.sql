@@ -0,0 +1,27 @@
+-- 以前からのtimetableとeventrank
+-- timetableは獲得ポイントを監視しているプロセスが、貢献ランキングを取得すべき配信（イベント、ルーム、時刻）を登録する。
+-- eventrankは貢献ランキングを突き合わせた結果（リスナーごとの前回の名前、増分など）を取得した時刻（ts）ごとに保存する。
+
+create table if not exists timetable (
+	eventid		varchar(100) not null,
+	userid		int not null,
+	sampletm1	datetime not null,
+	sampletm2	datetime,
+	totalpoint	int not null default 0,
+	status		int not null default 0
+);
+
+create table if not exists eventrank (
+	eventid		varchar(100) not null,
+	userid		int not null,
+	ts		datetime not null,
+	listner		varchar(255) not null,
+	lastname	varchar(255) not null default '',
+	lsnid		int not null default 0,
+	t_lsnid		int not null,
+	norder		int not null,
+	nrank		int not null,
+	point		int not null,
+	increment	int not null,
+	status		int not null default 0
+);
@@ -0,0 +1,5 @@
+-- 貢献ランキングの取得に失敗したときのリトライ（status = 2）と保留（status = 9）
+
+alter table timetable add column attempts int not null default 0;
+alter table timetable add column lasterror varchar(255);
+alter table timetable add column nextretry datetime;
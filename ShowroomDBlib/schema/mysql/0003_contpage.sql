@@ -0,0 +1,9 @@
+-- 取得した貢献ランキングのページ（gzipで圧縮したもの）
+
+create table if not exists contpage (
+	eventid	varchar(100) not null,
+	userid	int not null,
+	ts	datetime not null,
+	page	mediumblob not null,
+	primary key (eventid, userid, ts)
+);
@@ -0,0 +1,6 @@
+-- ルームのポイント（監視プロセスが記録したもの、貢献ランキングの合計、ページに表示されたもの）とその検証結果
+
+alter table timetable add column earnedpoint int;
+alter table timetable add column sumpoint int not null default 0;
+alter table timetable add column disppoint int not null default -1;
+alter table timetable add column pointcheck int not null default -1;
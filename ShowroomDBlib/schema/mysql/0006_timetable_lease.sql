@@ -0,0 +1,4 @@
+-- timetableの行の確保（status = 3）
+
+alter table timetable add column worker varchar(64);
+alter table timetable add column leaseexpiry datetime;
@@ -0,0 +1,23 @@
+-- 同じ時刻の貢献ランキングが重複して保存されないようにする。
+-- eventid, userid, ts で始まるので SelectMaxTsFromEventrank()、SelectEventRankingFromEventrank() のインデックスにもなる。
+--
+-- 以前は同じ配信を同じ分のうちに二度処理すると同じ行が重複して保存されていたので、一意キーを追加する前にそれを削除する。
+-- 行を区別する列がないので一時的な列（dedupe_id）を追加し、重複しているもののうち後に追加されたもの（dedupe_idが最大のもの）を残す。
+
+alter table eventrank add column dedupe_id bigint not null auto_increment, add unique key eventrank_dedupe (dedupe_id),
+	add key eventrank_dedupe_key (eventid, userid, ts, t_lsnid);
+delete e from eventrank e join (
+	select eventid, userid, ts, t_lsnid, max(dedupe_id) as keep_id from eventrank
+	group by eventid, userid, ts, t_lsnid having count(*) > 1
+) d on e.eventid = d.eventid and e.userid = d.userid and e.ts = d.ts and e.t_lsnid = d.t_lsnid and e.dedupe_id < d.keep_id;
+alter table eventrank drop column dedupe_id, drop key eventrank_dedupe_key;
+alter table eventrank add unique key eventrank_snapshot (eventid, userid, ts, t_lsnid);
+
+alter table eventrank_replay add column dedupe_id bigint not null auto_increment, add unique key eventrank_replay_dedupe (dedupe_id),
+	add key eventrank_replay_dedupe_key (eventid, userid, ts, t_lsnid);
+delete e from eventrank_replay e join (
+	select eventid, userid, ts, t_lsnid, max(dedupe_id) as keep_id from eventrank_replay
+	group by eventid, userid, ts, t_lsnid having count(*) > 1
+) d on e.eventid = d.eventid and e.userid = d.userid and e.ts = d.ts and e.t_lsnid = d.t_lsnid and e.dedupe_id < d.keep_id;
+alter table eventrank_replay drop column dedupe_id, drop key eventrank_replay_dedupe_key;
+alter table eventrank_replay add unique key eventrank_replay_snapshot (eventid, userid, ts, t_lsnid);
@@ -0,0 +1,15 @@
+-- 貢献ランキング（スナップショット）をtimetableの行（eventid、userid、sampletm1）をキーにして保存する。
+-- fetchtmは貢献ランキングのページを取得した時刻。tsにはsampletm1と同じものを保存する。
+-- これまでのデータはどのtimetableの行のものかがわからないので、sampletm1、fetchtmともtsとする。
+
+alter table eventrank add column sampletm1 datetime after ts;
+alter table eventrank add column fetchtm datetime after sampletm1;
+update eventrank set sampletm1 = ts, fetchtm = ts where sampletm1 is null;
+alter table eventrank drop index eventrank_snapshot;
+alter table eventrank add unique key eventrank_sample (eventid, userid, sampletm1, t_lsnid);
+
+alter table eventrank_replay add column sampletm1 datetime after ts;
+alter table eventrank_replay add column fetchtm datetime after sampletm1;
+update eventrank_replay set sampletm1 = ts where sampletm1 is null;
+alter table eventrank_replay drop index eventrank_replay_snapshot;
+alter table eventrank_replay add unique key eventrank_replay_sample (eventid, userid, sampletm1, t_lsnid);
@@ -0,0 +1,30 @@
+-- リスナー（T_LsnID）ごとの名前、最初と最後に現れた配信、状態（0: 最後の配信の貢献ランキングに載っている、1: 載っていない）
+-- eventrankには貢献ランキングに載っているリスナーだけを保存し、載らなくなったリスナーはここから突き合わせに加える。
+
+create table if not exists listener (
+	eventid		varchar(100) not null,
+	userid		int not null,
+	t_lsnid		int not null,
+	listner		varchar(255) not null,
+	lsnid		int not null default 0,
+	avatar		varchar(255) not null default '',
+	firstseen	datetime not null,
+	lastseen	datetime not null,
+	state		int not null default 0,
+	primary key (eventid, userid, t_lsnid)
+);
+
+-- これまでのeventrankからリスナーを登録する（名前などはそのリスナーが保存されている最後の配信のもの）
+
+insert into listener (eventid, userid, t_lsnid, listner, lsnid, avatar, firstseen, lastseen, state)
+select e.eventid, e.userid, e.t_lsnid, e.listner, e.lsnid, e.avatar, f.firstseen, coalesce(f.lastseen, f.firstseen),
+	case when e.point < 0 then 1 else 0 end
+from eventrank e
+join (select eventid, userid, t_lsnid, min(sampletm1) as firstseen, max(case when point >= 0 then sampletm1 end) as lastseen, max(sampletm1) as latest
+	from eventrank group by eventid, userid, t_lsnid) f
+	on e.eventid = f.eventid and e.userid = f.userid and e.t_lsnid = f.t_lsnid and e.sampletm1 = f.latest
+where not exists (select 1 from listener l where l.eventid = e.eventid and l.userid = e.userid and l.t_lsnid = e.t_lsnid);
+
+-- 貢献ランキングに載らなくなったリスナー（point = -1）の行はlistenerに登録したので、eventrankからは削除してかまわない。
+--	delete from eventrank where point < 0;
+-- （このmigrationでは削除しない。以前の貢献ランキングをそのまま参照しているものがあれば、それを確認してから削除すること）
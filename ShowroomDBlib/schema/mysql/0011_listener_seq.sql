@@ -0,0 +1,19 @@
+-- ルーム（eventid、userid）ごとに次に振るT_LsnID
+-- 貢献ランキングを保存するトランザクションの中で更新するので、同時に保存しても同じT_LsnIDを振ることはない。
+
+create table if not exists listener_seq (
+	eventid		varchar(100) not null,
+	userid		int not null,
+	nextid		int not null,
+	primary key (eventid, userid)
+);
+
+-- 0012_renumber_tlsnid で振りなおす前のT_LsnID（Order + idx*1000）と振りなおしたT_LsnIDの対応
+
+create table if not exists tlsnid_map (
+	eventid		varchar(100) not null,
+	userid		int not null,
+	old_tlsnid	int not null,
+	new_tlsnid	int not null,
+	primary key (eventid, userid, old_tlsnid)
+);
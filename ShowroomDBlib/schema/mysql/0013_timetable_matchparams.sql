@@ -0,0 +1,3 @@
+-- 貢献ランキングを保存したときに突き合わせの判定に使った値（"cutoff3a=0.62 gap3b=0.2 ..."、Environment.ymlのmatching）
+
+alter table timetable add column matchparams varchar(255);
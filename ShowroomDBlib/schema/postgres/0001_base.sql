@@ -0,0 +1,26 @@
+-- 以前からのtimetableとeventrank（schema/mysql/0001_base.sql と同じもの）
+-- 時刻はtimestamp with time zoneに保存する。
+
+create table if not exists timetable (
+	eventid		varchar(100) not null,
+	userid		integer not null,
+	sampletm1	timestamp with time zone not null,
+	sampletm2	timestamp with time zone,
+	totalpoint	integer not null default 0,
+	status		integer not null default 0
+);
+
+create table if not exists eventrank (
+	eventid		varchar(100) not null,
+	userid		integer not null,
+	ts		timestamp with time zone not null,
+	listner		varchar(255) not null,
+	lastname	varchar(255) not null default '',
+	lsnid		integer not null default 0,
+	t_lsnid		integer not null,
+	norder		integer not null,
+	nrank		integer not null,
+	point		integer not null,
+	increment	integer not null,
+	status		integer not null default 0
+);
@@ -0,0 +1,5 @@
+-- 貢献ランキングの取得に失敗したときのリトライ（status = 2）と保留（status = 9）
+
+alter table timetable add column if not exists attempts integer not null default 0;
+alter table timetable add column if not exists lasterror varchar(255);
+alter table timetable add column if not exists nextretry timestamp with time zone;
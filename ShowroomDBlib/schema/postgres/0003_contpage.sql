@@ -0,0 +1,10 @@
+-- 取得した貢献ランキングのページ（gzipで圧縮したもの）
+-- SavePage()は主キーを使って on conflict で置き換える。
+
+create table if not exists contpage (
+	eventid	varchar(100) not null,
+	userid	integer not null,
+	ts	timestamp with time zone not null,
+	page	bytea not null,
+	primary key (eventid, userid, ts)
+);
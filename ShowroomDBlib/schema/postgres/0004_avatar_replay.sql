@@ -0,0 +1,5 @@
+-- リスナーのアバター、突き合わせを再実行（replay）した結果を保存するテーブル
+
+alter table eventrank add column if not exists avatar varchar(255) not null default '';
+
+create table if not exists eventrank_replay (like eventrank including defaults);
@@ -0,0 +1,6 @@
+-- ルームのポイント（監視プロセスが記録したもの、貢献ランキングの合計、ページに表示されたもの）とその検証結果
+
+alter table timetable add column if not exists earnedpoint integer;
+alter table timetable add column if not exists sumpoint integer not null default 0;
+alter table timetable add column if not exists disppoint integer not null default -1;
+alter table timetable add column if not exists pointcheck integer not null default -1;
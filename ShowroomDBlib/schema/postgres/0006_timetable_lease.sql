@@ -0,0 +1,4 @@
+-- timetableの行の確保（status = 3）
+
+alter table timetable add column if not exists worker varchar(64);
+alter table timetable add column if not exists leaseexpiry timestamp with time zone;
@@ -0,0 +1,9 @@
+-- 同じ時刻の貢献ランキングが重複して保存されないようにする。
+-- 一意キーを追加する前に、重複して保存されている行を削除する（ctidが最大のものを残す）
+
+delete from eventrank a using eventrank b
+	where a.eventid = b.eventid and a.userid = b.userid and a.ts = b.ts and a.t_lsnid = b.t_lsnid and a.ctid < b.ctid;
+create unique index if not exists eventrank_snapshot on eventrank (eventid, userid, ts, t_lsnid);
+delete from eventrank_replay a using eventrank_replay b
+	where a.eventid = b.eventid and a.userid = b.userid and a.ts = b.ts and a.t_lsnid = b.t_lsnid and a.ctid < b.ctid;
+create unique index if not exists eventrank_replay_snapshot on eventrank_replay (eventid, userid, ts, t_lsnid);
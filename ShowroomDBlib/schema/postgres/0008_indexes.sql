@@ -0,0 +1,5 @@
+-- 処理すべきtimetableの行の検索と確保、T_LsnIDの最大値の検索のためのインデックス
+
+create index if not exists timetable_pending on timetable (status, sampletm1);
+create index if not exists timetable_room on timetable (eventid, userid, sampletm1);
+create index if not exists eventrank_tlsnid on eventrank (eventid, userid, t_lsnid);
@@ -0,0 +1,13 @@
+-- 貢献ランキング（スナップショット）をtimetableの行（eventid、userid、sampletm1）をキーにして保存する（schema/mysql/0009_snapshot_sample.sql と同じもの）
+
+alter table eventrank add column if not exists sampletm1 timestamp with time zone;
+alter table eventrank add column if not exists fetchtm timestamp with time zone;
+update eventrank set sampletm1 = ts, fetchtm = ts where sampletm1 is null;
+drop index if exists eventrank_snapshot;
+create unique index if not exists eventrank_sample on eventrank (eventid, userid, sampletm1, t_lsnid);
+
+alter table eventrank_replay add column if not exists sampletm1 timestamp with time zone;
+alter table eventrank_replay add column if not exists fetchtm timestamp with time zone;
+update eventrank_replay set sampletm1 = ts where sampletm1 is null;
+drop index if exists eventrank_replay_snapshot;
+create unique index if not exists eventrank_replay_sample on eventrank_replay (eventid, userid, sampletm1, t_lsnid);
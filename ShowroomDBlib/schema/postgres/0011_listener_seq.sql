@@ -0,0 +1,20 @@
+-- ルーム（eventid、userid）ごとに次に振るT_LsnID
+-- （schema/mysql/0011_listener_seq.sql と同じもの）
+-- 貢献ランキングを保存するトランザクションの中で更新するので、同時に保存しても同じT_LsnIDを振ることはない。
+
+create table if not exists listener_seq (
+	eventid		varchar(100) not null,
+	userid		integer not null,
+	nextid		integer not null,
+	primary key (eventid, userid)
+);
+
+-- 0012_renumber_tlsnid で振りなおす前のT_LsnID（Order + idx*1000）と振りなおしたT_LsnIDの対応
+
+create table if not exists tlsnid_map (
+	eventid		varchar(100) not null,
+	userid		integer not null,
+	old_tlsnid	integer not null,
+	new_tlsnid	integer not null,
+	primary key (eventid, userid, old_tlsnid)
+);
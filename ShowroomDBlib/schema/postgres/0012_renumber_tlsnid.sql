@@ -0,0 +1,32 @@
+-- これまでのT_LsnID（Order + idx*1000）を、ルームごとに最初に現れた順に1から振りなおす。
+-- （schema/mysql/0012_renumber_tlsnid.sql と同じもの）
+-- 対応はtlsnid_mapに残す（振りなおす前のT_LsnIDで記録したものを探すときに使う）
+-- 一つのトランザクションで実行するので、途中で失敗したときは（MySQLでも）すべて取り消される。
+
+insert into tlsnid_map (eventid, userid, old_tlsnid, new_tlsnid)
+select l.eventid, l.userid, l.t_lsnid,
+	(select count(*) from listener l2 where l2.eventid = l.eventid and l2.userid = l.userid
+		and (l2.firstseen < l.firstseen or (l2.firstseen = l.firstseen and l2.t_lsnid <= l.t_lsnid)))
+from listener l
+where not exists (select 1 from tlsnid_map m where m.eventid = l.eventid and m.userid = l.userid);
+
+-- 一意キーに反しないよう、いったん負の値にしてから正の値にする。
+
+update eventrank set t_lsnid = -(select m.new_tlsnid from tlsnid_map m
+	where m.eventid = eventrank.eventid and m.userid = eventrank.userid and m.old_tlsnid = eventrank.t_lsnid)
+where t_lsnid > 0 and exists (select 1 from tlsnid_map m
+	where m.eventid = eventrank.eventid and m.userid = eventrank.userid and m.old_tlsnid = eventrank.t_lsnid);
+update eventrank set t_lsnid = -t_lsnid where t_lsnid < 0;
+
+update listener set t_lsnid = -(select m.new_tlsnid from tlsnid_map m
+	where m.eventid = listener.eventid and m.userid = listener.userid and m.old_tlsnid = listener.t_lsnid)
+where t_lsnid > 0 and exists (select 1 from tlsnid_map m
+	where m.eventid = listener.eventid and m.userid = listener.userid and m.old_tlsnid = listener.t_lsnid);
+update listener set t_lsnid = -t_lsnid where t_lsnid < 0;
+
+-- eventrank_replayはreplayを実行するたびに作りなおすので、振りなおさない。
+
+insert into listener_seq (eventid, userid, nextid)
+select eventid, userid, max(t_lsnid) + 1 from listener l
+where not exists (select 1 from listener_seq s where s.eventid = l.eventid and s.userid = l.userid)
+group by eventid, userid;
@@ -0,0 +1,4 @@
+-- 貢献ランキングを保存したときに突き合わせの判定に使った値（"cutoff3a=0.62 gap3b=0.2 ..."、Environment.ymlのmatching）
+-- （schema/mysql/0013_timetable_matchparams.sql と同じもの）
+
+alter table timetable add column if not exists matchparams varchar(255);
@@ -0,0 +1,34 @@
+-- 突き合わせの結果（前回の名前、判定の方法、名前の距離）をlastnameとは別のカラムに保存する。
+-- （schema/mysql/0014_match_reason.sql と同じもの）
+-- method	id、exact、unique-higher、3A、3B、3C、new、lost（matching.Method）
+-- lastnameはこれまでと同じ形式（"前回の名前 [3A 0.512]" など、Excelやログに表示するもの）のまま保存する。
+
+alter table eventrank add column if not exists prevname varchar(255) not null default '';
+alter table eventrank add column if not exists method varchar(20) not null default '';
+alter table eventrank add column if not exists distance double precision not null default 0;
+alter table eventrank_replay add column if not exists prevname varchar(255) not null default '';
+alter table eventrank_replay add column if not exists method varchar(20) not null default '';
+alter table eventrank_replay add column if not exists distance double precision not null default 0;
+
+-- これまでのeventrankのlastnameから求める（eventrank_replayはreplayを実行するたびに作りなおすので求めない）
+--	"前回の名前 [ID]"		id
+--	"前回の名前 [2]"		unique-higher
+--	"前回の名前 [3A 0.512]"	3A、3B、3C（名前の距離は "%6.3f" で書かれている）
+--	""			そのリスナーが最初に現れた配信ならnew、それ以外はexact（IDが一致して名前が変わっていないものもexactとする）
+--	point < 0		lost（以前は貢献ランキングに載らなくなったリスナーも保存していた）
+
+update eventrank set method = 'lost' where method = '' and point < 0;
+update eventrank set method = 'id', prevname = left(lastname, -5)
+where method = '' and lastname like '% [ID]';
+update eventrank set method = 'unique-higher', prevname = left(lastname, -4)
+where method = '' and lastname like '% [2]';
+update eventrank set method = substr(lastname, length(lastname) - 8, 2), prevname = left(lastname, -11), distance = cast(substr(lastname, length(lastname) - 5, 5) as double precision)
+where method = '' and lastname like '% [3_ _.___]';
+
+-- 名前が変わっていないものはprevnameを""にする（Phase 2、3で判定したものは名前が変わっていなくてもlastnameに書いていた）
+update eventrank set prevname = '' where prevname = listner and method in ('unique-higher', '3A', '3B', '3C');
+
+update eventrank set method = case when exists (select 1 from listener l
+		where l.eventid = eventrank.eventid and l.userid = eventrank.userid and l.t_lsnid = eventrank.t_lsnid and l.firstseen = eventrank.sampletm1)
+	then 'new' else 'exact' end
+where method = '' and lastname = '';
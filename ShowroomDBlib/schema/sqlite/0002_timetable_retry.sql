@@ -0,0 +1,3 @@
+alter table timetable add column attempts integer not null default 0;
+alter table timetable add column lasterror varchar(255);
+alter table timetable add column nextretry datetime;
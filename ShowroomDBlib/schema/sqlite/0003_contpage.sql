@@ -0,0 +1,7 @@
+create table if not exists contpage (
+	eventid	varchar(100) not null,
+	userid	integer not null,
+	ts	datetime not null,
+	page	blob not null,
+	primary key (eventid, userid, ts)
+);
@@ -0,0 +1,19 @@
+-- SQLiteには create table ... like がないので eventrank_replay は列を並べて作成する。
+
+alter table eventrank add column avatar varchar(255) not null default '';
+
+create table if not exists eventrank_replay (
+	eventid		varchar(100) not null,
+	userid		integer not null,
+	ts		datetime not null,
+	listner		varchar(255) not null,
+	lastname	varchar(255) not null default '',
+	lsnid		integer not null default 0,
+	t_lsnid		integer not null,
+	norder		integer not null,
+	nrank		integer not null,
+	point		integer not null,
+	increment	integer not null,
+	status		integer not null default 0,
+	avatar		varchar(255) not null default ''
+);
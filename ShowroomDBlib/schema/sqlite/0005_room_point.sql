@@ -0,0 +1,4 @@
+alter table timetable add column earnedpoint integer;
+alter table timetable add column sumpoint integer not null default 0;
+alter table timetable add column disppoint integer not null default -1;
+alter table timetable add column pointcheck integer not null default -1;
@@ -0,0 +1,2 @@
+alter table timetable add column worker varchar(64);
+alter table timetable add column leaseexpiry datetime;
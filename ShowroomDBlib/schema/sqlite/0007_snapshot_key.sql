@@ -0,0 +1,6 @@
+-- 一意キーを追加する前に、重複して保存されている行を削除する（後に追加されたもの（rowidが最大のもの）を残す）
+
+delete from eventrank where rowid not in (select max(rowid) from eventrank group by eventid, userid, ts, t_lsnid);
+create unique index if not exists eventrank_snapshot on eventrank (eventid, userid, ts, t_lsnid);
+delete from eventrank_replay where rowid not in (select max(rowid) from eventrank_replay group by eventid, userid, ts, t_lsnid);
+create unique index if not exists eventrank_replay_snapshot on eventrank_replay (eventid, userid, ts, t_lsnid);
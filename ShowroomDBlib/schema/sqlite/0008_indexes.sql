@@ -0,0 +1,3 @@
+create index if not exists timetable_pending on timetable (status, sampletm1);
+create index if not exists timetable_room on timetable (eventid, userid, sampletm1);
+create index if not exists eventrank_tlsnid on eventrank (eventid, userid, t_lsnid);
@@ -0,0 +1,672 @@
+package ShowroomDBlib
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+/*
+	Storeのテスト
+
+	テストごとに一時的なSQLiteのデータベースを作成して実行します（他のテストのデータには影響されません）
+	次の環境変数を指定したときは、MySQL、PostgreSQLでも同じテストを実行します。
+	テストごとにデータベース（showroomdblib_test_{時刻}）を作成し、終わったら削除するので、データベースを作成、削除できる
+	ユーザーで接続してください。接続したデータベースにあるデータには触れません。
+
+	SHOWROOMDBLIB_TEST_MYSQL	MySQLのDSN（例 "user:password@tcp(localhost:3306)/"）
+	SHOWROOMDBLIB_TEST_POSTGRES	PostgreSQLの接続文字列（例 "host=localhost user=postgres password=xxx dbname=postgres sslmode=disable"）
+*/
+
+var testServers = []struct {
+	dialect string
+	env     string
+}{
+	{"mysql", "SHOWROOMDBLIB_TEST_MYSQL"},
+	{"postgres", "SHOWROOMDBLIB_TEST_POSTGRES"},
+}
+
+//	forEachStore はfnをSQLiteと、環境変数で指定されたMySQL、PostgreSQLのそれぞれの新しいデータベース（スキーマは最新の版）で実行します。
+func forEachStore(t *testing.T, fn func(t *testing.T, s *Store)) {
+	t.Helper()
+	forEachEmptyStore(t, func(t *testing.T, s *Store) {
+		migrateTestStore(t, s)
+		fn(t, s)
+	})
+}
+
+//	forEachEmptyStore はforEachStoreと同じですが、スキーマを作成していないデータベースで実行します。
+func forEachEmptyStore(t *testing.T, fn func(t *testing.T, s *Store)) {
+	t.Helper()
+	t.Run("sqlite", func(t *testing.T) {
+		fn(t, newTestSQLite(t))
+	})
+	for _, server := range testServers {
+		server := server
+		t.Run(server.dialect, func(t *testing.T) {
+			dsn := os.Getenv(server.env)
+			if dsn == "" {
+				t.Skipf("%s is not set", server.env)
+			}
+			fn(t, newTestServer(t, server.dialect, dsn))
+		})
+	}
+}
+
+func newTestSQLite(t testing.TB) *Store {
+	t.Helper()
+	s, err := OpenStore(&DBConfig{Dbdriver: "sqlite", Dbpath: filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+//	newTestServer はdsnのサーバーにテスト用のデータベースを作成し、それを使うStoreを返します（テストが終わったら削除します）
+func newTestServer(t testing.TB, dialect, dsn string) *Store {
+	t.Helper()
+
+	if dialect == "postgres" && (strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")) {
+		var err error
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	admin, err := sql.Open(dialect, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := fmt.Sprintf("showroomdblib_test_%d", time.Now().UnixNano())
+	if _, err = admin.Exec("create database " + name); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("drop database " + name); err != nil {
+			t.Logf("drop database %s: %v", name, err)
+		}
+		admin.Close()
+	})
+
+	var db *sql.DB
+	switch dialect {
+	case "mysql":
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.DBName = name
+		cfg.ParseTime = true
+		connector, err := mysql.NewConnector(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db = sql.OpenDB(connector)
+	case "postgres":
+		//	後に書いたものが優先される。
+		if db, err = sql.Open("postgres", dsn+" dbname="+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Store{db: db, dialect: dialect, batchsize: DefaultBatchSize}
+	//	t.Cleanup()は後に登録したものから実行されるので、データベースを削除する前に接続を閉じる。
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func migrateTestStore(t testing.TB, s *Store) {
+	t.Helper()
+	if _, _, err := s.Migrate(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const testEventid = "test"
+
+//	fixture はテストで使う配信とデータです。
+type fixture struct {
+	t    *testing.T
+	ctx  context.Context
+	s    *Store
+	base time.Time
+}
+
+func newFixture(t *testing.T, s *Store) *fixture {
+	return &fixture{t: t, ctx: context.Background(), s: s, base: time.Now().Add(-time.Hour).Truncate(time.Second)}
+}
+
+//	sample はroomのm分目の配信を返します。
+func (f *fixture) sample(room, m int) Sample {
+	return Sample{Eventid: testEventid, Userid: room, Sampletm1: f.base.Add(time.Duration(m) * time.Minute)}
+}
+
+func (f *fixture) insert(samples ...Sample) {
+	f.t.Helper()
+	for _, sample := range samples {
+		if err := f.s.InsertSample(f.ctx, sample, -1); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+}
+
+func (f *fixture) claim(worker string) []Sample {
+	f.t.Helper()
+	samples, err := f.s.ClaimSamples(f.ctx, worker, 1000, time.Minute)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return samples
+}
+
+func (f *fixture) release(worker string, samples ...Sample) {
+	f.t.Helper()
+	for _, sample := range samples {
+		if err := f.s.ReleaseSample(f.ctx, worker, sample); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+}
+
+func sameSamples(a, b []Sample) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Eventid != b[i].Eventid || a[i].Userid != b[i].Userid || !a[i].Sampletm1.Equal(b[i].Sampletm1) {
+			return false
+		}
+	}
+	return true
+}
+
+func testRanking() EventRanking {
+	return EventRanking{
+		{Order: 1, Rank: 1, Listner: "リスナー1", LsnID: 101, Avatar: "a1", T_LsnID: 1, Point: 300, Incremental: 300, Method: "new"},
+		{Order: 2, Rank: 2, Listner: "リスナー2", LsnID: 102, Avatar: "a2", T_LsnID: 2, Point: 200, Incremental: 200, Method: "exact"},
+		{Order: 3, Rank: 3, Listner: "リスナー3", T_LsnID: 3, Point: 100, Incremental: -1, Lastname: "前の名前 [3A 0.512]",
+			Prevname: "前の名前", Method: "3A", Distance: 0.512},
+	}
+}
+
+func TestClaimSamplesOrder(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+		f.insert(f.sample(1, 1), f.sample(1, 0), f.sample(2, 2))
+
+		want := []Sample{f.sample(1, 0), f.sample(1, 1), f.sample(2, 2)}
+		if got := f.claim("w1"); !sameSamples(got, want) {
+			t.Errorf("ClaimSamples() = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestClaimSamplesExclusive(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+		f.insert(f.sample(1, 0), f.sample(1, 1))
+
+		if got := f.claim("w1"); len(got) != 2 {
+			t.Fatalf("w1 claimed %v, want 2 samples", got)
+		}
+		if got := f.claim("w2"); len(got) != 0 {
+			t.Errorf("w2 claimed %v held by w1", got)
+		}
+		if err := s.RenewLease(f.ctx, "w2", f.sample(1, 0), time.Minute); !errors.Is(err, ErrNotClaimed) {
+			t.Errorf("RenewLease() by w2 returned %v, want ErrNotClaimed", err)
+		}
+		if err := s.RenewLease(f.ctx, "w1", f.sample(1, 0), time.Minute); err != nil {
+			t.Errorf("RenewLease() by w1 returned %v", err)
+		}
+	})
+}
+
+func TestReleaseSample(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+		f.insert(f.sample(1, 0), f.sample(1, 1), f.sample(2, 2))
+
+		f.release("w1", f.claim("w1")...)
+		if got := f.claim("w2"); len(got) != 3 {
+			t.Errorf("w2 claimed %v after release, want 3 samples", got)
+		}
+	})
+}
+
+func TestFailSampleRetry(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+		f.insert(f.sample(1, 0), f.sample(1, 1), f.sample(2, 2))
+		f.claim("w1")
+
+		parked, err := s.FailSample(f.ctx, "w1", f.sample(1, 0), "test error", 3, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parked {
+			t.Errorf("parked after the first failure")
+		}
+		//	後の配信（同じルーム）は、前の配信のリトライが終わるまで確保できない。
+		f.release("w1", f.sample(1, 1), f.sample(2, 2))
+		want := []Sample{f.sample(2, 2)}
+		if got := f.claim("w2"); !sameSamples(got, want) {
+			t.Errorf("claimed %v, want only room 2", got)
+		}
+	})
+}
+
+func TestFailSampleParked(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+		sample := f.sample(3, 3)
+		f.insert(sample)
+
+		for i := 1; i <= 2; i++ {
+			if got := f.claim("w1"); !sameSamples(got, []Sample{sample}) {
+				t.Fatalf("claimed %v before failure %d, want %v", got, i, sample)
+			}
+			parked, err := s.FailSample(f.ctx, "w1", sample, "test error", 2, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parked != (i == 2) {
+				t.Errorf("parked=%v after %d failure(s)", parked, i)
+			}
+		}
+		if got := f.claim("w1"); len(got) != 0 {
+			t.Errorf("parked sample was claimed: %v", got)
+		}
+	})
+}
+
+func TestCommitSample(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+		sample := f.sample(2, 2)
+		f.insert(sample)
+		f.claim("w1")
+
+		fetchtm := f.base.Add(10 * time.Minute)
+		result := SampleResult{Sampletm2: fetchtm, Totalpoint: 600, Sumpoint: 600, Disppoint: 610, Pointcheck: PointCheckOK,
+			Matchparams: "cutoff3a=0.62 gap3b=0.2 ceiling=1.1 insert=0.8 delete=0.8 replace=1"}
+		if err := s.CommitSample(f.ctx, "w1", sample, fetchtm, testRanking(), result); err != nil {
+			t.Fatal(err)
+		}
+
+		sampletm1, eventranking, err := s.LatestSnapshot(f.ctx, testEventid, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sampletm1.Equal(sample.Sampletm1) {
+			t.Errorf("LatestSnapshot() sampletm1=%v, want %v", sampletm1, sample.Sampletm1)
+		}
+		want := testRanking()
+		if len(eventranking) != len(want) {
+			t.Fatalf("LatestSnapshot() returned %d listener(s), want %d", len(eventranking), len(want))
+		}
+		for i := range want {
+			if eventranking[i] != want[i] {
+				t.Errorf("LatestSnapshot()[%d] = %+v, want %+v", i, eventranking[i], want[i])
+			}
+		}
+		if maxtlsnid, err := s.MaxTLsnID(f.ctx, testEventid, 2); err != nil || maxtlsnid != 3 {
+			t.Errorf("MaxTLsnID() = %d, %v, want 3", maxtlsnid, err)
+		}
+		if matchparams, err := s.MatchParams(f.ctx, sample); err != nil || matchparams != result.Matchparams {
+			t.Errorf("MatchParams() = %q, %v, want %q", matchparams, err, result.Matchparams)
+		}
+		//	処理済みのものは確保できない。
+		if err = s.RenewLease(f.ctx, "w1", sample, time.Minute); !errors.Is(err, ErrNotClaimed) {
+			t.Errorf("RenewLease() after commit returned %v, want ErrNotClaimed", err)
+		}
+	})
+}
+
+func TestCommitSampleNotClaimed(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+		sample := f.sample(4, 4)
+		f.insert(sample)
+
+		fetchtm := f.base.Add(11 * time.Minute)
+		err := s.CommitSample(f.ctx, "w1", sample, fetchtm, testRanking(), SampleResult{Sampletm2: fetchtm})
+		if !errors.Is(err, ErrNotClaimed) {
+			t.Errorf("CommitSample() returned %v, want ErrNotClaimed", err)
+		}
+		if _, _, err = s.LatestSnapshot(f.ctx, testEventid, 4); !errors.Is(err, ErrNoSnapshot) {
+			t.Errorf("LatestSnapshot() returned %v, want ErrNoSnapshot", err)
+		}
+	})
+}
+
+func TestSaveSnapshotReplace(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+		sample := f.sample(5, 5)
+
+		//	同じ配信を時刻を変えて二度処理しても、置き換えられる。
+		for i := 0; i < 2; i++ {
+			if err := s.SaveSnapshot(f.ctx, sample, f.base.Add(time.Duration(12+i)*time.Minute), testRanking()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		eventranking, err := s.Snapshot(f.ctx, testEventid, 5, sample.Sampletm1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(eventranking) != len(testRanking()) {
+			t.Errorf("Snapshot() returned %d listener(s), want %d", len(eventranking), len(testRanking()))
+		}
+		if tslist, err := s.SnapshotTimes(f.ctx, testEventid, 5); err != nil || len(tslist) != 1 {
+			t.Errorf("SnapshotTimes() = %v, %v, want one snapshot", tslist, err)
+		}
+	})
+}
+
+func TestPreviousSnapshot(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+
+		//	後の配信を先に処理し、前の配信を遅れて処理する。
+		later, earlier := f.sample(7, 30), f.sample(7, 20)
+		ranking := testRanking()
+		if err := s.SaveSnapshot(f.ctx, later, f.base.Add(40*time.Minute), ranking); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SaveSnapshot(f.ctx, earlier, f.base.Add(41*time.Minute), ranking[:1]); err != nil {
+			t.Fatal(err)
+		}
+
+		sampletm1, eventranking, err := s.PreviousSnapshot(f.ctx, f.sample(7, 25))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sampletm1.Equal(earlier.Sampletm1) || len(eventranking) != 1 {
+			t.Errorf("PreviousSnapshot() sampletm1=%v with %d listener(s), want %v with 1", sampletm1, len(eventranking), earlier.Sampletm1)
+		}
+		if _, _, err = s.PreviousSnapshot(f.ctx, earlier); !errors.Is(err, ErrNoSnapshot) {
+			t.Errorf("PreviousSnapshot() of the first sample returned %v, want ErrNoSnapshot", err)
+		}
+		if sampletm1, _, err = s.LatestSnapshot(f.ctx, testEventid, 7); err != nil || !sampletm1.Equal(later.Sampletm1) {
+			t.Errorf("LatestSnapshot() sampletm1=%v, %v, want %v", sampletm1, err, later.Sampletm1)
+		}
+		tslist, err := s.SnapshotTimes(f.ctx, testEventid, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tslist) != 2 || !tslist[0].Equal(earlier.Sampletm1) || !tslist[1].Equal(later.Sampletm1) {
+			t.Errorf("SnapshotTimes() = %v, want [%v %v]", tslist, earlier.Sampletm1, later.Sampletm1)
+		}
+	})
+}
+
+func TestDroppedListeners(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+
+		//	二人目のリスナーは二回目の配信で貢献ランキングに載らなくなり（突き合わせの結果はPoint = -1）、三回目でまた載る。
+		ranking := testRanking()[:2]
+		if err := s.SaveSnapshot(f.ctx, f.sample(8, 50), f.base, ranking); err != nil {
+			t.Fatal(err)
+		}
+		dropped := testRanking()[:2]
+		dropped[1].Point, dropped[1].Incremental, dropped[1].Order, dropped[1].Status = -1, -1, 999, -1
+		if err := s.SaveSnapshot(f.ctx, f.sample(8, 51), f.base, dropped); err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := s.Snapshot(f.ctx, testEventid, 8, f.sample(8, 51).Sampletm1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != 1 {
+			t.Errorf("Snapshot() returned %d listener(s), want only the present one", len(stored))
+		}
+		_, previous, err := s.PreviousRanking(f.ctx, f.sample(8, 52))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(previous) != 2 || previous[1].T_LsnID != ranking[1].T_LsnID || previous[1].Point != -1 || previous[1].Listner != ranking[1].Listner {
+			t.Errorf("PreviousRanking() = %+v, want the dropped listener with Point -1", previous)
+		}
+		listeners, err := s.Listeners(f.ctx, testEventid, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listeners) != 2 || listeners[1].State != ListenerDropped || !listeners[1].Lastseen.Equal(f.sample(8, 50).Sampletm1) {
+			t.Errorf("Listeners() = %+v, want the second one dropped after sample 50", listeners)
+		}
+
+		//	名前を変えてまた載る。
+		back := testRanking()[:2]
+		back[1].Listner = "リスナー2（改名）"
+		if err = s.SaveSnapshot(f.ctx, f.sample(8, 52), f.base, back); err != nil {
+			t.Fatal(err)
+		}
+		if listeners, err = s.Listeners(f.ctx, testEventid, 8); err != nil {
+			t.Fatal(err)
+		}
+		if listeners[1].State != ListenerPresent || listeners[1].Listner != back[1].Listner || !listeners[1].Firstseen.Equal(f.sample(8, 50).Sampletm1) {
+			t.Errorf("Listeners()[1] = %+v, want present with the new name", listeners[1])
+		}
+		if maxtlsnid, err := s.MaxTLsnID(f.ctx, testEventid, 8); err != nil || maxtlsnid != ranking[1].T_LsnID {
+			t.Errorf("MaxTLsnID() = %d, %v, want %d", maxtlsnid, err, ranking[1].T_LsnID)
+		}
+	})
+}
+
+func TestAllocateTLsnIDs(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+
+		//	T_LsnIDが0のリスナー（新たに現れたもの）には、すでにあるT_LsnIDの次から振られる。
+		ranking := testRanking()
+		ranking[1].T_LsnID, ranking[2].T_LsnID = 0, 0
+		if err := s.SaveSnapshot(f.ctx, f.sample(9, 60), f.base, ranking); err != nil {
+			t.Fatal(err)
+		}
+		if ranking[1].T_LsnID != 2 || ranking[2].T_LsnID != 3 {
+			t.Errorf("SaveSnapshot() assigned %d, %d, want 2, 3", ranking[1].T_LsnID, ranking[2].T_LsnID)
+		}
+
+		//	振られたものより大きいT_LsnIDがあれば、その次から振る。
+		more := append(testRanking(), EventRank{Order: 4, Rank: 4, Listner: "リスナー4", T_LsnID: 10, Point: 50},
+			EventRank{Order: 5, Rank: 5, Listner: "リスナー5", Point: 40})
+		if err := s.SaveSnapshot(f.ctx, f.sample(9, 61), f.base, more); err != nil {
+			t.Fatal(err)
+		}
+		if more[4].T_LsnID != 11 {
+			t.Errorf("SaveSnapshot() assigned %d, want 11", more[4].T_LsnID)
+		}
+		if first, err := s.AllocateTLsnIDs(f.ctx, testEventid, 9, 3); err != nil || first != 12 {
+			t.Errorf("AllocateTLsnIDs() = %d, %v, want 12", first, err)
+		}
+		if listeners, err := s.Listeners(f.ctx, testEventid, 9); err != nil || len(listeners) != 5 {
+			t.Errorf("Listeners() returned %d listener(s), %v, want 5", len(listeners), err)
+		}
+	})
+}
+
+//	はじめてのルームでT_LsnIDを同時に振っても、エラーにならず、同じT_LsnIDが振られないこと。
+func TestAllocateTLsnIDsConcurrent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		const workers, n = 8, 5
+		ctx := context.Background()
+		firsts := make(chan int, workers)
+		errs := make(chan error, workers)
+		for i := 0; i < workers; i++ {
+			go func() {
+				first, err := s.AllocateTLsnIDs(ctx, testEventid, 20, n)
+				firsts <- first
+				errs <- err
+			}()
+		}
+
+		used := make(map[int]bool)
+		for i := 0; i < workers; i++ {
+			if err := <-errs; err != nil {
+				t.Errorf("AllocateTLsnIDs() returned %v", err)
+			}
+			first := <-firsts
+			for id := first; id < first+n; id++ {
+				if used[id] {
+					t.Errorf("T_LsnID %d was allocated twice", id)
+				}
+				used[id] = true
+			}
+		}
+		for id := 1; id <= workers*n; id++ {
+			if !used[id] {
+				t.Errorf("T_LsnID %d was not allocated", id)
+			}
+		}
+	})
+}
+
+//	SetBatchSize()を通さずに作ったStore（batchsizeが0）でも貢献ランキングを保存できること。
+func TestSaveSnapshotZeroBatchSize(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		z := *s
+		z.batchsize = 0
+		f := newFixture(t, &z)
+
+		//	一回目はリスナーを追加し（insertListeners）、二回目はlastseenを更新する（updateIn）
+		for m := 70; m < 72; m++ {
+			if err := z.SaveSnapshot(f.ctx, f.sample(21, m), f.base, testRanking()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		listeners, err := z.Listeners(f.ctx, testEventid, 21)
+		if err != nil || len(listeners) != 3 {
+			t.Fatalf("Listeners() returned %d listener(s), %v, want 3", len(listeners), err)
+		}
+		if !listeners[0].Lastseen.Equal(f.sample(21, 71).Sampletm1) {
+			t.Errorf("Listeners()[0].Lastseen = %v, want %v", listeners[0].Lastseen, f.sample(21, 71).Sampletm1)
+		}
+	})
+}
+
+func TestNoSnapshot(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+		sample := f.sample(99, 0)
+		f.insert(sample)
+
+		if _, _, err := s.LatestSnapshot(f.ctx, testEventid, 99); !errors.Is(err, ErrNoSnapshot) {
+			t.Errorf("LatestSnapshot() returned %v, want ErrNoSnapshot", err)
+		}
+		if _, err := s.MaxTLsnID(f.ctx, testEventid, 99); !errors.Is(err, ErrNoSnapshot) {
+			t.Errorf("MaxTLsnID() returned %v, want ErrNoSnapshot", err)
+		}
+		if earnedpoint, err := s.EarnedPoint(f.ctx, sample); err != nil || earnedpoint != -1 {
+			t.Errorf("EarnedPoint() = %d, %v, want -1", earnedpoint, err)
+		}
+	})
+}
+
+func TestPages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+		ts1 := f.base.Add(20 * time.Minute)
+		ts2 := f.base.Add(21 * time.Minute)
+		page := []byte("<html>test</html>")
+
+		//	同じ時刻のものは置き換える。
+		for _, ts := range []time.Time{ts2, ts1, ts1} {
+			if err := s.SavePage(f.ctx, testEventid, 6, ts, page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tslist, err := s.PageTimes(f.ctx, testEventid, 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tslist) != 2 || !tslist[0].Equal(ts1) || !tslist[1].Equal(ts2) {
+			t.Errorf("PageTimes() = %v, want [%v %v]", tslist, ts1, ts2)
+		}
+		if loaded, err := s.Page(f.ctx, testEventid, 6, ts1); err != nil || !bytes.Equal(loaded, page) {
+			t.Errorf("Page() = %q, %v, want %q", loaded, err, page)
+		}
+
+		//	ts2より前のもの（ts1）だけが削除される。
+		n, err := s.DeletePagesBefore(f.ctx, ts2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("DeletePagesBefore() deleted %d page(s), want 1", n)
+		}
+		if tslist, err = s.PageTimes(f.ctx, testEventid, 6); err != nil || len(tslist) != 1 || !tslist[0].Equal(ts2) {
+			t.Errorf("PageTimes() after purge = %v, %v, want [%v]", tslist, err, ts2)
+		}
+	})
+}
+
+func TestEarnedPoint(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+		registered, recorded := f.sample(10, 0), f.sample(10, 1)
+		if err := s.InsertSample(f.ctx, registered, 1234); err != nil {
+			t.Fatal(err)
+		}
+		f.insert(recorded)
+
+		//	登録したときに記録したものと、後から記録したもの（同じ値で二度記録してもよい）
+		for i := 0; i < 2; i++ {
+			if err := s.RecordEarnedPoint(f.ctx, recorded, 5678); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, c := range []struct {
+			sample Sample
+			want   int
+		}{{registered, 1234}, {recorded, 5678}} {
+			if earnedpoint, err := s.EarnedPoint(f.ctx, c.sample); err != nil || earnedpoint != c.want {
+				t.Errorf("EarnedPoint(%v) = %d, %v, want %d", c.sample.Sampletm1, earnedpoint, err, c.want)
+			}
+		}
+		if err := s.RecordEarnedPoint(f.ctx, f.sample(10, 2), 1); !errors.Is(err, ErrNoSample) {
+			t.Errorf("RecordEarnedPoint() of an unregistered sample returned %v, want ErrNoSample", err)
+		}
+	})
+}
+
+func TestSampleFetchedAt(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		f := newFixture(t, s)
+		done, first, second := f.sample(11, 0), f.sample(11, 10), f.sample(11, 20)
+		f.insert(done, first, second)
+		f.claim("w1")
+		if err := s.CommitSample(f.ctx, "w1", done, f.base, testRanking(), SampleResult{Sampletm2: f.base}); err != nil {
+			t.Fatal(err)
+		}
+
+		cases := []struct {
+			fetched time.Duration
+			want    Sample
+		}{
+			{5 * time.Minute, done},   //	処理済みのものしかない
+			{25 * time.Minute, first}, //	処理済みでないもっとも古いもの
+			{15 * time.Minute, first},
+		}
+		for _, c := range cases {
+			sample, err := s.SampleFetchedAt(f.ctx, testEventid, 11, f.base.Add(c.fetched))
+			if err != nil || !sameSamples([]Sample{sample}, []Sample{c.want}) {
+				t.Errorf("SampleFetchedAt(+%v) = %v, %v, want %v", c.fetched, sample.Sampletm1, err, c.want.Sampletm1)
+			}
+		}
+		if _, err := s.SampleFetchedAt(f.ctx, testEventid, 11, f.base.Add(-time.Minute)); !errors.Is(err, ErrNoSample) {
+			t.Errorf("SampleFetchedAt() before any sample returned %v, want ErrNoSample", err)
+		}
+	})
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBench(t *testing.T) {
+	store := openTestStore(t)
+	if status := Bench([]string{"-sizes", "10,20", "-batch", "1,5", "-repeat", "2"}, store); status != 0 {
+		t.Fatalf("Bench() = %d", status)
+	}
+	if store.BatchSize() != 100 {
+		t.Errorf("Bench() left batchsize %d", store.BatchSize())
+	}
+	//	確認用のイベントのデータは残さない。
+	var n int
+	if err := store.DB().QueryRowContext(context.Background(), "select count(*) from listener").Scan(&n); err != nil || n != 0 {
+		t.Errorf("%d listener(s) left after Bench(), %v", n, err)
+	}
+}
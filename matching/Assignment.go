@@ -0,0 +1,269 @@
+package matching
+
+import (
+	"fmt"
+	"math"
+
+	"ShowroomDBlib"
+)
+
+/*
+	Assignment は名前の一致度による突き合わせ（Phase 3の3A）を全体として最適になるように行う方法です。
+
+	Greedyでは前回の貢献ランキングの順にそれぞれのリスナーがもっとも一致度の高いものを選ぶので、
+	前の方のリスナーが、後の方のリスナーとよりよく一致する名前を先に取ってしまうことがあります。
+	Assignmentでは、Phase 0、Phase 1の後に残ったリスナーのすべての組について
+
+		コスト = 名前の距離 + PointWeight * ポイントの増え方の不自然さ
+
+	を求め（名前はGreedyと同じく正規化したもので比較します）、コストの合計が最小になる組み合わせ（最小コストの二部マッチング、ハンガリー法）を選びます。
+	ポイントの増え方の不自然さは今回のポイントのうち前回からの増分の割合（前回のポイントがわからないときは1）です。
+	今回のポイントが前回のポイントより少ない組、IDが異なる組は選びません。
+	コストがCutoff3A以上の組は選ばず、同一のリスナーが見つからなかったものとします（選んだ組は3Aとして記録します）
+
+	選べる組が一つもないリスナーは除いてから解くので、計算量は選べる組のあるリスナーの数（前回n人、今回m人）に対してO((n+m)^3)です。
+	残ったリスナーはGreedyと同じように3B、3C、Phase 2で突き合わせます（3Aはここで判定したので、名前の距離だけで3Aとすることはしません）
+	Logfを指定したときは、Greedyの結果と異なるものを記録します（Differences()）
+*/
+type Assignment struct {
+	Params Params                                   //	判定に使う値（指定しないものはDefaultParams()の値）
+	Logf   func(format string, args ...interface{}) //	突き合わせの経過を記録する（nilのときは記録しない）
+}
+
+// Match は貢献ランキングを突き合わせます。
+func (a *Assignment) Match(prev, curr ShowroomDBlib.EventRanking) *MatchResult {
+
+	w := newGreedy(a.Params, a.Logf, prev, curr)
+	w.phase0()
+	w.phase1()
+	w.assign()
+	w.assigned = true
+	w.logf("          Phase 2\n")
+	w.phase3()
+	w.phase2()
+	w.logf("          Phase 4\n")
+	result := w.result()
+
+	if a.Logf != nil {
+		greedy := (&Greedy{Params: a.Params}).Match(prev, curr)
+		for _, d := range Differences(greedy, result) {
+			a.Logf("***** greedy/assignment %s\n", d.Format(prev, curr))
+		}
+	}
+	return result
+}
+
+//	implausibility はポイントの増え方の不自然さ（今回のポイントのうち前回からの増分の割合、0〜1）を返します。
+func implausibility(last, new *ShowroomDBlib.EventRank) float64 {
+	if last.Point < 0 {
+		return 1.0
+	}
+	if new.Point <= 0 {
+		return 0.0
+	}
+	return float64(new.Point-last.Point) / float64(new.Point)
+}
+
+func (w *greedy) assign() {
+
+	w.logf("          Phase 3 (assignment)\n")
+
+	var rows, cols []int
+	for j := range w.last {
+		if w.last[j].Status != 1 {
+			rows = append(rows, j)
+		}
+	}
+	for i := range w.new {
+		if w.new[i].Status != 1 {
+			cols = append(cols, i)
+		}
+	}
+
+	//	組のコスト（今回のポイントが前回より少ない組、IDが異なる組、コストがCutoff3A以上の組はunassignable）
+	nd := w.distance()
+	pair := make([][]float64, len(rows))
+	dist := make([][]float64, len(rows))
+	rowok := make([]bool, len(rows))
+	colok := make([]bool, len(cols))
+	for r, j := range rows {
+		pair[r] = make([]float64, len(cols))
+		dist[r] = make([]float64, len(cols))
+		for c, i := range cols {
+			pair[r][c] = unassignable
+			last, new := &w.last[j], &w.new[i]
+			if new.Point < last.Point || DifferentListener(last, new) {
+				continue
+			}
+			dist[r][c] = nd.Distance(w.newkey[i], w.lastkey[j])
+			if v := dist[r][c] + w.params.PointWeight*implausibility(last, new); v < w.params.Cutoff3A {
+				pair[r][c] = v
+				rowok[r] = true
+				colok[c] = true
+			}
+		}
+	}
+
+	//	選べる組が一つもない行と列は、どう割り当てても「見つからない」「新しい」になるので除いてから解く。
+	//	計算量は残った行と列の数をn、mとしてO((n+m)^3)（名前の似ているリスナーが多いほど大きくなる）
+	var keeprows, keepcols []int
+	for r, ok := range rowok {
+		if ok {
+			keeprows = append(keeprows, r)
+		}
+	}
+	for c, ok := range colok {
+		if ok {
+			keepcols = append(keepcols, c)
+		}
+	}
+	if len(keeprows) == 0 {
+		return
+	}
+
+	//	keeprows、keepcolsのそれぞれに「見つからなかった」ことを表す行と列を加えた正方行列にする。
+	//		[ 組のコスト（n×m）         | 前回のリスナーが見つからない（対角がCutoff3A） ]
+	//		[ 今回のリスナーが新しい（対角が0） | 0                                   ]
+	n, m := len(keeprows), len(keepcols)
+	cost := make([][]float64, n+m)
+	for r := range cost {
+		cost[r] = make([]float64, n+m)
+		for c := range cost[r] {
+			cost[r][c] = unassignable
+		}
+	}
+	for r, kr := range keeprows {
+		for c, kc := range keepcols {
+			cost[r][c] = pair[kr][kc]
+		}
+		cost[r][m+r] = w.params.Cutoff3A
+	}
+	for c := 0; c < m; c++ {
+		cost[n+c][c] = 0
+		for r := 0; r < n; r++ {
+			cost[n+c][m+r] = 0
+		}
+	}
+
+	for r, c := range minCostAssignment(cost) {
+		if r >= n || c >= m {
+			continue
+		}
+		kr, kc := keeprows[r], keepcols[c]
+		j, i := rows[kr], cols[kc]
+		w.logf("*****         【%s】 equals to 【%s】 (cost %6.3f)\n", w.last[j].Listner+" ["+string(Method3A)+fmt.Sprintf("%6.3f", dist[kr][kc])+"]", w.new[i].Listner, cost[r][c])
+		w.match(j, i, Method3A, dist[kr][kc])
+	}
+}
+
+//	unassignable は選ばない組のコストです（コストの合計はこれより十分に小さいので、他に割り当てがあれば選ばれない）
+const unassignable = 1e9
+
+/*
+	minCostAssignment()
+	正方行列costの各行に異なる列を一つずつ割り当て、コストの合計が最小になる割り当て（行ごとの列）を返します。
+	ハンガリー法（ポテンシャルを使うO(n^3)のもの）です。
+*/
+func minCostAssignment(cost [][]float64) (assignment []int) {
+
+	n := len(cost)
+	inf := math.Inf(1)
+	u := make([]float64, n+1)
+	v := make([]float64, n+1)
+	p := make([]int, n+1) //	p[列] = 割り当てた行（1から、0は未割り当て）
+	way := make([]int, n+1)
+
+	for r := 1; r <= n; r++ {
+		p[0] = r
+		c0 := 0
+		minv := make([]float64, n+1)
+		used := make([]bool, n+1)
+		for c := range minv {
+			minv[c] = inf
+		}
+		for {
+			used[c0] = true
+			r0, delta, c1 := p[c0], inf, 0
+			for c := 1; c <= n; c++ {
+				if used[c] {
+					continue
+				}
+				if cur := cost[r0-1][c-1] - u[r0] - v[c]; cur < minv[c] {
+					minv[c] = cur
+					way[c] = c0
+				}
+				if minv[c] < delta {
+					delta = minv[c]
+					c1 = c
+				}
+			}
+			for c := 0; c <= n; c++ {
+				if used[c] {
+					u[p[c]] += delta
+					v[c] -= delta
+				} else {
+					minv[c] -= delta
+				}
+			}
+			c0 = c1
+			if p[c0] == 0 {
+				break
+			}
+		}
+		for c0 != 0 {
+			c1 := way[c0]
+			p[c0] = p[c1]
+			c0 = c1
+		}
+	}
+
+	assignment = make([]int, n)
+	for c := 1; c <= n; c++ {
+		assignment[p[c]-1] = c - 1
+	}
+	return
+}
+
+/*
+	Difference は二つの突き合わせの結果で、前回の貢献ランキングのリスナー（Prev）の判定が異なるものです。
+	A、Bはそれぞれの結果での組です（同一のリスナーが見つからなかったときはCurr = -1）
+*/
+type Difference struct {
+	Prev int
+	A    Pair
+	B    Pair
+}
+
+// Differences は二つの突き合わせの結果（同じ貢献ランキングのもの）で判定が異なるものを返します。
+func Differences(a, b *MatchResult) (differences []Difference) {
+
+	pairs := func(r *MatchResult) []Pair {
+		byprev := make([]Pair, r.nprev)
+		for j := range byprev {
+			byprev[j] = Pair{Prev: j, Curr: -1}
+		}
+		for _, p := range r.pairs {
+			byprev[p.Prev] = p
+		}
+		return byprev
+	}
+	pa, pb := pairs(a), pairs(b)
+	for j := 0; j < len(pa) && j < len(pb); j++ {
+		if pa[j].Curr != pb[j].Curr {
+			differences = append(differences, Difference{Prev: j, A: pa[j], B: pb[j]})
+		}
+	}
+	return
+}
+
+// Format は差異を "【前回の名前】 【Aでの今回の名前】 3B 0.650 / 【Bでの今回の名前】 3A 0.300" の形式で返します。
+func (d Difference) Format(prev, curr ShowroomDBlib.EventRanking) string {
+
+	f := func(p Pair) string {
+		if p.Curr < 0 {
+			return "not found"
+		}
+		return fmt.Sprintf("【%s】 %s %.3f", curr[p.Curr].Listner, p.Method, p.Distance)
+	}
+	return fmt.Sprintf("【%s】 %s / %s", prev[d.Prev].Listner, f(d.A), f(d.B))
+}
@@ -0,0 +1,290 @@
+package matching
+
+import (
+	"fmt"
+
+	lsdp "github.com/deltam/go-lsd-parametrized"
+
+	"ShowroomDBlib"
+)
+
+/*
+	Greedy は既定の突き合わせの方法です（以前のCompareEventRanking()と同じ判定をします）
+
+	Phase 0		リスナーのID（LsnID）が一致するものを同一のリスナーとする（名前が変わっていてもよい）
+	Phase 1		名前（正規化したもの）が一致し、ポイントが前回以上のものを同一のリスナーとする
+	Phase 3		名前（正規化したもの）の一致度が高いもの（3A、3B、3C）を同一のリスナーとする
+				前回の貢献ランキングの順に、それぞれのリスナーについてもっとも一致度の高いものを選ぶ
+	Phase 2		（Phase 3の後に）前回のポイント以上のリスナーが一人しかいないときは同一のリスナーとする
+	Phase 4		残ったものは新たに現れたリスナーとする（Apply()で追加する）
+
+	前回、今回の貢献ランキングはポイントの順（降順）にソートされていることを前提にしています。
+	Statusは突き合わせに使うので、引数の貢献ランキングのStatusは無視します。
+	名前の正規化はParams.Normalizeで指定します（"none"とすれば以前のCompareEventRanking()と同じ判定になります）
+*/
+type Greedy struct {
+	Params Params                                   //	判定に使う値（指定しないものはDefaultParams()の値）
+	Logf   func(format string, args ...interface{}) //	突き合わせの経過を記録する（nilのときは記録しない）
+}
+
+//	greedy は一回の突き合わせの作業領域です。last、newは引数の貢献ランキングのコピーで、判定に合わせて更新します。
+//	lastkey、newkeyはlast、newの名前を正規化したもので、名前の比較にはこちらを使います。
+//	assignedはassign()で3Aを判定したとき（Assignment）trueで、phase3()では3Aを判定しません。
+type greedy struct {
+	params  Params
+	logf    func(format string, args ...interface{})
+	last    ShowroomDBlib.EventRanking
+	new     ShowroomDBlib.EventRanking
+	lastkey []string
+	newkey  []string
+	pairs   []Pair
+
+	assigned bool
+}
+
+// Match は貢献ランキングを突き合わせます。
+func (g *Greedy) Match(prev, curr ShowroomDBlib.EventRanking) *MatchResult {
+
+	w := newGreedy(g.Params, g.Logf, prev, curr)
+	w.phase0()
+	w.phase1()
+	w.logf("          Phase 2\n")
+	w.phase3()
+	w.phase2()
+	w.logf("          Phase 4\n")
+	return w.result()
+}
+
+func newGreedy(params Params, logf func(format string, args ...interface{}), prev, curr ShowroomDBlib.EventRanking) *greedy {
+
+	w := &greedy{
+		params: params.merge(DefaultParams()),
+		logf:   logf,
+		last:   make(ShowroomDBlib.EventRanking, len(prev)),
+		new:    make(ShowroomDBlib.EventRanking, len(curr)),
+	}
+	if w.logf == nil {
+		w.logf = func(string, ...interface{}) {}
+	}
+	copy(w.last, prev)
+	copy(w.new, curr)
+	for i := range w.last {
+		w.last[i].Status = 0
+	}
+	for i := range w.new {
+		w.new[i].Status = 0
+	}
+
+	normalizer, err := NewNormalizer(w.params.Normalize)
+	if err != nil {
+		//	ParamsはValidate()で確認しているはずだが、誤っているときは正規化せずに比較する。
+		w.logf("***** %v (names are not normalized)\n", err)
+		normalizer, _ = NewNormalizer(NormalizeNone)
+	}
+	w.lastkey = make([]string, len(w.last))
+	for j := range w.last {
+		w.lastkey[j] = normalizer.Normalize(w.last[j].Listner)
+	}
+	w.newkey = make([]string, len(w.new))
+	for i := range w.new {
+		w.newkey[i] = normalizer.Normalize(w.new[i].Listner)
+	}
+	return w
+}
+
+func (w *greedy) result() *MatchResult {
+	result, err := NewMatchResult(len(w.last), len(w.new), w.pairs)
+	if err != nil {
+		//	それぞれのリスナーはStatusで一度だけ突き合わせるので、ここには来ないはず。
+		panic(err)
+	}
+	return result
+}
+
+//	match は last[j] と new[i] を同一のリスナーとします。
+func (w *greedy) match(j, i int, method Method, dist float64) {
+	w.pairs = append(w.pairs, Pair{Prev: j, Curr: i, Method: method, Distance: dist})
+	w.last[j].Point = w.new[i].Point
+	CopyListenerID(&w.last[j], &w.new[i])
+	w.new[i].Status = 1
+	w.last[j].Status = 1
+}
+
+func (w *greedy) phase0() {
+
+	w.logf("          Phase 0\n")
+	//	リスナーのID（LsnID）がわかっているときはIDが一致するものを同一のリスナーとする（名前が変わっていてもよい）
+	for j := 0; j < len(w.last); j++ {
+		if w.last[j].LsnID <= 0 {
+			continue
+		}
+		for i := 0; i < len(w.new); i++ {
+			if w.new[i].Status == 1 || w.new[i].LsnID != w.last[j].LsnID {
+				continue
+			}
+			if w.new[i].Listner != w.last[j].Listner {
+				w.logf("*****         【%s】 equals to 【%s】\n", w.last[j].Listner+" [ID]", w.new[i].Listner)
+			}
+			w.match(j, i, MethodID, 0)
+			break
+		}
+	}
+}
+
+func (w *greedy) phase1() {
+
+	w.logf("          Phase 1\n")
+	//	既存のデータとリスナー名（正規化したもの）が一致するデータがあったときは既存のデータを更新する。
+	ncol := 1
+	msg := ""
+	for j := 0; j < len(w.last); j++ {
+		if w.last[j].Status == 1 {
+			//	Phase 0 でIDが一致したもの
+			continue
+		}
+		for i := 0; i < len(w.new); i++ {
+			if w.new[i].Status == 1 {
+				continue
+			}
+			if w.newkey[i] == w.lastkey[j] && !DifferentListener(&w.last[j], &w.new[i]) {
+				if w.new[i].Point >= w.last[j].Point {
+					w.match(j, i, MethodExact, 0)
+					msg = msg + fmt.Sprintf("%3d/%3d  ", j, i)
+					if ncol == 10 {
+						w.logf("%s\n", msg)
+						ncol = 1
+						msg = ""
+					} else {
+						ncol++
+					}
+					break
+				}
+			}
+		}
+	}
+	if msg != "" {
+		w.logf("%s\n", msg)
+	}
+}
+
+func (w *greedy) phase2() {
+
+	w.logf("     vvvvv     Phase 2\n")
+
+	//	現在のポイント以上のリスナーが一人しかいないなら同一人物のはず
+Outerloop:
+	for j := 0; j < len(w.last); j++ {
+		if w.last[j].Status == 1 {
+			continue
+		}
+		noasgn := -1
+		for i := 0; i < len(w.new); i++ {
+			if w.new[i].Status == 1 {
+				//	すでに突き合わせが終わったものは対象にしない。
+				continue
+			}
+			if w.new[i].Point < 0 {
+				//	いったんランクキング表外に出たものは突き合わせの対象としない。
+				continue
+			}
+			if DifferentListener(&w.last[j], &w.new[i]) {
+				//	IDが異なるものは別のリスナー
+				continue
+			}
+			if w.new[i].Point < w.last[j].Point {
+				break
+			}
+
+			if noasgn != -1 {
+				//	現在のポイント以上のリスナーが複数人いるとき
+				//	ここで処理を完全やめてしまうのは last_eventranking がソートしてあることが前提
+				//	ソートされていないのであれば単なるbreakにすべき
+				break Outerloop
+			} else {
+				//	現在のポイント以上のはじめてのリスナー
+				noasgn = i
+			}
+		}
+		if noasgn != -1 {
+			//	現在のポイント以上のリスナーが一人しかいなかった
+			w.logf("*****         【%s】 equals to 【%s】\n", w.new[noasgn].Listner, w.last[j].Listner+" [2]")
+			w.match(j, noasgn, MethodUniqueHigher, 0)
+		}
+
+	}
+	w.logf("     ^^^^^     Phase 2\n")
+}
+
+//	distance は名前の距離（重みをつけて正規化したレーベンシュタイン距離）を求めるものを返します。
+func (w *greedy) distance() lsdp.DistanceMeasurer {
+	// weighted
+	wd := lsdp.Weights{Insert: w.params.Insert, Delete: w.params.Delete, Replace: w.params.Replace}
+	// weighted and normalized
+	return lsdp.Normalized(wd)
+}
+
+func (w *greedy) phase3() {
+
+	w.logf("          Phase 3\n")
+	//	完全に一致するものがない場合は一致度が高いものを探す。
+	nd := w.distance()
+	for j := 0; j < len(w.last); j++ {
+		if w.last[j].Status == 1 {
+			continue
+		}
+		w.logf("---------------\n")
+		first_n := 0
+		first_v := 2.0
+		second_v := 2.0
+		for i := 0; i < len(w.new); i++ {
+			if w.new[i].Status == 1 {
+				continue
+			}
+			if w.new[i].Point < w.last[j].Point {
+				break
+			}
+			if DifferentListener(&w.last[j], &w.new[i]) {
+				continue
+			}
+
+			value := nd.Distance(w.newkey[i], w.lastkey[j])
+			w.logf("%6.3f [%3d] 【%s】 [%3d] 【%s】\n", value, j, w.last[j].Listner, i, w.new[i].Listner)
+			if value < first_v {
+				second_v = first_v
+				first_v = value
+				first_n = i
+			} else if value < second_v {
+				second_v = value
+			}
+		}
+
+		phase3 := func(method Method, dist float64) {
+			w.logf("*****         【%s】 equals to 【%s】\n", w.last[j].Listner+" ["+string(method)+fmt.Sprintf("%6.3f", dist)+"]", w.new[first_n].Listner)
+			w.match(j, first_n, method, dist)
+		}
+
+		switch {
+		//	値はParams（既定値はDefaultParams()）
+		//	Assignmentでは3Aはassign()で判定した（ポイントの増え方で選ばなかった組をここで3Aとしない）
+		case !w.assigned && first_v < w.params.Cutoff3A:
+			//	一致度が高い
+			phase3(Method3A, first_v)
+		case second_v < w.params.Ceiling && second_v-first_v > w.params.Gap3B:
+			//	一致度が他に比較して高い
+			phase3(Method3B, first_v)
+		case first_v < w.params.Ceiling && second_v > w.params.Ceiling &&
+			w.last[j].Point != -1 &&
+			(j == len(w.last)-1 || w.last[j].Point != w.last[j+1].Point):
+			//	一致度のチェック対象が一つしかない
+			//	ここで last_eventranking[j].Point != last_eventranking[j+1].Point の条件が成り立たないことはありえないはずだが...
+			phase3(Method3C, first_v)
+		default:
+			//	同一と思われるデータがみつからなかった。
+			//	（Phase 2で突き合わせるときは前回のポイントがわからないものとして扱う）
+			w.last[j].Point = -1
+			w.last[j].Status = -1
+			w.logf("*****         【%s】  not found.\n", w.last[j].Listner)
+		}
+
+	}
+}
@@ -0,0 +1,231 @@
+package matching
+
+import (
+	"fmt"
+	"sort"
+
+	"ShowroomDBlib"
+)
+
+/*
+	前の配信の貢献ランキングと今回の配信の貢献ランキングの突き合わせ（同一のリスナーを探すこと）
+
+	Matcher は二つの貢献ランキングから、どのリスナーとどのリスナーが同一かを判定し、その結果（MatchResult）を返します。
+	Matcherは引数の貢献ランキングを変更しません。
+	結果から保存する貢献ランキング（増分、前回の名前を含む）を作るのは Apply() です。
+
+	これまでsrgpcのCompareEventRanking()で行っていた突き合わせは Greedy（既定の方法）としてここに移しました。
+	別の方法を試すときは、Matcherを実装してCompareEventRanking()から使うようにしてください。
+
+	1.0A00	srgpcのCompareEventRanking()からMatcher、MatchResult、Apply()、Greedyとして分離する。
+	1.0B00	判定に使う値をParams、Config（イベントごとの値を含む）で指定できるようにする。
+	1.0C00	全体として最適な組み合わせを選ぶAssignment（ハンガリー法）と、結果の差異を求めるDifferences()を追加する。
+	1.0D00	Apply()で判定の方法、前回の名前、名前の距離をEventRankのMethod、Prevname、Distanceに入れる。
+	1.0E00	Phase 1、Phase 3で名前を正規化（NFKC、全角半角、ひらがなカタカナ、絵文字と飾りの記号、空白）してから比較する（Normalizer、Params.Normalize）
+			既定で正規化するので判定が変わる。以前と同じ判定にするときはParams.Normalizeを"none"にする。
+	1.0E01	Assignmentで選べる組が一つもないリスナーを除いてから最小コストの割り当てを求める（判定は変わらない）
+	1.0E02	AssignmentではPhase 3で名前の距離だけで3Aとしない（ポイントの増え方が不自然なので選ばなかった組が3Aになっていた）
+
+*/
+
+const Version = "10E02"
+
+// Method はリスナーを同一と判定した理由です。
+type Method string
+
+const (
+	MethodID           Method = "id"            //	Phase 0	リスナーのID（LsnID）が一致する
+	MethodExact        Method = "exact"         //	Phase 1	名前（正規化したもの）が一致する
+	MethodUniqueHigher Method = "unique-higher" //	Phase 2	前回のポイント以上のリスナーが一人しかいない
+	Method3A           Method = "3A"            //	Phase 3	名前の一致度が高い
+	Method3B           Method = "3B"            //	Phase 3	名前の一致度が他と比較して高い
+	Method3C           Method = "3C"            //	Phase 3	一致度のチェックの対象が一つしかない
+	MethodNew          Method = "new"           //	Phase 4	新たに現れたリスナー
+	MethodLost         Method = "lost"          //	同一のリスナーが見つからなかった（貢献ランキングに載らなくなった）
+)
+
+// Pair は同一と判定したリスナーの組です。Prev、Currはそれぞれ前回、今回の貢献ランキングでの位置です。
+type Pair struct {
+	Prev     int
+	Curr     int
+	Method   Method
+	Distance float64 //	名前の距離（Phase 3で判定したもの、それ以外は0）
+}
+
+// Matcher は貢献ランキングを突き合わせます。prev、currを変更してはいけません。
+type Matcher interface {
+	Match(prev, curr ShowroomDBlib.EventRanking) *MatchResult
+}
+
+/*
+	MatchResult は突き合わせの結果です。作成した後は変更できません。
+
+	Pairs()		同一と判定したリスナーの組（Prevの順）
+	Lost()		前回の貢献ランキングで、同一のリスナーが見つからなかったもの（の位置）
+	New()		今回の貢献ランキングで、同一のリスナーが見つからなかったもの、つまり新たに現れたリスナー（の位置）
+*/
+type MatchResult struct {
+	nprev int
+	ncurr int
+	pairs []Pair
+	lost  []int
+	new   []int
+}
+
+/*
+	NewMatchResult()
+	nprev人、ncurr人の貢献ランキングの突き合わせの結果を作ります。
+	位置が範囲外のとき、一人のリスナーが複数の組に含まれているときはエラーを返します。
+*/
+func NewMatchResult(nprev, ncurr int, pairs []Pair) (*MatchResult, error) {
+
+	r := &MatchResult{nprev: nprev, ncurr: ncurr, pairs: make([]Pair, len(pairs))}
+	copy(r.pairs, pairs)
+	sort.Slice(r.pairs, func(i, j int) bool { return r.pairs[i].Prev < r.pairs[j].Prev })
+
+	prevused := make([]bool, nprev)
+	currused := make([]bool, ncurr)
+	for _, p := range r.pairs {
+		if p.Prev < 0 || p.Prev >= nprev || p.Curr < 0 || p.Curr >= ncurr {
+			return nil, fmt.Errorf("NewMatchResult(): pair %d/%d is out of range (%d/%d)", p.Prev, p.Curr, nprev, ncurr)
+		}
+		if prevused[p.Prev] || currused[p.Curr] {
+			return nil, fmt.Errorf("NewMatchResult(): pair %d/%d is matched twice", p.Prev, p.Curr)
+		}
+		prevused[p.Prev] = true
+		currused[p.Curr] = true
+	}
+	for j, used := range prevused {
+		if !used {
+			r.lost = append(r.lost, j)
+		}
+	}
+	for i, used := range currused {
+		if !used {
+			r.new = append(r.new, i)
+		}
+	}
+	return r, nil
+}
+
+// Pairs は同一と判定したリスナーの組をPrevの順に返します。
+func (r *MatchResult) Pairs() []Pair {
+	return append([]Pair(nil), r.pairs...)
+}
+
+// Lost は同一のリスナーが見つからなかった前回の貢献ランキングの位置を返します。
+func (r *MatchResult) Lost() []int {
+	return append([]int(nil), r.lost...)
+}
+
+// New は新たに現れたリスナーの今回の貢献ランキングの位置を返します。
+func (r *MatchResult) New() []int {
+	return append([]int(nil), r.new...)
+}
+
+// Len は前回、今回の貢献ランキングのリスナーの数を返します。
+func (r *MatchResult) Len() (nprev, ncurr int) {
+	return r.nprev, r.ncurr
+}
+
+/*
+	Apply()
+	突き合わせの結果から保存する貢献ランキングと増分の合計を作ります（prev、currは変更しません）
+
+	前回の貢献ランキングのリスナーは同じ順序のまま、
+		同一のリスナーが見つかったものは今回の順位、ポイント、増分（Status = 1）
+		見つからなかったものは Point = -1、Incremental = -1、Order = 999（Status = -1）
+	とし、その後に新たに現れたリスナーを加えます（T_LsnID = 0、保存するときにStoreが振る）
+	ソートはしません（ソートするとExcelにあるデータと整合性がとれなくなるため、ソートはExcelで行います）
+
+	前回のポイントがわからない（Point = -1）ときと、Phase 2（MethodUniqueHigher）で判定したときは増分を-1とします。
+	Phase 2は見つからなかったリスナーのポイントを-1にした後で行っていたためです。
+	判定の方法はMethod、名前が変わったときの前回の名前はPrevname、名前の距離（3A、3B、3C）はDistanceに入れます。
+	Lastnameは表示用で、名前が変わったリスナーには前回の名前と判定した理由（例えば "前の名前 [3A 0.512]"）を入れます。
+	Phase 1では正規化した名前が一致すればよいので、名前が変わっていることがあります（"前の名前 [exact]"）
+*/
+func Apply(prev, curr ShowroomDBlib.EventRanking, result *MatchResult) (eventranking ShowroomDBlib.EventRanking, totalincremental int) {
+
+	eventranking = make(ShowroomDBlib.EventRanking, len(prev), len(prev)+len(result.new))
+	copy(eventranking, prev)
+
+	for _, p := range result.pairs {
+		last := &eventranking[p.Prev]
+		new := &curr[p.Curr]
+
+		if last.Point != -1 && p.Method != MethodUniqueHigher {
+			last.Incremental = new.Point - last.Point
+			totalincremental += last.Incremental
+		} else {
+			last.Incremental = -1
+		}
+		last.Rank = new.Rank
+		last.Point = new.Point
+		last.Order = new.Order
+		CopyListenerID(last, new)
+		last.Status = 1
+		last.Method = string(p.Method)
+		last.Distance = p.Distance
+		last.Prevname = ""
+		if new.Listner != last.Listner {
+			last.Prevname = last.Listner
+		}
+
+		switch {
+		case (p.Method == MethodExact || p.Method == MethodID) && new.Listner == last.Listner:
+			last.Lastname = ""
+		case p.Method == MethodID:
+			last.Lastname = last.Listner + " [ID]"
+		case p.Method == MethodExact:
+			last.Lastname = last.Listner + " [exact]"
+		case p.Method == MethodUniqueHigher:
+			last.Lastname = last.Listner + " [2]"
+		default:
+			last.Lastname = last.Listner + " [" + string(p.Method) + fmt.Sprintf("%6.3f", p.Distance) + "]"
+		}
+		last.Listner = new.Listner
+	}
+
+	for _, j := range result.lost {
+		last := &eventranking[j]
+		last.Point = -1
+		last.Incremental = -1
+		last.Status = -1
+		last.Order = 999
+		last.Lastname = ""
+		last.Prevname = ""
+		last.Method = string(MethodLost)
+		last.Distance = 0
+	}
+
+	for _, i := range result.new {
+		new := curr[i]
+		eventranking = append(eventranking, ShowroomDBlib.EventRank{
+			Order:       new.Order,
+			Rank:        new.Rank,
+			Listner:     new.Listner,
+			LsnID:       new.LsnID,
+			Avatar:      new.Avatar,
+			T_LsnID:     0,
+			Point:       new.Point,
+			Incremental: new.Point,
+			Method:      string(MethodNew),
+		})
+		totalincremental += new.Point
+	}
+
+	return
+}
+
+//	DifferentListener はどちらのリスナーもIDがわかっていて、かつそれが異なるとき（つまり別のリスナーであることが確実なとき）trueを返します。
+func DifferentListener(last, new *ShowroomDBlib.EventRank) bool {
+	return last.LsnID > 0 && new.LsnID > 0 && last.LsnID != new.LsnID
+}
+
+//	CopyListenerID は名前で突き合わせたリスナーについて、新たに得られたIDとアバターを引き継ぎます。
+func CopyListenerID(last, new *ShowroomDBlib.EventRank) {
+	if new.LsnID > 0 {
+		last.LsnID = new.LsnID
+	}
+	last.Avatar = new.Avatar
+}
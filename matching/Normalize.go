@@ -0,0 +1,120 @@
+package matching
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/text/width"
+)
+
+/*
+	リスナーの名前の正規化
+
+	SHOWROOMのリスナーの名前には全角と半角の違い、ひらがなとカタカナの違い、絵文字や飾りの記号が多く、
+	そのまま比較すると "ﾁｮｳｯﾄ★" と "チョウット" はまったく違う名前になってしまいます。
+	突き合わせ（Phase 1の名前の一致、Phase 3の名前の距離）では、次の手順で正規化した名前を比較します。
+	保存する名前（Listner、Prevname）は正規化しません。
+
+	nfkc		Unicodeの互換分解と合成（NFKC、"①" → "1"、"㈱" → "(株)" など）
+	width		全角の英数字・記号を半角に、半角カタカナを全角にする
+	kana		ひらがなをカタカナにする
+	emoji		絵文字、飾りの記号（★、♪ など）、異体字セレクタ、ゼロ幅接合子を除く
+	space		連続する空白（全角の空白を含む）を一つの半角の空白にし、前後の空白を除く
+
+	正規化すると空になる名前（記号だけのものなど）は、正規化せずに比較します。
+*/
+
+const (
+	NormalizeNFKC  = "nfkc"
+	NormalizeWidth = "width"
+	NormalizeKana  = "kana"
+	NormalizeEmoji = "emoji"
+	NormalizeSpace = "space"
+	NormalizeNone  = "none"
+)
+
+// DefaultNormalize は既定の正規化の手順です（すべての手順をこの順に行う）
+const DefaultNormalize = "nfkc,width,kana,emoji,space"
+
+// Normalizer は名前を正規化します。
+type Normalizer struct {
+	steps []func(string) string
+}
+
+/*
+	NewNormalizer()
+	カンマ区切りの手順（"nfkc,width,kana,emoji,space" など、"none"なら正規化しない）からNormalizerを作ります。
+	手順は書かれた順に行います。
+*/
+func NewNormalizer(steps string) (n *Normalizer, err error) {
+
+	n = &Normalizer{}
+	if strings.TrimSpace(steps) == NormalizeNone {
+		return n, nil
+	}
+	for _, step := range strings.Split(steps, ",") {
+		switch strings.TrimSpace(step) {
+		case NormalizeNFKC:
+			n.steps = append(n.steps, norm.NFKC.String)
+		case NormalizeWidth:
+			n.steps = append(n.steps, width.Fold.String)
+		case NormalizeKana:
+			n.steps = append(n.steps, foldKana)
+		case NormalizeEmoji:
+			n.steps = append(n.steps, stripDecoration)
+		case NormalizeSpace:
+			n.steps = append(n.steps, collapseSpace)
+		default:
+			return nil, fmt.Errorf("unknown normalize step <%s> (%s, %s, %s, %s, %s or %s)", step,
+				NormalizeNFKC, NormalizeWidth, NormalizeKana, NormalizeEmoji, NormalizeSpace, NormalizeNone)
+		}
+	}
+	return n, nil
+}
+
+// Normalize は名前を正規化します。正規化すると空になるときは元の名前を返します。
+func (n *Normalizer) Normalize(name string) string {
+
+	normalized := name
+	for _, step := range n.steps {
+		normalized = step(normalized)
+	}
+	if normalized == "" {
+		return name
+	}
+	return normalized
+}
+
+//	foldKana はひらがな（ぁ〜ゖ、ゝ、ゞ）をカタカナにします。
+func foldKana(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'ぁ' && r <= 'ゖ') || r == 'ゝ' || r == 'ゞ' {
+			return r + ('ァ' - 'ぁ')
+		}
+		return r
+	}, s)
+}
+
+//	stripDecoration は絵文字と飾りの記号（Unicodeの記号So、Sk、囲み記号Me）、異体字セレクタ、ゼロ幅の文字を除きます。
+func stripDecoration(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.Is(unicode.So, r), unicode.Is(unicode.Sk, r), unicode.Is(unicode.Me, r):
+			return -1
+		case unicode.Is(unicode.Variation_Selector, r):
+			return -1
+		case r == '\u200b', r == '\u200c', r == '\u200d', r == '\u2060', r == '\ufeff':
+			return -1
+		case r >= '\U000e0000' && r <= '\U000e007f': //	タグ文字（旗の絵文字に使われる）
+			return -1
+		}
+		return r
+	}, s)
+}
+
+//	collapseSpace は連続する空白を一つの半角の空白にし、前後の空白を除きます。
+func collapseSpace(s string) string {
+	return strings.Join(strings.FieldsFunc(s, unicode.IsSpace), " ")
+}
@@ -0,0 +1,183 @@
+package matching
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	Params は突き合わせの判定に使う値です（Phase 3）
+
+	Mode		"greedy"（Greedy、既定の方法）または "assignment"（Assignment）
+	Cutoff3A	名前の距離がこれより小さければ同一とする（3A）
+				以前は0.72としていたが、0.6を超えて一致と判断されるものはあやしいものが多かった（2022-03-23）
+	Gap3B		二番目に近いものとの差がこれより大きければ同一とする（3B）
+	Ceiling		これ以上の距離は一致する可能性がないものとする（3B、3C）
+	Insert、Delete、Replace	名前の距離（レーベンシュタイン距離）の重み
+	PointWeight	ポイントの増え方の不自然さ（0〜1）に対する重み（Modeが"assignment"のとき）
+	Normalize	Phase 1、Phase 3で名前を比較する前に行う正規化の手順（"nfkc,width,kana,emoji,space"、"none"なら正規化しない、Normalize.go）
+
+	0の値（Modeは""）は「指定しない」ことを意味します（Config.ParamsFor()で既定値またはイベント共通の値になります）
+*/
+type Params struct {
+	Mode        string  `yaml:"mode"`
+	Cutoff3A    float64 `yaml:"cutoff3a"`
+	Gap3B       float64 `yaml:"gap3b"`
+	Ceiling     float64 `yaml:"ceiling"`
+	Insert      float64 `yaml:"insert"`
+	Delete      float64 `yaml:"delete"`
+	Replace     float64 `yaml:"replace"`
+	PointWeight float64 `yaml:"pointweight"`
+	Normalize   string  `yaml:"normalize"`
+}
+
+const (
+	ModeGreedy     = "greedy"
+	ModeAssignment = "assignment"
+)
+
+// DefaultParams はこれまでCompareEventRanking()で使っていた値（とすべての手順の正規化）を返します。
+func DefaultParams() Params {
+	return Params{Mode: ModeGreedy, Cutoff3A: 0.62, Gap3B: 0.2, Ceiling: 1.1, Insert: 0.8, Delete: 0.8, Replace: 1.0, PointWeight: 0.1,
+		Normalize: DefaultNormalize}
+}
+
+//	merge はpで指定されていない（0の）値をbaseの値にします。
+func (p Params) merge(base Params) Params {
+	if p.Mode == "" {
+		p.Mode = base.Mode
+	}
+	if p.Cutoff3A == 0 {
+		p.Cutoff3A = base.Cutoff3A
+	}
+	if p.Gap3B == 0 {
+		p.Gap3B = base.Gap3B
+	}
+	if p.Ceiling == 0 {
+		p.Ceiling = base.Ceiling
+	}
+	if p.Insert == 0 {
+		p.Insert = base.Insert
+	}
+	if p.Delete == 0 {
+		p.Delete = base.Delete
+	}
+	if p.Replace == 0 {
+		p.Replace = base.Replace
+	}
+	if p.PointWeight == 0 {
+		p.PointWeight = base.PointWeight
+	}
+	if p.Normalize == "" {
+		p.Normalize = base.Normalize
+	}
+	return p
+}
+
+/*
+	Validate()
+	値が正しいことを確認します。
+	名前の距離は0から1（正規化したもの）なので、Cutoff3AとGap3Bは1以下、Cutoff3AはCeilingより小さくなければなりません。
+*/
+func (p Params) Validate() error {
+
+	if p.Mode != ModeGreedy && p.Mode != ModeAssignment {
+		return fmt.Errorf("mode must be %s or %s (%s)", ModeGreedy, ModeAssignment, p.Mode)
+	}
+
+	for _, v := range []struct {
+		name  string
+		value float64
+	}{
+		{"cutoff3a", p.Cutoff3A}, {"gap3b", p.Gap3B}, {"ceiling", p.Ceiling},
+		{"insert", p.Insert}, {"delete", p.Delete}, {"replace", p.Replace}, {"pointweight", p.PointWeight},
+	} {
+		if !(v.value > 0) {
+			return fmt.Errorf("%s must be greater than 0 (%v)", v.name, v.value)
+		}
+	}
+	if p.Cutoff3A > 1 {
+		return fmt.Errorf("cutoff3a must be 1 or less (%v)", p.Cutoff3A)
+	}
+	if p.Gap3B > 1 {
+		return fmt.Errorf("gap3b must be 1 or less (%v)", p.Gap3B)
+	}
+	if p.Cutoff3A >= p.Ceiling {
+		return fmt.Errorf("cutoff3a (%v) must be less than ceiling (%v)", p.Cutoff3A, p.Ceiling)
+	}
+	if _, err := NewNormalizer(p.Normalize); err != nil {
+		return err
+	}
+	return nil
+}
+
+// String は値を "mode=greedy cutoff3a=0.62 gap3b=0.2 ..." の形式で返します（timetableのmatchparamsに保存するもの）
+func (p Params) String() string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	s := "mode=" + p.Mode + " cutoff3a=" + f(p.Cutoff3A) + " gap3b=" + f(p.Gap3B) + " ceiling=" + f(p.Ceiling) +
+		" insert=" + f(p.Insert) + " delete=" + f(p.Delete) + " replace=" + f(p.Replace)
+	if p.Mode == ModeAssignment {
+		s += " pointweight=" + f(p.PointWeight)
+	}
+	return s + " normalize=" + p.Normalize
+}
+
+/*
+	Config はEnvironment.ymlのmatchingの設定です。
+
+	matching:
+	  mode: greedy
+	  cutoff3a: 0.62
+	  gap3b: 0.2
+	  normalize: nfkc,width,kana,emoji,space
+	  events:
+	    eventid:
+	      cutoff3a: 0.55
+	      normalize: none
+
+	eventsにはイベントごとに変える値だけを書きます（書かなかったものはイベント共通の値になります）
+*/
+type Config struct {
+	Params `yaml:",inline"`
+	Events map[string]Params `yaml:"events"`
+}
+
+// ParamsFor はイベントの突き合わせに使う値を返します。
+func (c *Config) ParamsFor(eventid string) Params {
+	p := c.Params.merge(DefaultParams())
+	if ep, ok := c.Events[eventid]; ok {
+		p = ep.merge(p)
+	}
+	return p
+}
+
+// Validate はイベント共通の値とイベントごとの値を確認します。
+func (c *Config) Validate() error {
+
+	if err := c.ParamsFor("").Validate(); err != nil {
+		return fmt.Errorf("matching: %w", err)
+	}
+	eventids := make([]string, 0, len(c.Events))
+	for eventid := range c.Events {
+		eventids = append(eventids, eventid)
+	}
+	sort.Strings(eventids)
+	for _, eventid := range eventids {
+		if err := c.ParamsFor(eventid).Validate(); err != nil {
+			return fmt.Errorf("matching.events.%s: %w", eventid, err)
+		}
+	}
+	return nil
+}
+
+// String は設定をログに出力するためのものです。
+func (c *Config) String() string {
+	s := []string{c.ParamsFor("").String()}
+	for eventid := range c.Events {
+		s = append(s, eventid+": "+c.ParamsFor(eventid).String())
+	}
+	sort.Strings(s[1:])
+	return strings.Join(s, ", ")
+}
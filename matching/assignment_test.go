@@ -0,0 +1,166 @@
+package matching
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"ShowroomDBlib"
+)
+
+//	bruteForceAssignment はすべての割り当てを調べてコストの合計の最小値を返します。
+func bruteForceAssignment(cost [][]float64) float64 {
+
+	n := len(cost)
+	used := make([]bool, n)
+	best := math.Inf(1)
+	var search func(r int, total float64)
+	search = func(r int, total float64) {
+		if r == n {
+			best = math.Min(best, total)
+			return
+		}
+		for c := 0; c < n; c++ {
+			if !used[c] {
+				used[c] = true
+				search(r+1, total+cost[r][c])
+				used[c] = false
+			}
+		}
+	}
+	search(0, 0)
+	return best
+}
+
+//	minCostAssignment()の結果が、小さな行列で総当たりで求めた最小のコストと一致すること。
+func TestMinCostAssignment(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(1))
+	for k := 0; k < 500; k++ {
+		n := 1 + rng.Intn(6)
+		cost := make([][]float64, n)
+		for r := range cost {
+			cost[r] = make([]float64, n)
+			for c := range cost[r] {
+				switch rng.Intn(4) {
+				case 0:
+					cost[r][c] = unassignable
+				case 1:
+					cost[r][c] = float64(rng.Intn(3))
+				default:
+					cost[r][c] = rng.Float64()
+				}
+			}
+		}
+
+		assignment := minCostAssignment(cost)
+		used := make([]bool, n)
+		total := 0.0
+		for r, c := range assignment {
+			if c < 0 || c >= n || used[c] {
+				t.Fatalf("minCostAssignment(%v) = %v is not a permutation", cost, assignment)
+			}
+			used[c] = true
+			total += cost[r][c]
+		}
+		if want := bruteForceAssignment(cost); math.Abs(total-want) > 1e-6 {
+			t.Errorf("minCostAssignment(%v) = %v, total %f, want %f", cost, assignment, total, want)
+		}
+	}
+}
+
+//	Greedyでは前の方のリスナーが後の方のリスナーとよく一致する名前を先に取ってしまうが、Assignmentではそうならないこと。
+func TestAssignmentDiffersFromGreedy(t *testing.T) {
+
+	//	abcdxx - abcdeg 0.333、abcdxx - abcdyy 0.333、abcdef - abcdeg 0.167、abcdef - abcdyy 0.333
+	//	zzzz、qqqqqqqq、rrrrrrrr はどの名前とも似ていない（Assignmentでは除いてから解く）
+	prev := ranking(lr("abcdxx", 0, 100), lr("abcdef", 0, 90), lr("zzzz", 0, 50))
+	curr := ranking(lr("abcdeg", 0, 200), lr("abcdyy", 0, 150), lr("qqqqqqqq", 0, 10), lr("rrrrrrrr", 0, 5))
+	params := Params{Normalize: NormalizeNone}
+
+	curronly := func(r *MatchResult) []int {
+		matched := make([]int, 3)
+		for j := range matched {
+			matched[j] = -1
+		}
+		for _, p := range r.Pairs() {
+			matched[p.Prev] = p.Curr
+		}
+		return matched
+	}
+
+	greedy := (&Greedy{Params: params}).Match(prev, curr)
+	if got, want := curronly(greedy), []int{0, 1, -1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Greedy matched %v, want %v", got, want)
+	}
+
+	var logged []string
+	logf := func(format string, args ...interface{}) {
+		if strings.HasPrefix(format, "***** greedy/assignment") {
+			logged = append(logged, format)
+		}
+	}
+	assignment := (&Assignment{Params: params, Logf: logf}).Match(prev, curr)
+	if got, want := curronly(assignment), []int{1, 0, -1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Assignment matched %v, want %v", got, want)
+	}
+	for _, p := range assignment.Pairs() {
+		if p.Method != Method3A {
+			t.Errorf("Assignment pair %d/%d method %s, want 3A", p.Prev, p.Curr, p.Method)
+		}
+	}
+	if lost, new := assignment.Lost(), assignment.New(); !reflect.DeepEqual(lost, []int{2}) || !reflect.DeepEqual(new, []int{2, 3}) {
+		t.Errorf("Assignment lost %v, new %v, want [2], [2 3]", lost, new)
+	}
+
+	differences := Differences(greedy, assignment)
+	if len(differences) != 2 || differences[0].Prev != 0 || differences[1].Prev != 1 {
+		t.Errorf("Differences() = %+v, want listeners 0 and 1", differences)
+	}
+	if len(logged) != 2 {
+		t.Errorf("Assignment logged %d difference(s) from Greedy, want 2", len(logged))
+	}
+}
+
+//	一致する可能性のあるリスナーがいないときはAssignmentもGreedyと同じ結果になること。
+func TestAssignmentNoCandidates(t *testing.T) {
+
+	prev := ranking(lr("abcd", 0, 100))
+	curr := ranking(lr("wxyz", 0, 200), lr("wxyq", 0, 150))
+	params := Params{Normalize: NormalizeNone}
+
+	greedy := (&Greedy{Params: params}).Match(prev, curr)
+	assignment := (&Assignment{Params: params}).Match(prev, curr)
+	if d := Differences(greedy, assignment); len(d) != 0 {
+		t.Errorf("Differences() = %+v, want none", d)
+	}
+	var empty ShowroomDBlib.EventRanking
+	if r := (&Assignment{Params: params}).Match(empty, curr); len(r.Pairs()) != 0 || len(r.New()) != 2 {
+		t.Errorf("Match() with no previous ranking = %+v", r)
+	}
+}
+
+//	ポイントの増え方が不自然な組は、名前の距離がCutoff3Aより小さくてもAssignmentでは選ばないこと（Greedyは3Aとする）
+func TestAssignmentPointPenalty(t *testing.T) {
+
+	//	abcdefghij - abcdwxyzij 0.4、abcdefghij - abcdwxyzqj 0.5
+	//	前回のポイントがわからないので不自然さは1、コストは0.9と1.0でどちらもCutoff3A以上
+	prev := ranking(lr("abcdefghij", 0, -1))
+	curr := ranking(lr("abcdwxyzij", 0, 300), lr("abcdwxyzqj", 0, 200))
+	params := Params{Normalize: NormalizeNone, PointWeight: 0.5}
+
+	greedy := (&Greedy{Params: params}).Match(prev, curr)
+	if pairs := greedy.Pairs(); len(pairs) != 1 || pairs[0].Curr != 0 || pairs[0].Method != Method3A {
+		t.Errorf("Greedy matched %+v, want 0/0 3A", pairs)
+	}
+
+	assignment := (&Assignment{Params: params}).Match(prev, curr)
+	if pairs := assignment.Pairs(); len(pairs) != 0 {
+		t.Errorf("Assignment matched %+v, want none", pairs)
+	}
+	if lost, new := assignment.Lost(), assignment.New(); !reflect.DeepEqual(lost, []int{0}) || !reflect.DeepEqual(new, []int{0, 1}) {
+		t.Errorf("Assignment lost %v, new %v, want [0], [0 1]", lost, new)
+	}
+}
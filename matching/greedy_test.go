@@ -0,0 +1,299 @@
+package matching
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	lsdp "github.com/deltam/go-lsd-parametrized"
+
+	"ShowroomDBlib"
+)
+
+//	lr は貢献ランキングの一行です（Order、Rank、T_LsnIDはranking()で振る）
+func lr(name string, lsnid, point int) ShowroomDBlib.EventRank {
+	return ShowroomDBlib.EventRank{Listner: name, LsnID: lsnid, Avatar: fmt.Sprintf("a%d", lsnid), Point: point, Incremental: point}
+}
+
+//	ranking はランクの順に並べた貢献ランキングを作ります。
+func ranking(ranks ...ShowroomDBlib.EventRank) ShowroomDBlib.EventRanking {
+	eventranking := make(ShowroomDBlib.EventRanking, len(ranks))
+	for i, r := range ranks {
+		r.Order, r.Rank, r.T_LsnID = i+1, i+1, i+1
+		eventranking[i] = r
+	}
+	return eventranking
+}
+
+/*
+	baselineCompareEventRanking()
+	matchingパッケージに分離する前のsrgpcのCompareEventRanking()です（記録を除いたもの）
+	Greedy（正規化しないとき）とApply()がこれと同じ結果になることを確認するために残してあります。
+	引数の貢献ランキングを変更するので、コピーを渡してください。
+*/
+func baselineCompareEventRanking(last_eventranking, new_eventranking ShowroomDBlib.EventRanking) (ShowroomDBlib.EventRanking, int) {
+
+	totalincremental := 0
+
+	update := func(j, i int) {
+		if last_eventranking[j].Point != -1 {
+			incremental := new_eventranking[i].Point - last_eventranking[j].Point
+			totalincremental += incremental
+			last_eventranking[j].Incremental = incremental
+		} else {
+			last_eventranking[j].Incremental = -1
+		}
+		last_eventranking[j].Rank = new_eventranking[i].Rank
+		last_eventranking[j].Point = new_eventranking[i].Point
+		last_eventranking[j].Order = new_eventranking[i].Order
+		new_eventranking[i].Status = 1
+		last_eventranking[j].Status = 1
+	}
+
+	//	Phase 0
+	for j := 0; j < len(last_eventranking); j++ {
+		if last_eventranking[j].LsnID <= 0 {
+			continue
+		}
+		for i := 0; i < len(new_eventranking); i++ {
+			if new_eventranking[i].Status == 1 || new_eventranking[i].LsnID != last_eventranking[j].LsnID {
+				continue
+			}
+			update(j, i)
+			last_eventranking[j].Avatar = new_eventranking[i].Avatar
+			if new_eventranking[i].Listner == last_eventranking[j].Listner {
+				last_eventranking[j].Lastname = ""
+			} else {
+				last_eventranking[j].Lastname = last_eventranking[j].Listner + " [ID]"
+				last_eventranking[j].Listner = new_eventranking[i].Listner
+			}
+			break
+		}
+	}
+
+	//	Phase 1
+	for j := 0; j < len(last_eventranking); j++ {
+		if last_eventranking[j].Status == 1 {
+			continue
+		}
+		for i := 0; i < len(new_eventranking); i++ {
+			if new_eventranking[i].Status == 1 {
+				continue
+			}
+			if new_eventranking[i].Listner == last_eventranking[j].Listner && !DifferentListener(&last_eventranking[j], &new_eventranking[i]) {
+				if new_eventranking[i].Point >= last_eventranking[j].Point {
+					update(j, i)
+					last_eventranking[j].Lastname = ""
+					CopyListenerID(&last_eventranking[j], &new_eventranking[i])
+					break
+				}
+			}
+		}
+	}
+
+	phase2 := func() {
+	Outerloop:
+		for j := 0; j < len(last_eventranking); j++ {
+			if last_eventranking[j].Status == 1 {
+				continue
+			}
+			noasgn := -1
+			for i := 0; i < len(new_eventranking); i++ {
+				if new_eventranking[i].Status == 1 {
+					continue
+				}
+				if new_eventranking[i].Point < 0 {
+					continue
+				}
+				if DifferentListener(&last_eventranking[j], &new_eventranking[i]) {
+					continue
+				}
+				if new_eventranking[i].Point < last_eventranking[j].Point {
+					break
+				}
+				if noasgn != -1 {
+					break Outerloop
+				} else {
+					noasgn = i
+				}
+			}
+			if noasgn != -1 {
+				update(j, noasgn)
+				CopyListenerID(&last_eventranking[j], &new_eventranking[noasgn])
+				last_eventranking[j].Lastname = last_eventranking[j].Listner + " [2]"
+				last_eventranking[j].Listner = new_eventranking[noasgn].Listner
+			}
+		}
+	}
+
+	//	Phase 3
+	wd := lsdp.Weights{Insert: 0.8, Delete: 0.8, Replace: 1.0}
+	nd := lsdp.Normalized(wd)
+	for j := 0; j < len(last_eventranking); j++ {
+		if last_eventranking[j].Status == 1 {
+			continue
+		}
+		first_n := 0
+		first_v := 2.0
+		second_v := 2.0
+		for i := 0; i < len(new_eventranking); i++ {
+			if new_eventranking[i].Status == 1 {
+				continue
+			}
+			if new_eventranking[i].Point < last_eventranking[j].Point {
+				break
+			}
+			if DifferentListener(&last_eventranking[j], &new_eventranking[i]) {
+				continue
+			}
+			value := nd.Distance(new_eventranking[i].Listner, last_eventranking[j].Listner)
+			if value < first_v {
+				second_v = first_v
+				first_v = value
+				first_n = i
+			} else if value < second_v {
+				second_v = value
+			}
+		}
+
+		phase3 := func(cond string, dist float64) {
+			update(j, first_n)
+			CopyListenerID(&last_eventranking[j], &new_eventranking[first_n])
+			last_eventranking[j].Lastname = last_eventranking[j].Listner + " [" + cond + fmt.Sprintf("%6.3f", dist) + "]"
+			last_eventranking[j].Listner = new_eventranking[first_n].Listner
+		}
+
+		switch {
+		case first_v < 0.62:
+			phase3("3A", first_v)
+		case second_v < 1.1 && second_v-first_v > 0.2:
+			phase3("3B", first_v)
+		case first_v < 1.1 && second_v > 1.1 &&
+			last_eventranking[j].Point != -1 &&
+			(j == len(last_eventranking)-1 || last_eventranking[j].Point != last_eventranking[j+1].Point):
+			phase3("3C", first_v)
+		default:
+			last_eventranking[j].Point = -1
+			last_eventranking[j].Incremental = -1
+			last_eventranking[j].Status = -1
+			last_eventranking[j].Order = 999
+			last_eventranking[j].Lastname = ""
+		}
+	}
+
+	phase2()
+
+	//	Phase 4
+	for i := 0; i < len(new_eventranking); i++ {
+		if new_eventranking[i].Status != 1 {
+			last_eventranking = append(last_eventranking, ShowroomDBlib.EventRank{
+				Order:       new_eventranking[i].Order,
+				Rank:        new_eventranking[i].Rank,
+				Listner:     new_eventranking[i].Listner,
+				LsnID:       new_eventranking[i].LsnID,
+				Avatar:      new_eventranking[i].Avatar,
+				Point:       new_eventranking[i].Point,
+				Incremental: new_eventranking[i].Point,
+			})
+			totalincremental += new_eventranking[i].Point
+		}
+	}
+
+	return last_eventranking, totalincremental
+}
+
+//	baselineFields はbaselineCompareEventRanking()が作る項目だけを残します（Method、Prevname、DistanceはApply()で加えたもの）
+func baselineFields(eventranking ShowroomDBlib.EventRanking) ShowroomDBlib.EventRanking {
+	fields := make(ShowroomDBlib.EventRanking, len(eventranking))
+	for i, evr := range eventranking {
+		evr.Method, evr.Prevname, evr.Distance = "", "", 0
+		fields[i] = evr
+	}
+	return fields
+}
+
+//	Greedy（正規化しないとき）とApply()の結果が、分離する前のCompareEventRanking()と同じになること。
+func TestGreedyBaseline(t *testing.T) {
+	cases := []struct {
+		name    string
+		prev    ShowroomDBlib.EventRanking
+		curr    ShowroomDBlib.EventRanking
+		methods []Method //	Apply()の結果の行ごとの判定の方法
+	}{
+		{"exact",
+			ranking(lr("alice", 0, 300), lr("bob", 0, 200)),
+			ranking(lr("alice", 0, 350), lr("bob", 0, 250)),
+			[]Method{MethodExact, MethodExact}},
+		{"exact and new",
+			ranking(lr("alice", 0, 300)),
+			ranking(lr("carol", 0, 500), lr("alice", 0, 400)),
+			[]Method{MethodExact, MethodNew}},
+		{"id",
+			ranking(lr("alice", 11, 300)),
+			ranking(lr("zzzzzzzz", 11, 400)),
+			[]Method{MethodID}},
+		{"same name, different id",
+			ranking(lr("alice", 11, 300)),
+			ranking(lr("alice", 12, 400)),
+			[]Method{MethodLost, MethodNew}},
+		{"point unknown",
+			ranking(lr("alice", 0, 300), lr("bob", 0, -1)),
+			ranking(lr("alice", 0, 400), lr("bob", 0, 50)),
+			[]Method{MethodExact, MethodExact}},
+		{"unique-higher",
+			//	ポイントが減ったので名前が一致しても同一としない（Phase 1、Phase 3）が、残ったリスナーが一人だけなのでPhase 2で同一とする
+			ranking(lr("alice", 0, 300)),
+			ranking(lr("alice", 0, 200)),
+			[]Method{MethodUniqueHigher}},
+		{"3A",
+			ranking(lr("alice", 0, 300)),
+			ranking(lr("alicf", 0, 400)),
+			[]Method{Method3A}},
+		{"3B",
+			//	abcd - axyz 0.75、abcd - wxyz 1.0
+			ranking(lr("abcd", 0, 100)),
+			ranking(lr("wxyz", 0, 500), lr("axyz", 0, 400)),
+			[]Method{Method3B, MethodNew}},
+		{"3C",
+			ranking(lr("abcd", 0, 100)),
+			ranking(lr("wxyz", 0, 200)),
+			[]Method{Method3C}},
+		{"new and lost",
+			//	どちらも距離は1.0で、どちらとも決められない
+			ranking(lr("abcd", 0, 100)),
+			ranking(lr("wxyz", 0, 200), lr("wxyq", 0, 150)),
+			[]Method{MethodLost, MethodNew, MethodNew}},
+		{"lower point is not a candidate",
+			//	ポイントが前回より少ないものはPhase 3の対象にならず、Phase 2では残ったリスナーが二人いるので決められない
+			ranking(lr("alice", 0, 300), lr("bob", 0, 200)),
+			ranking(lr("alice", 0, 350), lr("bobb", 0, 100), lr("dave", 0, 50)),
+			[]Method{MethodExact, MethodLost, MethodNew, MethodNew}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			prev := append(ShowroomDBlib.EventRanking(nil), c.prev...)
+			curr := append(ShowroomDBlib.EventRanking(nil), c.curr...)
+
+			result := (&Greedy{Params: Params{Normalize: NormalizeNone}}).Match(prev, curr)
+			got, gotinc := Apply(prev, curr, result)
+			if !reflect.DeepEqual(prev, c.prev) || !reflect.DeepEqual(curr, c.curr) {
+				t.Errorf("Match() or Apply() modified the rankings")
+			}
+
+			want, wantinc := baselineCompareEventRanking(
+				append(ShowroomDBlib.EventRanking(nil), c.prev...),
+				append(ShowroomDBlib.EventRanking(nil), c.curr...))
+			if !reflect.DeepEqual(baselineFields(got), want) || gotinc != wantinc {
+				t.Errorf("Apply() = %+v (%d)\nbaseline  %+v (%d)", baselineFields(got), gotinc, want, wantinc)
+			}
+
+			methods := make([]Method, len(got))
+			for k, evr := range got {
+				methods[k] = Method(evr.Method)
+			}
+			if !reflect.DeepEqual(methods, c.methods) {
+				t.Errorf("methods = %v, want %v", methods, c.methods)
+			}
+		})
+	}
+}
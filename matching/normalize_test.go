@@ -0,0 +1,64 @@
+package matching
+
+import (
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		steps string
+		name  string
+		want  string
+	}{
+		{DefaultNormalize, "ﾁｮｳｯﾄ★", "チョウット"},
+		{DefaultNormalize, "ちょうっと", "チョウット"},
+		{DefaultNormalize, " Ｃｈｏｕｅｔｔｅ　　２１００ ", "Chouette 2100"},
+		{NormalizeNFKC, "①㈱ｶﾞ", "1(株)ガ"},
+		{NormalizeWidth, "ＡＢＣ１２３ﾁｮｳ", "ABC123チョウ"},
+		{NormalizeKana, "ちょうっと", "チョウット"},
+		{NormalizeEmoji, "なな🍓★♪👍🏻‍", "なな"},
+		{NormalizeSpace, "  a　　b  ", "a b"},
+		{NormalizeNone, "ﾁｮｳｯﾄ★", "ﾁｮｳｯﾄ★"},
+		//	正規化すると空になる名前は正規化しない
+		{DefaultNormalize, "★♪", "★♪"},
+		{NormalizeSpace, "　", "　"},
+	}
+	for _, c := range cases {
+		n, err := NewNormalizer(c.steps)
+		if err != nil {
+			t.Fatalf("NewNormalizer(%q) returned %v", c.steps, err)
+		}
+		if got := n.Normalize(c.name); got != c.want {
+			t.Errorf("NewNormalizer(%q).Normalize(%q) = %q, want %q", c.steps, c.name, got, c.want)
+		}
+	}
+
+	if _, err := NewNormalizer("nfkc,romaji"); err == nil {
+		t.Errorf("NewNormalizer() accepted an unknown step")
+	}
+}
+
+//	正規化した名前が一致すればPhase 1で同一とし、保存する名前は正規化しないこと。
+func TestGreedyNormalize(t *testing.T) {
+
+	prev := ranking(lr("ﾁｮｳｯﾄ★", 0, 100))
+	curr := ranking(lr("べつのひと", 0, 300), lr("チョウット", 0, 200))
+
+	result := (&Greedy{}).Match(prev, curr)
+	pairs := result.Pairs()
+	if len(pairs) != 1 || pairs[0].Curr != 1 || pairs[0].Method != MethodExact {
+		t.Fatalf("Match() = %+v, want 0/1 exact", pairs)
+	}
+	eventranking, _ := Apply(prev, curr, result)
+	if evr := eventranking[0]; evr.Listner != "チョウット" || evr.Prevname != "ﾁｮｳｯﾄ★" || evr.Lastname != "ﾁｮｳｯﾄ★ [exact]" {
+		t.Errorf("Apply() = %+v, want the raw names", evr)
+	}
+
+	//	normalize: none ならこれまでと同じく別のリスナーになる
+	result = (&Greedy{Params: Params{Normalize: NormalizeNone}}).Match(prev, curr)
+	for _, p := range result.Pairs() {
+		if p.Method == MethodExact {
+			t.Errorf("Match() with normalize none = %+v, want no exact match", p)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package matching
+
+import (
+	"strings"
+	"testing"
+)
+
+//	イベントごとの値は書いたものだけが変わり、残りはイベント共通の値（さらに既定値）になること。
+func TestConfigParamsFor(t *testing.T) {
+
+	c := &Config{
+		Params: Params{Mode: ModeAssignment, Gap3B: 0.3},
+		Events: map[string]Params{
+			"event1": {Cutoff3A: 0.55},
+		},
+	}
+
+	want := DefaultParams()
+	want.Mode = ModeAssignment
+	want.Gap3B = 0.3
+	if got := c.ParamsFor("other"); got != want {
+		t.Errorf("ParamsFor(other) = %+v, want %+v", got, want)
+	}
+
+	want.Cutoff3A = 0.55
+	if got := c.ParamsFor("event1"); got != want {
+		t.Errorf("ParamsFor(event1) = %+v, want %+v", got, want)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
+
+func TestParamsValidate(t *testing.T) {
+
+	with := func(f func(p *Params)) Params {
+		p := DefaultParams()
+		f(&p)
+		return p
+	}
+	cases := []struct {
+		name   string
+		params Params
+		want   string //	エラーのメッセージに含まれる文字列（エラーにならないときは""）
+	}{
+		{"default", DefaultParams(), ""},
+		{"assignment", with(func(p *Params) { p.Mode = ModeAssignment }), ""},
+		{"unknown mode", with(func(p *Params) { p.Mode = "hungarian" }), "mode"},
+		{"cutoff3a equals ceiling", with(func(p *Params) { p.Cutoff3A, p.Ceiling = 0.8, 0.8 }), "ceiling"},
+		{"cutoff3a above ceiling", with(func(p *Params) { p.Cutoff3A, p.Ceiling = 0.9, 0.8 }), "ceiling"},
+		{"cutoff3a above 1", with(func(p *Params) { p.Cutoff3A = 1.05 }), "cutoff3a"},
+		{"gap3b above 1", with(func(p *Params) { p.Gap3B = 1.5 }), "gap3b"},
+		{"negative insert", with(func(p *Params) { p.Insert = -0.8 }), "insert"},
+		{"negative replace", with(func(p *Params) { p.Replace = -1 }), "replace"},
+		{"negative pointweight", with(func(p *Params) { p.PointWeight = -0.1 }), "pointweight"},
+		{"normalize none", with(func(p *Params) { p.Normalize = NormalizeNone }), ""},
+		{"bad normalize step", with(func(p *Params) { p.Normalize = "nfkc,romaji" }), "romaji"},
+	}
+	for _, c := range cases {
+		err := c.params.Validate()
+		switch {
+		case c.want == "" && err != nil:
+			t.Errorf("%s: Validate() = %v, want nil", c.name, err)
+		case c.want != "" && err == nil:
+			t.Errorf("%s: Validate() = nil, want an error about %s", c.name, c.want)
+		case c.want != "" && !strings.Contains(err.Error(), c.want):
+			t.Errorf("%s: Validate() = %v, want an error about %s", c.name, err, c.want)
+		}
+	}
+}
+
+//	イベントごとの値が正しくないときは、そのイベントIDを示すエラーになること。
+func TestConfigValidateEvent(t *testing.T) {
+
+	c := &Config{
+		Events: map[string]Params{
+			"event1": {Cutoff3A: 0.5},
+			"event2": {Cutoff3A: 0.9, Ceiling: 0.8},
+		},
+	}
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "matching.events.event2") {
+		t.Errorf("Validate() = %v, want an error for event2", err)
+	}
+
+	c = &Config{Params: Params{Normalize: "nfkc,romaji"}}
+	if err = c.Validate(); err == nil || !strings.HasPrefix(err.Error(), "matching:") {
+		t.Errorf("Validate() = %v, want an error for the common params", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//	statusServer はリクエストごとにstatus(n)（nは1からのリクエストの番号）を返すサーバーを立てます。
+//	200のときはtestPageを返します。
+func statusServer(t *testing.T, status func(n int32, h http.Header) int) (*httptest.Server, *int32) {
+	t.Helper()
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		code := status(atomic.AddInt32(&hits, 1), rw.Header())
+		rw.WriteHeader(code)
+		if code == http.StatusOK {
+			rw.Write(testPage)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+//	5xxのときはMaxAttempts回まで取得を繰り返し、取得できればそのページを返すこと。
+func TestWebRankingSourceRetry(t *testing.T) {
+
+	server, hits := statusServer(t, func(n int32, h http.Header) int {
+		return http.StatusServiceUnavailable
+	})
+	w := &WebRankingSource{BaseURL: server.URL, MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	_, err := w.ReadRankingPage(context.Background(), "test", "1")
+	var ferr *FetchError
+	if !errors.As(err, &ferr) || ferr.Attempts != 3 || ferr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("ReadRankingPage() err = %#v, want FetchError after 3 attempts with status 503", err)
+	}
+	if n := atomic.LoadInt32(hits); n != 3 {
+		t.Errorf("server got %d request(s), want 3", n)
+	}
+
+	server, hits = statusServer(t, func(n int32, h http.Header) int {
+		if n < 3 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+	w.BaseURL = server.URL
+	page, err := w.ReadRankingPage(context.Background(), "test", "1")
+	if err != nil || string(page) != string(testPage) {
+		t.Fatalf("ReadRankingPage() = %d byte(s), %v, want testPage", len(page), err)
+	}
+	if n := atomic.LoadInt32(hits); n != 3 {
+		t.Errorf("server got %d request(s), want 3", n)
+	}
+}
+
+//	404はリトライしないこと。
+func TestWebRankingSourceNotFound(t *testing.T) {
+
+	server, hits := statusServer(t, func(n int32, h http.Header) int {
+		return http.StatusNotFound
+	})
+	w := &WebRankingSource{BaseURL: server.URL, MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	_, err := w.ReadRankingPage(context.Background(), "test", "1")
+	var ferr *FetchError
+	if !errors.As(err, &ferr) || ferr.Attempts != 1 || ferr.StatusCode != http.StatusNotFound {
+		t.Fatalf("ReadRankingPage() err = %#v, want FetchError after 1 attempt with status 404", err)
+	}
+	if n := atomic.LoadInt32(hits); n != 1 {
+		t.Errorf("server got %d request(s), want 1", n)
+	}
+}
+
+//	429のときはRetry-Afterで指示された時間（MaxBackoffで頭打ち）だけ待ってからリトライすること。
+func TestWebRankingSourceRetryAfter(t *testing.T) {
+
+	server, _ := statusServer(t, func(n int32, h http.Header) int {
+		if n == 1 {
+			h.Set("Retry-After", "1")
+			return http.StatusTooManyRequests
+		}
+		return http.StatusOK
+	})
+	w := &WebRankingSource{BaseURL: server.URL, MaxAttempts: 2, Backoff: time.Millisecond, MaxBackoff: 10 * time.Second}
+	start := time.Now()
+	if _, err := w.ReadRankingPage(context.Background(), "test", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("ReadRankingPage() retried after %v, want Retry-After 1s", elapsed)
+	}
+
+	w.MaxBackoff = 10 * time.Millisecond
+	server, _ = statusServer(t, func(n int32, h http.Header) int {
+		if n == 1 {
+			h.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+			return http.StatusTooManyRequests
+		}
+		return http.StatusOK
+	})
+	w.BaseURL = server.URL
+	start = time.Now()
+	if _, err := w.ReadRankingPage(context.Background(), "test", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ReadRankingPage() retried after %v, want MaxBackoff", elapsed)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"0", 0},
+		{"-5", 0},
+		{"soon", 0},
+		{"Wed, 01 May 2024 12:00:30 GMT", 30 * time.Second},
+		{"Wed, 01 May 2024 11:59:00 GMT", 0},
+	}
+	for _, c := range cases {
+		if got := retryAfter(c.value, now); got != c.want {
+			t.Errorf("retryAfter(%q) = %v, want %v", c.value, got, c.want)
+		}
+	}
+}
+
+//	リトライを待っている間にキャンセルされたときは待たずにそのエラーを返すこと。
+func TestWebRankingSourceCancel(t *testing.T) {
+
+	server, hits := statusServer(t, func(n int32, h http.Header) int {
+		h.Set("Retry-After", "60")
+		return http.StatusServiceUnavailable
+	})
+	w := &WebRankingSource{BaseURL: server.URL, MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Minute}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := w.ReadRankingPage(ctx, "test", "1")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ReadRankingPage() err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ReadRankingPage() returned after %v, want it to stop waiting", elapsed)
+	}
+	if n := atomic.LoadInt32(hits); n != 1 {
+		t.Errorf("server got %d request(s), want 1", n)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"ShowroomDBlib"
+	"matching"
+)
+
+func sameNameRanking() ShowroomDBlib.EventRanking {
+	return ShowroomDBlib.EventRanking{
+		{Order: 1, Rank: 1, Listner: "同じ名前", T_LsnID: 1, Point: 300, Incremental: 100, Lastname: "前の名前"},
+		{Order: 2, Rank: 2, Listner: "同じ名前", T_LsnID: 2, Point: 200, Incremental: 50},
+		{Order: 3, Rank: 3, Listner: "別の名前", T_LsnID: 3, Point: 100, Incremental: 10},
+	}
+}
+
+//	同じ名前のリスナーは一人にまとめずに、それぞれ比較すること。
+func TestDiffEventRankingSameName(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStore(t)
+	sample := ShowroomDBlib.Sample{Eventid: "test", Userid: 1, Sampletm1: time.Now().Add(-time.Hour).Truncate(time.Second)}
+	if err := store.SaveSnapshot(ctx, sample, sample.Sampletm1, sameNameRanking()); err != nil {
+		t.Fatal(err)
+	}
+	storedts := []time.Time{sample.Sampletm1}
+
+	if ndiff := DiffEventRanking(ctx, store, "test", 1, sample.Sampletm1, storedts, sameNameRanking()); ndiff != 0 {
+		t.Errorf("DiffEventRanking() of the same ranking = %d, want 0", ndiff)
+	}
+
+	replayed := sameNameRanking()
+	replayed[1].Incremental = 60
+	if ndiff := DiffEventRanking(ctx, store, "test", 1, sample.Sampletm1, storedts, replayed); ndiff != 1 {
+		t.Errorf("DiffEventRanking() with the second listener changed = %d, want 1", ndiff)
+	}
+}
+
+//	差異があったときは0以外を返すこと。
+func TestReplayStatus(t *testing.T) {
+	ctx := context.Background()
+	environment := &Environment{}
+	matcher := NewMatcher(environment.Matching.ParamsFor("test"))
+	sample := ShowroomDBlib.Sample{Eventid: "test", Userid: 1, Sampletm1: time.Now().Add(-time.Hour).Truncate(time.Second)}
+	page := ShowroomDBlib.EventRanking{
+		{Order: 1, Rank: 1, Listner: "リスナー1", Point: 300},
+		{Order: 2, Rank: 2, Listner: "リスナー2", Point: 200},
+	}
+
+	cases := []struct {
+		name   string
+		change func(ShowroomDBlib.EventRanking)
+		want   int
+	}{
+		{"same", func(ShowroomDBlib.EventRanking) {}, 0},
+		{"different", func(e ShowroomDBlib.EventRanking) { e[1].Lastname = "前の名前" }, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store := openTestStore(t)
+			stored, _ := CompareEventRanking(matcher, ShowroomDBlib.EventRanking{}, page)
+			c.change(stored)
+			if err := store.SaveSnapshot(ctx, sample, sample.Sampletm1, stored); err != nil {
+				t.Fatal(err)
+			}
+			args := []string{"-source", "eventrank", "-out", "diff", "-mode", matching.ModeGreedy, "test", "1"}
+			if status := Replay(args, environment, store, nil); status != c.want {
+				t.Errorf("Replay() = %d, want %d", status, c.want)
+			}
+		})
+	}
+}
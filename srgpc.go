@@ -13,7 +13,10 @@
 
 	使い方
 
-		% 実行モジュール名 FilenameOfConfigurationFile
+		% 実行モジュール名
+		% 実行モジュール名 replay [-source archive|eventrank] [-out diff|scratch|compare] [-mode greedy|assignment] eventid roomid
+
+		設定はServerConfig.yml（DB）とEnvironment.yml（その他、EnvironmentTmp.ymlを参照）から読み込みます。
 
 	課題
 		このプログラムは以前データをファイルから取得し結果をExcelファイルに書き出していたため、現在でもそのときの名残があります。
@@ -22,24 +25,33 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
+	"math"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/360EntSecGroup-Skylar/excelize"
 	"github.com/PuerkitoBio/goquery"
-	lsdp "github.com/deltam/go-lsd-parametrized"
 
 	"github.com/Chouette2100/exsrapi"
 
 	"ShowroomDBlib"
+	"matching"
 )
 
 /*
@@ -63,13 +75,96 @@ import (
 2.0C00		実行を指定した時間で打ち切るようにする。さくらインターネットのレンタルサーバでデーモンとみなされないための設定。
 020AD00	WaitNextMinute()を取り込みShowroomlibをimportしない。
 2.4.0		Githubにリリースする。
+2.5.0		貢献ランキングのページの取得元をRankingSourceとして差し替えられるようにする（SHOWROOMのサイトまたはHTMLファイル）
+2.6.0		貢献ランキングのページの取得にタイムアウトとリトライを設定する。GetPointsCont()はstatusではなくerrorを返す。
+			SIGINT、SIGTERMを受けたら取得中の処理を中断して終了する。
+2.7.0		貢献ランキングのページの構造を検証し、想定と違うとき（レイアウトの変更）は空のランキングとして扱わず
+			timetableを処理済みにしない。
+2.8.0		貢献ランキングが取得できなかったときはeventrankに保存せず、timetableをリトライ待ちにする。
+			規定の回数失敗したら保留にする。
+2.9.0		取得した貢献ランキングのページを（圧縮して）ディレクトリまたはDBに保存できるようにする。
+2.10.0		保存したページまたはeventrankのデータから突き合わせを再実行するサブコマンド replay を追加する。
+2.11.0		貢献ランキングのページからリスナーのID（プロフィールへのリンク）とアバターを取得して保存し、
+			IDがわかっているときはIDで突き合わせを行う（Phase 0）。IDが異なるもの同士は名前で突き合わせない。
+2.12.0		貢献ランキングのポイントの合計とページに表示されているルームのポイントをtimetableに保存し、
+			監視プロセスが記録したポイントと大きく異なるときはそのことを記録する。
+2.13.0		timetableの処理を複数のワーカーで並行して行う（同じルームのものは順に処理する）
+			SHOWROOMへのアクセスの間隔をすべてのワーカーで共通に制限する。
+2.14.0		timetableの行を確保（リース）してから処理する。複数のプロセスを同時に動かしても同じ配信を二度処理しない。
+2.15.0		データベースへのアクセスをShowroomDBlib.Storeで行う（エラーはstatusではなくerrorで扱う）
+2.16.0		貢献ランキングの保存とtimetableの更新を一つのトランザクションで行う。
+2.17.0		データベースのスキーマを作成、更新する migrate サブコマンドを追加する。起動時にスキーマの版を確認する。
+2.18.0		SQLiteを使えるようにする（ServerConfig.ymlで Dbdriver: sqlite、Dbpath を指定する）
+			データベースの読み書きを確認する storetest サブコマンドを追加する。
+2.19.0		PostgreSQLを使えるようにする（ServerConfig.ymlで Dbdriver: postgres を指定する）
+2.20.0		データベースの接続の設定（ポート、ソケット、TLS、タイムゾーン、接続数、タイムアウト）を指定できるようにする。
+			起動時にデータベースに接続できることを確認する。
+2.21.0		eventrankと保存するページをtimetableのsampletm1をキーにして保存する。取得した時刻はeventrankのfetchtmに保存する。
+			突き合わせの相手はその配信の前の配信の貢献ランキングとする（遅れて処理した配信も正しい順序で突き合わせる）
+2.22.0		貢献ランキングを複数行のinsertでまとめて保存する。保存する時間を計測する bench サブコマンドを追加する。
+2.23.0		貢献ランキングに載らなくなったリスナーをeventrankに保存し続けるのをやめ、listenerテーブルで管理する。
+2.24.0		新たに現れたリスナーのT_LsnIDを Order + idx*1000 とするのをやめ、保存するときにルームごとに1から順に振る。
+			これまでのT_LsnIDはmigrateで振りなおす（対応はtlsnid_mapテーブルに残す）
+2.25.0		リスナーの突き合わせをmatchingパッケージ（Matcher、MatchResult、Apply()）に分離する。判定は変えない。
+			CompareEventRanking()は引数の貢献ランキングを変更しないようにする。
+2.26.0		突き合わせの判定に使う値（3Aの閾値、3Bの差、上限、名前の距離の重み）をEnvironment.ymlのmatchingで指定できるようにする。
+			イベントごとに変えることもできる。起動時に値を確認し、判定に使った値はtimetableのmatchparamsに記録する。
+2.27.0		突き合わせの方法として全体として最適な組み合わせを選ぶもの（matchingのmode: assignment）を追加する。
+			replay に -out compare（greedyとassignmentの判定の差異の出力）と -mode を追加する。
+2.28.0		突き合わせの結果（前回の名前、判定の方法、名前の距離）をeventrankのprevname、method、distanceに保存する。
+			これまでのものはmigrateでlastnameから求める。
+2.29.0		突き合わせ（Phase 1、Phase 3）では名前を正規化（NFKC、全角半角、ひらがなカタカナ、絵文字と飾りの記号、空白）してから比較する。
+			手順はmatchingのnormalizeで指定する（noneとすればこれまでと同じ判定になる）保存する名前は正規化しない。
+			【判定の変更】正規化は既定で行うので、更新するとこれまでと判定が変わることがある
+			（全角半角、ひらがなカタカナ、絵文字だけが異なる名前は3A〜3Cや新しいリスナーではなくexactになる）
+			これまでと同じ判定にするときはEnvironment.ymlのmatchingで normalize: none とする（RELEASE_NOTES.mdを参照）
+2.29.1		storetest サブコマンドを削除する（ShowroomDBlibのテストとして go test で実行する）
+2.29.2		監視プロセスがearnedpointを記録するための関数をShowroomDBlibに追加する（これまで比較が行われていなかった）
+2.29.3		replay は差異があったときは終了コード1、エラーのときは2で終了する。
+			差異を調べるときは同じ名前のリスナーを名前と何番目かの組で区別する（これまでは一人にまとめられていた）
+2.29.4		migrate が失敗したときは終了コード2で終了する。
+2.29.5		bench が失敗したときは終了コード2で終了する（SQLiteでの計測はShowroomDBlibのBenchmarkSaveSnapshotで行う）
+2.29.6		bench で計測する前に一度保存しておく（最初のbatchの計測にだけlistenerテーブルへの追加の時間が含まれていた）
+2.29.7		使い方の表示に replay の -out compare と -mode を加える。
+			matchingのmode: assignmentでは一致する可能性のないリスナーを除いてから最適な組み合わせを求める（判定は変わらない）
+2.29.8		スキーマが古い（または新しい）ために処理をしないときは終了コード2で終了する。
+2.29.9		データベースの設定が正しくない、または接続できないときは終了コード2で終了する。
+2.29.10		貢献ランキングの表に見出しの行しかないときはページの構造が変わったとせず、空のランキングとする。
+2.29.11		Retry-AfterがHTTPの日付で指定されたときもその時刻まで待つ（MaxBackoffで頭打ち）
+2.29.12		timetableのearnedpointが0のときも比較する（これまではearnedpointがないときと同じく比較していなかった）
 
 */
 
-const version = "002004000"
+const version = "002029012"
 
 type Environment struct {
-	IntervalHour int
+	IntervalHour  int
+	RankingSource string //	貢献ランキングのページの取得元 "web"（デフォルト）または "fixture"
+	FixtureDir    string //	RankingSourceが"fixture"のときのHTMLファイルのあるディレクトリ
+
+	//	貢献ランキングのページを取得するときの設定（RankingSourceが"web"のとき）
+	HttpTimeout     int    //	タイムアウト（秒）
+	HttpMaxAttempts int    //	通信エラー、5xx、429のときの最大試行回数
+	HttpBackoff     int    //	一回目のリトライまでの待ち時間（ミリ秒）
+	HttpMaxBackoff  int    //	リトライまでの待ち時間の上限（ミリ秒）
+	UserAgent       string //	リクエストに設定するUser-Agent
+
+	//	貢献ランキングが取得できなかったときのtimetableの扱い
+	SampleMaxAttempts   int //	この回数失敗したら保留にする
+	SampleRetryInterval int //	一回目のリトライまでの間隔（分、以後失敗の回数に比例して延ばす）
+
+	//	取得した貢献ランキングのページの保存
+	ArchivePages     string //	"dir"、"db"または""（保存しない）
+	ArchiveDir       string //	ArchivePagesが"dir"のときの保存先
+	ArchiveRetention int    //	保存期間（日）、0なら削除しない
+
+	PointTolerance int //	貢献ランキングのポイントの合計と監視プロセスが記録したポイントの差の許容範囲（%）
+
+	Workers       int //	timetableを処理するワーカーの数（異なるルームのものを並行して処理する）
+	FetchInterval int //	SHOWROOMへのアクセスの最小間隔（ミリ秒、すべてのワーカーで共通、負の値なら制限しない）
+	LeaseTime     int //	timetableの行を確保しておく期間（秒、処理している間は延長する）
+
+	Matching matching.Config //	リスナーの突き合わせの判定に使う値（イベントごとに変えることもできる）
 }
 
 
@@ -79,18 +174,26 @@ type Environment struct {
 	イベントページのURLと配信者さんのIDから、イベント貢献ランキングのリストを取得します。
 
 	引数
+	ctx		context.Context
+	rankingsource	RankingSource	貢献ランキングのページの取得元
+	pagearchive	PageArchive	取得したページの保存先（nilなら保存しない）
 	EvnetName	string	イベント名、下記イベントページURLの"event_id"の部分
 		https://www.showroom-live.com/event/event_id
 	ID_Account	string	配信者さんのID
 		SHOWROOMへの登録順を示すと思われる6桁(以下)の数字です。アカウントとは違います。
+	sampletm	time.Time	サンプリングの時刻（timetableのsampletm1、ページを保存するときのキーになります）
 
 	戻り値
-	TotaScore	int
+	TotaScore	int		リスナーの貢献ポイントの合計（貢献ランキングに載っている範囲）
+	DisplayedPoint	int		ページに表示されているルームのポイント（表示されていないときは-1）
 	eventranking	struct
 		Rank	int		リスナーの順位
 		Point	int		リスナーの貢献ポイント
 		Listner string	リスナーの名前
-	status		int
+		LsnID	int		リスナーのID（プロフィールへのリンクから得られたとき、得られなければ0）
+		Avatar	string	リスナーのアバターのURL（得られたとき）
+	err		error	ページが取得できなかったときは RankingSource が返したエラー（WebRankingSourceなら*FetchError）
+				ページの構造が想定と違うときは*LayoutChangedError（ParseRankingPage()を参照）
 
 	***
 	リスナーさんの日々のあるいは配信ごとの貢献ポイントの推移がすぐにわかれば配信者さんもいろいろ手の打ちよう(?)が
@@ -110,33 +213,107 @@ type Environment struct {
 	なお、原因アカウントの特定、というのは犯人探しというような意味で言ってるわけじゃありませんので念のため。
 
 */
-func GetPointsCont(EventName, ID_Account string) (
+func GetPointsCont(
+	ctx context.Context,
+	rankingsource RankingSource,
+	pagearchive PageArchive,
+	EventName, ID_Account string,
+	sampletm time.Time,
+) (
 	TotalScore int,
+	DisplayedPoint int,
 	eventranking ShowroomDBlib.EventRanking,
-	status int,
+	err error,
 ) {
 
-	status = 0
+	DisplayedPoint = -1
 
 	//	貢献ランキングのページを開き、データ取得の準備をします。
-	_url := "https://www.showroom-live.com/event/contribution/" + EventName + "?room_id=" + ID_Account
-
-	resp, error := http.Get(_url)
-	if error != nil {
-		log.Printf("GetEventInfAndRoomList() http.Get() err=%s\n", error.Error())
-		status = 1
+	page, err := rankingsource.ReadRankingPage(ctx, EventName, ID_Account)
+	if err != nil {
+		log.Printf("GetPointsCont() ReadRankingPage() err=%s\n", err.Error())
 		return
 	}
-	defer resp.Body.Close()
+
+	//	取得したページをそのまま保存します（解析に失敗したときこそ必要になるので解析の前に保存します）
+	if pagearchive != nil {
+		if aerr := pagearchive.Save(EventName, ID_Account, sampletm, page); aerr != nil {
+			log.Printf("GetPointsCont() PageArchive.Save() err=%s\n", aerr.Error())
+		}
+	}
+
+	TotalScore, DisplayedPoint, eventranking, err = ParseRankingPage(page)
+	if err != nil {
+		log.Printf("GetPointsCont() ParseRankingPage() err=%s\n", err.Error())
+	}
+
+	return
+}
+
+//	貢献ランキングの表の見出しに含まれているはずの文字列（どれか一つが含まれていればよい）
+var (
+	RankHeaderWords  = []string{"順位", "Rank"}
+	PointHeaderWords = []string{"ポイント", "pt", "Point"}
+)
+
+//	ページに表示されているルームのポイントを探すためのパターン（最初のグループがポイント）
+var DisplayedPointPattern = regexp.MustCompile(`(?:獲得ポイント|イベントポイント|ルームポイント)[^0-9]{0,10}([0-9][0-9,]*)\s*pt`)
+
+// LayoutChangedError は貢献ランキングのページが想定している構造になっていないことを示します。
+// SHOWROOMがページのマークアップを変更したと考えられるので、このときのランキングは使ってはいけません。
+type LayoutChangedError struct {
+	Row    int //	問題のあった行（見出しの行が0、表が見つからないときは-1）
+	Reason string
+}
+
+func (e *LayoutChangedError) Error() string {
+	return fmt.Sprintf("contribution page layout changed: row %d: %s", e.Row, e.Reason)
+}
+
+/*
+	ParseRankingPage()
+	貢献ランキングのページ（HTML）を解析してイベント貢献ランキングのリストを作ります。
+
+	引数
+	page		[]byte	貢献ランキングのページ
+
+	戻り値
+	TotaScore	int	リスナーの貢献ポイントの合計
+	DisplayedPoint	int	ページに表示されているルームのポイント（DisplayedPointPatternで探す、見つからないときは-1）
+	eventranking	ShowroomDBlib.EventRanking
+	err		error	ページが想定している構造になっていないときは*LayoutChangedError
+
+	ページのマークアップが変わるとセレクターで何も取得できなくなり、それを空のランキングとして扱うと
+	既存のリスナーがすべて「ランキング外になった」と判断されてしまいます。
+	そうならないように次のことを確認します。
+		1. 表があり見出しの行に順位とポイントの列がある。
+		2. 順位とポイントが数値として読める。
+		3. 順位は昇順に、ポイントは降順に並んでいる。
+	見出しの行だけでデータの行がないとき（まだ貢献したリスナーがいないとき）は空のランキングを返します。
+*/
+func ParseRankingPage(page []byte) (
+	TotalScore int,
+	DisplayedPoint int,
+	eventranking ShowroomDBlib.EventRanking,
+	err error,
+) {
+
+	DisplayedPoint = -1
 
 	var doc *goquery.Document
-	doc, error = goquery.NewDocumentFromReader(resp.Body)
-	if error != nil {
-		log.Printf("GetEventInfAndRoomList() goquery.NewDocumentFromReader() err=<%s>.\n", error.Error())
-		status = 1
+	doc, err = goquery.NewDocumentFromReader(bytes.NewReader(page))
+	if err != nil {
+		err = fmt.Errorf("goquery.NewDocumentFromReader(): %w", err)
 		return
 	}
 
+	//	ルームのポイントが表示されていれば取得します（表示されていなくてもエラーとはしません）
+	if m := DisplayedPointPattern.FindStringSubmatch(doc.Text()); m != nil {
+		if p, perr := strconv.Atoi(strings.Replace(m[1], ",", "", -1)); perr == nil {
+			DisplayedPoint = p
+		}
+	}
+
 	/*
 		u := url.URL{}
 		u.Scheme = doc.Url.Scheme
@@ -153,50 +330,198 @@ func GetPointsCont(EventName, ID_Account string) (
 
 	//	eventranking = make([]EventRank)
 
-	doc.Find(".table-type-01:nth-child(2) > tbody > tr").Each(func(i int, s *goquery.Selection) {
-		if i != 0 {
+	rows := doc.Find(".table-type-01:nth-child(2) > tbody > tr")
+	if rows.Length() == 0 {
+		err = &LayoutChangedError{Row: -1, Reason: "ranking table not found"}
+		return
+	}
+
+	rows.EachWithBreak(func(i int, s *goquery.Selection) bool {
+		if i == 0 {
+			//	見出しの行を確認します。
+			header := s.Find("th, td")
+			if header.Length() < 3 {
+				err = &LayoutChangedError{Row: i, Reason: fmt.Sprintf("header has %d column(s)", header.Length())}
+				return false
+			}
+			if !containsAny(header.Eq(0).Text(), RankHeaderWords) {
+				err = &LayoutChangedError{Row: i, Reason: fmt.Sprintf("unexpected rank header <%s>", strings.TrimSpace(header.Eq(0).Text()))}
+				return false
+			}
+			if !containsAny(header.Eq(2).Text(), PointHeaderWords) {
+				err = &LayoutChangedError{Row: i, Reason: fmt.Sprintf("unexpected point header <%s>", strings.TrimSpace(header.Eq(2).Text()))}
+				return false
+			}
+			return true
+		}
 
-			//	データを一つ取得するたびに(戻り値となる)リスナー数をカウントアップします。
-			//	NoListner++
+		//	データを一つ取得するたびに(戻り値となる)リスナー数をカウントアップします。
+		//	NoListner++
 
-			//	以下セレクターはブラウザの開発ツールを使って確認したものです。
+		//	以下セレクターはブラウザの開発ツールを使って確認したものです。
 
-			//	順位を取得し、文字列から数値に変換します。
-			//	selector_ranking = fmt.Sprintf("table.table-type-01:nth-child(2) > tbody:nth-child(2) > tr:nth-child(%d) > td:nth-child(%d)", NoListner+2, 1)
-			ranking = s.Find("td:nth-child(1)").Text()
+		if n := s.Find("td").Length(); n < 3 {
+			err = &LayoutChangedError{Row: i, Reason: fmt.Sprintf("row has %d column(s)", n)}
+			return false
+		}
 
-			/*
-				//	データがなくなったらbreakします。このときのNoListnerは通常100、場合によってはそれ以下です。
-				if ranking == "" {
-					break
-				}
-			*/
+		//	順位を取得し、文字列から数値に変換します。
+		//	selector_ranking = fmt.Sprintf("table.table-type-01:nth-child(2) > tbody:nth-child(2) > tr:nth-child(%d) > td:nth-child(%d)", NoListner+2, 1)
+		ranking = strings.TrimSpace(s.Find("td:nth-child(1)").Text())
+
+		/*
+			//	データがなくなったらbreakします。このときのNoListnerは通常100、場合によってはそれ以下です。
+			if ranking == "" {
+				break
+			}
+		*/
 
-			iranking, _ = strconv.Atoi(ranking)
+		var perr error
+		iranking, perr = strconv.Atoi(ranking)
+		if perr != nil {
+			err = &LayoutChangedError{Row: i, Reason: fmt.Sprintf("rank <%s> is not a number", ranking)}
+			return false
+		}
 
-			//	リスナー名を取得します。
-			//	selector_listner = fmt.Sprintf("table.table-type-01:nth-child(2) > tbody:nth-child(2) > tr:nth-child(%d) > td:nth-child(%d)", NoListner+2, 2)
-			listner = s.Find("td:nth-child(2)").Text()
+		//	リスナー名を取得します。
+		//	selector_listner = fmt.Sprintf("table.table-type-01:nth-child(2) > tbody:nth-child(2) > tr:nth-child(%d) > td:nth-child(%d)", NoListner+2, 2)
+		listner = s.Find("td:nth-child(2)").Text()
 
-			//	貢献ポイントを取得し、文字列から"pt"の部分を除いた上で数値に変換します。
-			//	selector_point = fmt.Sprintf("table.table-type-01:nth-child(2) > tbody:nth-child(2) > tr:nth-child(%d) > td:nth-child(%d)", NoListner+2, 3)
-			point = s.Find("td:nth-child(3)").Text()
-			point = strings.Replace(point, "pt", "", -1)
-			ipoint, _ = strconv.Atoi(point)
-			TotalScore += ipoint
+		//	リスナーのプロフィールへのリンクがあればそこからIDを、アバターの画像があればそのURLを取得します。
+		//	（アバターは選べるものなので同じアバターのリスナーがいることもあり、IDの代わりにはなりません）
+		lsnid := 0
+		if href, ok := s.Find("a[href]").Attr("href"); ok {
+			lsnid = ListenerIDFromURL(href)
+		}
+		avatar, _ := s.Find("img[src]").Attr("src")
+
+		//	貢献ポイントを取得し、文字列から"pt"の部分（と桁区切りのカンマ）を除いた上で数値に変換します。
+		//	selector_point = fmt.Sprintf("table.table-type-01:nth-child(2) > tbody:nth-child(2) > tr:nth-child(%d) > td:nth-child(%d)", NoListner+2, 3)
+		point = s.Find("td:nth-child(3)").Text()
+		point = strings.Replace(point, "pt", "", -1)
+		point = strings.Replace(point, ",", "", -1)
+		point = strings.TrimSpace(point)
+		ipoint, perr = strconv.Atoi(point)
+		if perr != nil {
+			err = &LayoutChangedError{Row: i, Reason: fmt.Sprintf("point <%s> is not a number", point)}
+			return false
+		}
 
-			//	戻り値となるスライスに取得したデータを追加します。
-			eventrank.Rank = iranking
-			eventrank.Point = ipoint
-			eventrank.Listner = listner
-			eventrank.Order = i
-			eventranking = append(eventranking, eventrank)
+		//	順位は1からの昇順（同順位あり）、ポイントは降順に並んでいるはずです。
+		if len(eventranking) == 0 {
+			if iranking < 1 {
+				err = &LayoutChangedError{Row: i, Reason: fmt.Sprintf("first rank is %d", iranking)}
+				return false
+			}
+		} else {
+			prev := eventranking[len(eventranking)-1]
+			if iranking < prev.Rank || iranking > i {
+				err = &LayoutChangedError{Row: i, Reason: fmt.Sprintf("rank %d follows rank %d", iranking, prev.Rank)}
+				return false
+			}
+			if ipoint > prev.Point {
+				err = &LayoutChangedError{Row: i, Reason: fmt.Sprintf("point %d follows point %d", ipoint, prev.Point)}
+				return false
+			}
 		}
+
+		TotalScore += ipoint
+
+		//	戻り値となるスライスに取得したデータを追加します。
+		eventrank.Rank = iranking
+		eventrank.Point = ipoint
+		eventrank.Listner = listner
+		eventrank.LsnID = lsnid
+		eventrank.Avatar = avatar
+		eventrank.Order = i
+		eventranking = append(eventranking, eventrank)
+
+		return true
 	})
 
+	if err != nil {
+		TotalScore = 0
+		DisplayedPoint = -1
+		eventranking = nil
+	}
+
 	return
 }
 
+/*
+	CheckRoomPoint()
+	貢献ランキングから求めたポイントの合計を、獲得ポイントを監視しているプロセスがtimetableに記録したポイントと比較します。
+	貢献ランキングに載っているのは上位のリスナーだけなので二つが完全に一致することはありませんが、
+	大きく離れているときは貢献ランキングの取得か突き合わせのどこかがおかしいと考えられます。
+
+	引数
+	sumpoint	int	貢献ランキングのポイントの合計
+	disppoint	int	ページに表示されていたルームのポイント（ないときは-1）
+	earnedpoint	int	timetableに記録されたポイント（ないときは-1）
+	tolerance	float64	許容する差（earnedpointに対する割合）
+
+	戻り値
+	pointcheck	int	ShowroomDBlib.PointCheckXXXX
+	msg		string	一致しなかったときの説明
+*/
+func CheckRoomPoint(sumpoint, disppoint, earnedpoint int, tolerance float64) (pointcheck int, msg string) {
+
+	if earnedpoint < 0 {
+		return ShowroomDBlib.PointCheckNone, ""
+	}
+
+	//	ポイントが0と記録されているときは割合では比較できないので、ポイントがあれば一致しないとします。
+	if earnedpoint == 0 {
+		if sumpoint > 0 {
+			return ShowroomDBlib.PointCheckDiverged, fmt.Sprintf("sum of contribution %d but earned point is 0", sumpoint)
+		}
+		if disppoint > 0 {
+			return ShowroomDBlib.PointCheckDiverged, fmt.Sprintf("displayed point %d but earned point is 0", disppoint)
+		}
+		return ShowroomDBlib.PointCheckOK, ""
+	}
+
+	if diff := math.Abs(float64(sumpoint-earnedpoint)) / float64(earnedpoint); diff > tolerance {
+		return ShowroomDBlib.PointCheckDiverged,
+			fmt.Sprintf("sum of contribution %d differs from earned point %d by %.1f%%", sumpoint, earnedpoint, diff*100.0)
+	}
+	if disppoint >= 0 {
+		if diff := math.Abs(float64(disppoint-earnedpoint)) / float64(earnedpoint); diff > tolerance {
+			return ShowroomDBlib.PointCheckDiverged,
+				fmt.Sprintf("displayed point %d differs from earned point %d by %.1f%%", disppoint, earnedpoint, diff*100.0)
+		}
+	}
+
+	return ShowroomDBlib.PointCheckOK, ""
+}
+
+//	ListenerIDFromURL はリスナーのプロフィールのURL（例 /user/profile?user_id=1234567）からリスナーのIDを取り出します。
+//	IDが含まれていないときは0を返します。
+func ListenerIDFromURL(href string) (lsnid int) {
+
+	u, err := url.Parse(href)
+	if err != nil {
+		return 0
+	}
+	for _, key := range []string{"user_id", "viewer_id"} {
+		if v := u.Query().Get(key); v != "" {
+			if lsnid, err = strconv.Atoi(v); err == nil && lsnid > 0 {
+				return lsnid
+			}
+		}
+	}
+	return 0
+}
+
+func containsAny(s string, words []string) bool {
+	for _, w := range words {
+		if strings.Contains(s, w) {
+			return true
+		}
+	}
+	return false
+}
+
 func MakeListInSheet(
 	oldfilename,
 	newfilename string,
@@ -388,226 +713,40 @@ func ReadListInSheet(
 	return
 }
 
+/*
+	CompareEventRanking()
+	前の配信の貢献ランキングと今回の配信の貢献ランキングを突き合わせ、保存する貢献ランキングと増分の合計を返します。
+	突き合わせはmatchingパッケージのMatcher（NewMatcher()が作るもの）で行います。引数の貢献ランキングは変更しません。
+*/
 func CompareEventRanking(
+	matcher matching.Matcher,
 	last_eventranking ShowroomDBlib.EventRanking,
 	new_eventranking ShowroomDBlib.EventRanking,
-	idx int,
 ) (ShowroomDBlib.EventRanking, int) {
 
-	totalincremental := 0
-
-	log.Printf("          Phase 1\n")
-	//	既存のデータとリスナー名が一致するデータがあったときは既存のデータを更新する。
-	ncol := 1
-	msg := ""
-	for j := 0; j < len(last_eventranking); j++ {
-		for i := 0; i < len(new_eventranking); i++ {
-			if new_eventranking[i].Status == 1 {
-				continue
-			}
-			if new_eventranking[i].Listner == last_eventranking[j].Listner {
-				if new_eventranking[i].Point >= last_eventranking[j].Point {
-					if last_eventranking[j].Point != -1 {
-						incremental := new_eventranking[i].Point - last_eventranking[j].Point
-						totalincremental += incremental
-						last_eventranking[j].Incremental = incremental
-					} else {
-						last_eventranking[j].Incremental = -1
-					}
-					last_eventranking[j].Rank = new_eventranking[i].Rank
-					last_eventranking[j].Point = new_eventranking[i].Point
-					last_eventranking[j].Order = new_eventranking[i].Order
-					last_eventranking[j].Lastname = ""
-					new_eventranking[i].Status = 1
-					last_eventranking[j].Status = 1
-					msg = msg + fmt.Sprintf("%3d/%3d  ", j, i)
-					if ncol == 10 {
-						log.Printf("%s\n", msg)
-						ncol = 1
-						msg = ""
-					} else {
-						ncol++
-					}
-					break
-				}
-			}
-		}
-	}
-	if msg != "" {
-		log.Printf("%s\n", msg)
-	}
-
-	log.Printf("          Phase 2\n")
-
-	phase2 := func() {
-		log.Printf("     vvvvv     Phase 2\n")
-
-		//	現在のポイント以上のリスナーが一人しかいないなら同一人物のはず
-	Outerloop:
-		for j := 0; j < len(last_eventranking); j++ {
-			if last_eventranking[j].Status == 1 {
-				continue
-			}
-			noasgn := -1
-			for i := 0; i < len(new_eventranking); i++ {
-				if new_eventranking[i].Status == 1 {
-					//	すでに突き合わせが終わったものは対象にしない。
-					continue
-				}
-				if new_eventranking[i].Point < 0 {
-					//	いったんランクキング表外に出たものは突き合わせの対象としない。
-					continue
-				}
-				if new_eventranking[i].Point < last_eventranking[j].Point {
-					break
-				}
-
-				if noasgn != -1 {
-					//	現在のポイント以上のリスナーが複数人いるとき
-					//	ここで処理を完全やめてしまうのは last_eventranking がソートしてあることが前提
-					//	ソートされていないのであれば単なるbreakにすべき
-					break Outerloop
-				} else {
-					//	現在のポイント以上のはじめてのリスナー
-					noasgn = i
-				}
-			}
-			if noasgn != -1 {
-				//	現在のポイント以上のリスナーが一人しかいなかった
-				if last_eventranking[j].Point != -1 {
-					incremental := new_eventranking[noasgn].Point - last_eventranking[j].Point
-					totalincremental += incremental
-					last_eventranking[j].Incremental = incremental
-				} else {
-					last_eventranking[j].Incremental = -1
-				}
-				last_eventranking[j].Rank = new_eventranking[noasgn].Rank
-				last_eventranking[j].Point = new_eventranking[noasgn].Point
-				last_eventranking[j].Order = new_eventranking[noasgn].Order
-				new_eventranking[noasgn].Status = 1
-				last_eventranking[j].Status = 1
-				last_eventranking[j].Lastname = last_eventranking[j].Listner + " [2]"
-				last_eventranking[j].Listner = new_eventranking[noasgn].Listner
-				log.Printf("*****         【%s】 equals to 【%s】\n", new_eventranking[noasgn].Listner, last_eventranking[j].Lastname)
-			}
-
-		}
-		log.Printf("     ^^^^^     Phase 2\n")
-	}
-	//	コメントにした理由を思い出す！
-	//	phase2()
-
-	log.Printf("          Phase 3\n")
-	//	完全に一致するものがない場合は一致度が高いものを探す。
-	// weighted
-	wd := lsdp.Weights{Insert: 0.8, Delete: 0.8, Replace: 1.0}
-	// weighted and normalized
-	nd := lsdp.Normalized(wd)
-	for j := 0; j < len(last_eventranking); j++ {
-		if last_eventranking[j].Status == 1 {
-			continue
-		}
-		log.Println("---------------")
-		first_n := 0
-		first_v := 2.0
-		second_v := 2.0
-		for i := 0; i < len(new_eventranking); i++ {
-			if new_eventranking[i].Status == 1 {
-				continue
-			}
-			if new_eventranking[i].Point < last_eventranking[j].Point {
-				break
-			}
-
-			newlistner := new_eventranking[i].Listner
-			lastlistner := last_eventranking[j].Listner
-			value := nd.Distance(newlistner, lastlistner)
-			log.Printf("%6.3f [%3d] 【%s】 [%3d] 【%s】\n", value, j, lastlistner, i, newlistner)
-			if value < first_v {
-				second_v = first_v
-				first_v = value
-				first_n = i
-			} else if value < second_v {
-				second_v = value
-			}
-		}
-
-		phase3 := func(cond string, dist float64) {
-			if last_eventranking[j].Point != -1 {
-				incremental := new_eventranking[first_n].Point - last_eventranking[j].Point
-				totalincremental += incremental
-				last_eventranking[j].Incremental = incremental
-			} else {
-				last_eventranking[j].Incremental = -1
-			}
-			last_eventranking[j].Rank = new_eventranking[first_n].Rank
-			last_eventranking[j].Point = new_eventranking[first_n].Point
-			last_eventranking[j].Order = new_eventranking[first_n].Order
-			new_eventranking[first_n].Status = 1
-			last_eventranking[j].Status = 1
-			last_eventranking[j].Lastname = last_eventranking[j].Listner + " [" + cond + fmt.Sprintf("%6.3f", dist) + "]"
-			last_eventranking[j].Listner = new_eventranking[first_n].Listner
-			log.Printf("*****         【%s】 equals to 【%s】\n", last_eventranking[j].Lastname, new_eventranking[first_n].Listner)
-		}
-
-		switch {
-		//	case first_v < 0.72:	//	この数値は大きすぎると思われる。0.6を超えて一致と判断されるものはあやしいものが多かった（2022-03-23)
-		case first_v < 0.62:
-			//	一致度が高い
-			phase3("3A", first_v)
-		case second_v < 1.1 && second_v-first_v > 0.2:
-			//	一致度が他に比較して高い
-			phase3("3B", first_v)
-		case first_v < 1.1 && second_v > 1.1 &&
-			last_eventranking[j].Point != -1 &&
-			(j == len(last_eventranking)-1 || last_eventranking[j].Point != last_eventranking[j+1].Point):
-			//	一致度のチェック対象が一つしかない
-			//	ここで last_eventranking[j].Point != last_eventranking[j+1].Point の条件が成り立たないことはありえないはずだが...
-			phase3("3C", first_v)
-		default:
-			//	同一と思われるデータがみつからなかった。
-			last_eventranking[j].Point = -1
-			last_eventranking[j].Incremental = -1
-			last_eventranking[j].Status = -1
-			last_eventranking[j].Order = 999
-			last_eventranking[j].Lastname = ""
-			log.Printf("*****         【%s】  not found.\n", last_eventranking[j].Listner)
-		}
-
-	}
-
-	phase2()
-
-	log.Printf("          Phase 4\n")
-
-	//	既存のランキングになかったリスナーを既存のランキングに追加する。
-	//	ソートはしない。ソートするとExcelにあるデータと整合性がとれなくなる。
-	//	つまり、ソートはExcelで行う。
-	var eventrank ShowroomDBlib.EventRank
-	no := len(last_eventranking)
-	for i := 0; i < len(new_eventranking); i++ {
-		if new_eventranking[i].Status != 1 {
-			eventrank.Order = no
-			no++
-			eventrank.Listner = new_eventranking[i].Listner
-			eventrank.Rank = new_eventranking[i].Rank
-			eventrank.Point = new_eventranking[i].Point
-			eventrank.Order = new_eventranking[i].Order
-			eventrank.T_LsnID = new_eventranking[i].Order + idx*1000
-			eventrank.Incremental = -1
-
-			incremental := new_eventranking[i].Point
-			totalincremental += incremental
-			eventrank.Incremental = incremental
+	result := matcher.Match(last_eventranking, new_eventranking)
+	return matching.Apply(last_eventranking, new_eventranking, result)
+}
 
-			last_eventranking = append(last_eventranking, eventrank)
-		}
+/*
+	NewMatcher()
+	判定に使う値（Environment.ymlのmatchingのParamsFor()で得たもの）から突き合わせに使うMatcherを作ります。
+	modeが"assignment"のときはmatching.Assignment、それ以外はmatching.Greedyで突き合わせます。
+*/
+func NewMatcher(params matching.Params) matching.Matcher {
+	if params.Mode == matching.ModeAssignment {
+		return &matching.Assignment{Params: params, Logf: log.Printf}
 	}
-
-	return last_eventranking, totalincremental
+	return &matching.Greedy{Params: params, Logf: log.Printf}
 }
+
 func ExtractTask(
+	ctx context.Context,
 	environment *Environment,
+	store *ShowroomDBlib.Store,
+	rankingsource RankingSource,
+	pagearchive PageArchive,
+	worker string,
 	/*
 		bmakesheet bool,
 	*/
@@ -620,8 +759,6 @@ func ExtractTask(
 	//	var event_id, room_id string
 	//	var bmakesheet bool
 
-	bmakesheet := true
-
 	fmt.Printf("%s ***************** ExtractTaskGroup() ****************\n", time.Now().Format("2006/1/2 15:04:05"))
 	defer fmt.Printf("%s ************* end of ExtractTaskGroup() *************\n", time.Now().Format("2006/1/2 15:04:05"))
 
@@ -631,91 +768,96 @@ func ExtractTask(
 	st := time.Now()
 	log.Printf(" Start of ExtractTaskGroup() at %s\n", st.Format("2006/1/2 15:04:05"))
 
+	//	保存期間を過ぎたページの削除は一時間に一回行う。
+	PurgePages(pagearchive, environment.ArchiveRetention)
+	lastpurge := time.Now()
+
+	workers := environment.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	lease := time.Duration(environment.LeaseTime) * time.Second
+
 Outerloop:
 	for {
 
 		for {
 
-			ndata, event_id, userno, sampletm1 := ShowroomDBlib.SelectEidUidFromTimetable()
-			if ndata <= 0 {
-				break
-			}
-
-			room_id := fmt.Sprintf("%d", userno)
-
-			log.Printf(" ndata = %d event_id [%s]  userno =%d.\n", ndata, event_id, userno)
-
-			log.Printf("------------------- new_eventranking --------------------\n")
-			//	totalscore, new_eventranking, _ := GetPointsCont(event_id, room_id)
-			_, new_eventranking, _ := GetPointsCont(event_id, room_id)
-
-			/*
-				for i := 0; i < len(new_eventranking); i++ {
-					log.Printf("%3d\t%7d\t【%s】\r\n", new_eventranking[i].rank, new_eventranking[i].point, new_eventranking[i].listner)
-				}
-				log.Printf("Total Score=%d\n", totalscore)
-			*/
-
-			log.Printf("------------------- last_eventranking --------------------\n")
-
-			last_eventranking := make(ShowroomDBlib.EventRanking, 0)
-
-			ndata, maxts := ShowroomDBlib.SelectMaxTsFromEventrank(event_id, userno)
-			if ndata < 0 {
-				log.Printf(" %d returned by SelectMaxTsFromEventrank()\n", ndata)
+			//	処理すべきものをまとめて確保し、ルーム（eventid, userid）ごとに分ける。
+			//	同じルームのものは古いものから順に一つのワーカーで処理する（突き合わせは前回の結果に対して行うので順序が重要）
+			//	異なるルームのものはworkers個のワーカーで並行して処理する。
+			//	確保したものは他のプロセスでは処理されない（二つのプロセスを同時に動かしても同じ配信を二度処理することはない）
+			samples, err := store.ClaimSamples(ctx, worker, workers*4, lease)
+			if err != nil {
+				log.Printf(" ClaimSamples() returned err=%s\n", err.Error())
+				ReleaseSamples(store, worker, samples)
 				break Outerloop
-			} else if ndata > 0 {
-				last_eventranking, status = ShowroomDBlib.SelectEventRankingFromEventrank(event_id, userno, maxts)
 			}
-			/*	*/
-			for i := 0; i < len(last_eventranking); i++ {
-				log.Printf("%3d\t%7d\t【%s】\r\n", last_eventranking[i].Order, last_eventranking[i].Point, last_eventranking[i].Listner)
-			}
-			/*	*/
-
-			log.Printf("------------------- compare --------------------\n")
-			idx := ShowroomDBlib.SelectMaxTlsnidFromEventranking(event_id, userno) / 1000
-			if idx >= 1000 {
-				idx /= 1000
+			if len(samples) == 0 {
+				break
 			}
-			idx += 1
-			final_eventranking, totalincremental := CompareEventRanking(last_eventranking, new_eventranking, idx)
-			log.Printf("------------------- final_eventranking --------------------\n")
-			for i := 0; i < len(final_eventranking); i++ {
-				if final_eventranking[i].Lastname != "" {
-					log.Printf("%3d\t%7d\t【%s】\t【%s】\r\n",
-						final_eventranking[i].Order,
-						final_eventranking[i].Point,
-						final_eventranking[i].Listner,
-						final_eventranking[i].Lastname)
+			log.Printf(" %d sample(s) to process.\n", len(samples))
+
+			var rooms [][]ShowroomDBlib.Sample
+			roomidx := make(map[string]int)
+			for _, sample := range samples {
+				key := fmt.Sprintf("%s/%d", sample.Eventid, sample.Userid)
+				if i, ok := roomidx[key]; ok {
+					rooms[i] = append(rooms[i], sample)
 				} else {
-					log.Printf("%3d\t%7d\t【%s】\r\n",
-						final_eventranking[i].Order,
-						final_eventranking[i].Point,
-						final_eventranking[i].Listner)
+					roomidx[key] = len(rooms)
+					rooms = append(rooms, []ShowroomDBlib.Sample{sample})
 				}
 			}
 
-			if bmakesheet {
-
-				sampletm2 := time.Now().Truncate(time.Minute)
-				ier_status := ShowroomDBlib.InsertIntoEventrank(event_id, userno, sampletm2, final_eventranking)
-				if ier_status != 0 {
-					log.Printf(" Can`t insert into eventrank.\n")
-				}
-				ShowroomDBlib.UpdateTimetable(event_id, userno, sampletm1, sampletm2, totalincremental)
-
-			} else {
-				for i := 1; i < 100; i++ {
-					fmt.Printf(" (%d) %s", i, CtoA(i))
-				}
-				fmt.Printf(".\n")
+			var wg sync.WaitGroup
+			var fatal int32
+			sem := make(chan struct{}, workers)
+			for _, room := range rooms {
+				wg.Add(1)
+				go func(room []ShowroomDBlib.Sample) {
+					defer wg.Done()
+					sem <- struct{}{}
+					defer func() { <-sem }()
+					for i, sample := range room {
+						if ctx.Err() != nil || atomic.LoadInt32(&fatal) != 0 {
+							ReleaseSamples(store, worker, room[i:])
+							return
+						}
+						done, err := ProcessSample(ctx, environment, store, rankingsource, pagearchive, worker, sample)
+						if err != nil {
+							log.Printf(" ProcessSample() returned err=%s\n", err.Error())
+							atomic.StoreInt32(&fatal, 1)
+							ReleaseSamples(store, worker, room[i+1:])
+							return
+						}
+						if !done {
+							//	このルームの以降のものは、失敗したものが処理できるまで処理しない。
+							ReleaseSamples(store, worker, room[i+1:])
+							return
+						}
+					}
+				}(room)
 			}
+			wg.Wait()
 
+			if ctx.Err() != nil || fatal != 0 {
+				break Outerloop
+			}
 		}
 		hhn, mmn, _ = WaitNextMinute()
 		fmt.Printf("** %02d %02d\n", hhn, mmn)
 
+		if ctx.Err() != nil {
+			log.Printf(" ExtractTaskGroup() canceled t=%s\n", time.Now().Format("2006/1/2 15:04:05"))
+			break
+		}
+
+		if time.Since(lastpurge) >= time.Hour {
+			PurgePages(pagearchive, environment.ArchiveRetention)
+			lastpurge = time.Now()
+		}
+
 		if (hhn+1)%environment.IntervalHour == 0 && mmn == 0 {
 			log.Printf(" End of ExtractTaskGroup() t=%s\n", time.Now().Format("2006/1/2 15:04:05"))
 			break
@@ -728,6 +870,239 @@ Outerloop:
 	return
 }
 
+/*
+	ProcessSample()
+	timetableの一つの行（一つの配信）について、貢献ランキングを取得し、前回のものと突き合わせて結果を保存します。
+	行はworkerが確保しているものとし、処理している間は確保している期間（lease）を延長し続けます。
+	期間が切れて他のworkerに確保されてしまったときは結果を保存しません。
+
+	戻り値
+	done		bool	処理済みにしたとき true（貢献ランキングが取得できずリトライ待ちや保留にしたときは false）
+	err		error	DBのエラーなど処理を続けられないとき
+*/
+func ProcessSample(
+	ctx context.Context,
+	environment *Environment,
+	store *ShowroomDBlib.Store,
+	rankingsource RankingSource,
+	pagearchive PageArchive,
+	worker string,
+	sample ShowroomDBlib.Sample,
+) (
+	done bool,
+	err error,
+) {
+
+	bmakesheet := true
+
+	event_id := sample.Eventid
+	userno := sample.Userid
+	sampletm1 := sample.Sampletm1
+	room_id := fmt.Sprintf("%d", userno)
+
+	log.Printf(" event_id [%s]  userno =%d  sampletm1 = %v.\n", event_id, userno, sampletm1)
+
+	//	確保してから処理を始めるまでに時間がかかることがあるので、まず延長しておく。
+	lease := time.Duration(environment.LeaseTime) * time.Second
+	if err = store.RenewLease(ctx, worker, sample, lease); errors.Is(err, ShowroomDBlib.ErrNotClaimed) {
+		log.Printf(" event_id [%s] userno=%d sampletm1=%v is no longer claimed by %s.\n", event_id, userno, sampletm1, worker)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	sctx, cancel, lost := KeepLease(ctx, store, worker, sample, lease)
+	defer cancel()
+
+	//	貢献ランキングを取得した時刻（timetableのsampletm2、eventrankのfetchtm）
+	//	eventrankと保存するページはsampletm1をキーにする（遅れて処理しても配信の順に並ぶように）
+	sampletm2 := time.Now().Truncate(time.Second)
+
+	log.Printf("------------------- new_eventranking --------------------\n")
+	totalscore, disppoint, new_eventranking, err := GetPointsCont(sctx, rankingsource, pagearchive, event_id, room_id, sampletm1)
+	if err != nil {
+		log.Printf(" GetPointsCont() returned err=%s\n", err.Error())
+		if lost() {
+			//	他のworkerに確保されたときは何もしない。
+			return false, nil
+		}
+		if ctx.Err() != nil {
+			//	中断されたときはtimetableを元に戻しておく。
+			ReleaseSamples(store, worker, []ShowroomDBlib.Sample{sample})
+			return false, nil
+		}
+		var lerr *LayoutChangedError
+		if errors.As(err, &lerr) {
+			log.Printf(" **** The layout of the contribution page seems to have changed. ****\n")
+		}
+		//	取得できなかったときは結果を保存せず、timetableをリトライ待ちにする（規定の回数失敗したら保留にする）
+		//	ここで処理済みにしてしまうと貢献ポイントがゼロの配信として記録され、リスナーの追跡も途切れてしまう。
+		parked, ferr := store.FailSample(ctx, worker, sample, err.Error(),
+			environment.SampleMaxAttempts, time.Duration(environment.SampleRetryInterval)*time.Minute)
+		if errors.Is(ferr, ShowroomDBlib.ErrNotClaimed) {
+			log.Printf(" event_id [%s] userno=%d sampletm1=%v was claimed by another worker.\n", event_id, userno, sampletm1)
+			return false, nil
+		} else if ferr != nil {
+			return false, ferr
+		}
+		if parked {
+			log.Printf(" **** event_id [%s] userno=%d sampletm1=%v is parked for manual review. ****\n", event_id, userno, sampletm1)
+		}
+		return false, nil
+	}
+
+	/*
+		for i := 0; i < len(new_eventranking); i++ {
+			log.Printf("%3d\t%7d\t【%s】\r\n", new_eventranking[i].rank, new_eventranking[i].point, new_eventranking[i].listner)
+		}
+		log.Printf("Total Score=%d\n", totalscore)
+	*/
+
+	log.Printf("------------------- last_eventranking --------------------\n")
+
+	last_eventranking := make(ShowroomDBlib.EventRanking, 0)
+
+	//	直近のものではなく、この配信の前の配信のものと突き合わせる（後の配信が先に処理されていることがあるため）
+	//	貢献ランキングに載らなくなったリスナーもlistenerテーブルから加えられる（Point = -1）
+	_, snapshot, err := store.PreviousRanking(ctx, sample)
+	if err == nil {
+		last_eventranking = snapshot
+	} else if !errors.Is(err, ShowroomDBlib.ErrNoSnapshot) {
+		return false, err
+	}
+	/*	*/
+	for i := 0; i < len(last_eventranking); i++ {
+		log.Printf("%3d\t%7d\t【%s】\r\n", last_eventranking[i].Order, last_eventranking[i].Point, last_eventranking[i].Listner)
+	}
+	/*	*/
+
+	log.Printf("------------------- compare --------------------\n")
+	params := environment.Matching.ParamsFor(event_id)
+	matchparams := params.String()
+	log.Printf(" matchparams=%s\n", matchparams)
+	matcher := NewMatcher(params)
+	final_eventranking, totalincremental := CompareEventRanking(matcher, last_eventranking, new_eventranking)
+	log.Printf("------------------- final_eventranking --------------------\n")
+	for i := 0; i < len(final_eventranking); i++ {
+		if final_eventranking[i].Lastname != "" {
+			log.Printf("%3d\t%7d\t【%s】\t【%s】\r\n",
+				final_eventranking[i].Order,
+				final_eventranking[i].Point,
+				final_eventranking[i].Listner,
+				final_eventranking[i].Lastname)
+		} else {
+			log.Printf("%3d\t%7d\t【%s】\r\n",
+				final_eventranking[i].Order,
+				final_eventranking[i].Point,
+				final_eventranking[i].Listner)
+		}
+	}
+
+	log.Printf("------------------- room point --------------------\n")
+	//	ルームのポイント（貢献ランキングの合計と表示されているもの）を監視プロセスが記録したものと比較する。
+	earnedpoint, err := store.EarnedPoint(ctx, sample)
+	if err != nil {
+		//	比較できないだけなので処理は続ける。
+		log.Printf(" EarnedPoint() returned err=%s\n", err.Error())
+	}
+	pointcheck, msg := CheckRoomPoint(totalscore, disppoint, earnedpoint, float64(environment.PointTolerance)/100.0)
+	log.Printf(" totalscore=%d disppoint=%d earnedpoint=%d pointcheck=%d\n", totalscore, disppoint, earnedpoint, pointcheck)
+	if pointcheck == ShowroomDBlib.PointCheckDiverged {
+		log.Printf(" **** %s ****\n", msg)
+	}
+
+	if bmakesheet {
+
+		//	貢献ランキングの保存とtimetableの更新は一つのトランザクションで行う（途中で止まっても一部だけが保存されることはない）
+		err = store.CommitSample(ctx, worker, sample, sampletm2, final_eventranking, ShowroomDBlib.SampleResult{
+			Sampletm2:   sampletm2,
+			Totalpoint:  totalincremental,
+			Sumpoint:    totalscore,
+			Disppoint:   disppoint,
+			Pointcheck:  pointcheck,
+			Matchparams: matchparams,
+		})
+		if errors.Is(err, ShowroomDBlib.ErrNotClaimed) {
+			log.Printf(" event_id [%s] userno=%d sampletm1=%v was claimed by another worker. The result is discarded.\n", event_id, userno, sampletm1)
+			return false, nil
+		} else if err != nil {
+			log.Printf(" Can`t insert into eventrank.\n")
+			return false, err
+		}
+
+	} else {
+		for i := 1; i < 100; i++ {
+			fmt.Printf(" (%d) %s", i, CtoA(i))
+		}
+		fmt.Printf(".\n")
+	}
+
+	return true, nil
+}
+
+/*
+	KeepLease()
+	確保しているtimetableの行の期間（lease）を、その1/3ごとに延長し続けます。
+	延長できなかったとき（他のworkerに確保されたとき）は返したcontextをキャンセルし、lost()がtrueを返すようになります。
+	処理が終わったら cancel() を呼んでください。
+*/
+func KeepLease(
+	ctx context.Context,
+	store *ShowroomDBlib.Store,
+	worker string,
+	sample ShowroomDBlib.Sample,
+	lease time.Duration,
+) (
+	sctx context.Context,
+	cancel context.CancelFunc,
+	lost func() bool,
+) {
+
+	var flost int32
+	sctx, cancel = context.WithCancel(ctx)
+	lost = func() bool { return atomic.LoadInt32(&flost) != 0 }
+
+	interval := lease / 3
+	if interval <= 0 {
+		interval = time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sctx.Done():
+				return
+			case <-ticker.C:
+				if err := store.RenewLease(sctx, worker, sample, lease); errors.Is(err, ShowroomDBlib.ErrNotClaimed) {
+					log.Printf(" KeepLease() event_id [%s] userno=%d sampletm1=%v lease lost.\n", sample.Eventid, sample.Userid, sample.Sampletm1)
+					atomic.StoreInt32(&flost, 1)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return
+}
+
+//	ReleaseSamples は確保したが処理しなかったtimetableの行を元に戻します（中断されたときも戻すのでctxは使いません）
+func ReleaseSamples(store *ShowroomDBlib.Store, worker string, samples []ShowroomDBlib.Sample) {
+	for _, sample := range samples {
+		if err := store.ReleaseSample(context.Background(), worker, sample); err != nil {
+			log.Printf(" ReleaseSample() returned err=%s\n", err.Error())
+		}
+	}
+}
+
+//	WorkerID はtimetableの行を確保するときのこのプロセスの識別子（ホスト名とプロセスID）を返します。
+func WorkerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
 /*
 	WaitNextMinute()
 	現在時の時分の次の時分までウェイトします。
@@ -762,10 +1137,35 @@ func WaitNextMinute() (hhn, mmn, ssn int) {
 	return
 }
 
+//	ExitCode はサブコマンドの戻り値を終了コードにします（diff(1)にならい、0: 正常、1: 差異がある、2: エラー）
+func ExitCode(status int) int {
+	switch {
+	case status == 0:
+		return 0
+	case status > 0:
+		return 1
+	default:
+		return 2
+	}
+}
+
 func main() {
 
+	//	サブコマンド
+	//		（なし）	timetableにしたがって貢献ランキングを取得する
+	//		replay		突き合わせを再実行する（Replay()を参照）
+	//		migrate		データベースのスキーマを作成、更新する（Migrate()を参照）
+	//		bench		貢献ランキングを保存する時間を計測する（Bench()を参照）
+	subcommand := ""
 	if len(os.Args) > 1 {
-		fmt.Println("Usage: ", os.Args[0])
+		subcommand = os.Args[1]
+	}
+	switch subcommand {
+	case "", "replay", "migrate", "bench":
+	default:
+		fmt.Println("Usage: ", os.Args[0], "[replay [-source archive|eventrank] [-out diff|scratch|compare] [-mode greedy|assignment] eventid roomid]")
+		fmt.Println("       ", os.Args[0], "migrate [-status] [-baseline N]")
+		fmt.Println("       ", os.Args[0], "bench [-sizes 100,500,2000] [-batch 1,100] [-repeat 5]")
 		return
 	}
 
@@ -776,7 +1176,12 @@ func main() {
 	}
 	defer logfile.Close()
 	//	log.SetOutput(logfile)
-	log.SetOutput(io.MultiWriter(logfile, os.Stdout))
+	if subcommand == "" {
+		log.SetOutput(io.MultiWriter(logfile, os.Stdout))
+	} else {
+		//	サブコマンドの結果は標準出力に出すのでログはファイルにだけ出力する。
+		log.SetOutput(logfile)
+	}
 
 	log.Printf("\n")
 	log.Printf("\n")
@@ -797,15 +1202,92 @@ func main() {
 		log.Printf("Set IntervalMin to 99999.\n")
 		environment.IntervalHour = 99999
 	}
+	if environment.SampleMaxAttempts <= 0 {
+		environment.SampleMaxAttempts = 5
+	}
+	if environment.SampleRetryInterval <= 0 {
+		environment.SampleRetryInterval = 10
+	}
+	if environment.PointTolerance <= 0 {
+		environment.PointTolerance = 20
+	}
+	if environment.Workers <= 0 {
+		environment.Workers = 1
+	}
+	if environment.FetchInterval == 0 {
+		environment.FetchInterval = 1000
+	}
+	if environment.LeaseTime <= 0 {
+		environment.LeaseTime = 300
+	}
+	//	突き合わせの判定に使う値が正しくないときは処理をしない。
+	if err = environment.Matching.Validate(); err != nil {
+		log.Printf("Environment.yml: %s\n", err.Error())
+		fmt.Printf("Environment.yml: %s\n", err.Error())
+		return
+	}
+	log.Printf(" matching=%s\n", environment.Matching.String())
 	log.Printf(" environment=%+v\n", environment)
 
-	status := ShowroomDBlib.OpenDb(dbconfig)
-	if status != 0 {
-		log.Printf("OpenDB returned status = %d\n", status)
+	rankingsource, err := NewRankingSource(&environment)
+	if err != nil {
+		log.Printf("NewRankingSource() Error: %s\n", err.Error())
+		return
+	}
+
+	//	設定が正しくない、データベースに接続できないときは終了コード2で終了する。
+	store, err := ShowroomDBlib.OpenStore(dbconfig)
+	if err != nil {
+		log.Printf("OpenStore() Error: %s\n", err.Error())
+		fmt.Printf("OpenStore() Error: %s\n", err.Error())
+		os.Exit(2)
+	}
+	defer store.Close()
+
+	if subcommand == "migrate" {
+		if status := Migrate(os.Args[2:], store); status != 0 {
+			store.Close()
+			os.Exit(ExitCode(status))
+		}
+		return
+	}
+
+	//	スキーマが古い（または新しい）ときは処理をしない（正常に終了したのと区別できるように終了コードは2）
+	if err = store.CheckSchema(context.Background()); err != nil {
+		log.Printf("CheckSchema() Error: %s\n", err.Error())
+		fmt.Printf("%s\n", err.Error())
+		store.Close()
+		os.Exit(2)
+	}
+
+	pagearchive, err := NewPageArchive(&environment, store)
+	if err != nil {
+		log.Printf("NewPageArchive() Error: %s\n", err.Error())
+		return
+	}
+
+	if subcommand == "replay" {
+		if status := Replay(os.Args[2:], &environment, store, pagearchive); status != 0 {
+			store.Close()
+			os.Exit(ExitCode(status))
+		}
 		return
 	}
-	defer ShowroomDBlib.Db.Close()
 
-	ExtractTask(&environment)
+	if subcommand == "bench" {
+		if status := Bench(os.Args[2:], store); status != 0 {
+			store.Close()
+			os.Exit(ExitCode(status))
+		}
+		return
+	}
+
+	//	SIGINT、SIGTERMで処理を中断します（SHOWROOMへのアクセスやリトライの待ちも中断されます）
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	worker := WorkerID()
+	log.Printf(" worker=%s\n", worker)
+	ExtractTask(ctx, &environment, store, rankingsource, pagearchive, worker)
 
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ShowroomDBlib"
+)
+
+//	testPage は貢献ランキングのページで、ポイントの合計と表示されているルームのポイントはどちらも1000です。
+var testPage = []byte(`<html><body><div>
+<p>獲得ポイント 1,000pt</p>
+<table class="table-type-01">
+<tr><th>順位</th><th>ユーザー名</th><th>ポイント</th></tr>
+<tr><td>1</td><td>リスナー1</td><td>500pt</td></tr>
+<tr><td>2</td><td>リスナー2</td><td>300pt</td></tr>
+<tr><td>3</td><td>リスナー3</td><td>200pt</td></tr>
+</table>
+</div></body></html>`)
+
+//	pageSource はいつも同じページを返すRankingSourceです。
+type pageSource []byte
+
+func (p pageSource) ReadRankingPage(ctx context.Context, eventid, roomid string) ([]byte, error) {
+	return p, nil
+}
+
+func openTestStore(t *testing.T) *ShowroomDBlib.Store {
+	t.Helper()
+	store, err := ShowroomDBlib.OpenStore(&ShowroomDBlib.DBConfig{Dbdriver: "sqlite", Dbpath: filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if _, _, err = store.Migrate(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+//	rankingPage は見出しの行とデータの行から貢献ランキングのページを作ります。
+func rankingPage(header string, rows ...string) []byte {
+	page := `<html><body><div>
+<p>獲得ポイント 1,000pt</p>
+<table class="table-type-01">
+` + header + "\n"
+	for _, row := range rows {
+		page += row + "\n"
+	}
+	return []byte(page + "</table>\n</div></body></html>")
+}
+
+//	ページの構造が想定と違うときは*LayoutChangedError（問題のあった行）を返すこと。
+func TestParseRankingPage(t *testing.T) {
+
+	header := `<tr><th>順位</th><th>ユーザー名</th><th>ポイント</th></tr>`
+	cases := []struct {
+		name string
+		page []byte
+		row  int //	LayoutChangedErrorの行（エラーにならないときは-2）
+		want int //	ランキングの長さ
+	}{
+		{"ok", testPage, -2, 3},
+		{"header only", rankingPage(header), -2, 0},
+		{"empty", []byte(`<html><body></body></html>`), -1, 0},
+		{"no table", []byte(`<html><body><div><p>ランキング</p><table class="table-type-02"><tr><td>1</td></tr></table></div></body></html>`), -1, 0},
+		{"short header", rankingPage(`<tr><th>順位</th><th>ポイント</th></tr>`), 0, 0},
+		{"bad rank header", rankingPage(`<tr><th>No.</th><th>ユーザー名</th><th>ポイント</th></tr>`), 0, 0},
+		{"bad point header", rankingPage(`<tr><th>順位</th><th>ユーザー名</th><th>レベル</th></tr>`), 0, 0},
+		{"short row", rankingPage(header, `<tr><td>1</td><td>500pt</td></tr>`), 1, 0},
+		{"rank not a number", rankingPage(header, `<tr><td>一</td><td>リスナー1</td><td>500pt</td></tr>`), 1, 0},
+		{"point not a number", rankingPage(header, `<tr><td>1</td><td>リスナー1</td><td>-</td></tr>`), 1, 0},
+		{"first rank", rankingPage(header, `<tr><td>0</td><td>リスナー1</td><td>500pt</td></tr>`), 1, 0},
+		{"rank decreases", rankingPage(header,
+			`<tr><td>2</td><td>リスナー1</td><td>500pt</td></tr>`,
+			`<tr><td>1</td><td>リスナー2</td><td>300pt</td></tr>`), 2, 0},
+		{"rank skips", rankingPage(header,
+			`<tr><td>1</td><td>リスナー1</td><td>500pt</td></tr>`,
+			`<tr><td>5</td><td>リスナー2</td><td>300pt</td></tr>`), 2, 0},
+		{"point increases", rankingPage(header,
+			`<tr><td>1</td><td>リスナー1</td><td>300pt</td></tr>`,
+			`<tr><td>2</td><td>リスナー2</td><td>500pt</td></tr>`), 2, 0},
+	}
+	for _, c := range cases {
+		total, disppoint, eventranking, err := ParseRankingPage(c.page)
+		if c.row == -2 {
+			if err != nil || len(eventranking) != c.want {
+				t.Errorf("%s: ParseRankingPage() = %d listener(s), %v, want %d, nil", c.name, len(eventranking), err, c.want)
+			}
+			continue
+		}
+		var lerr *LayoutChangedError
+		if !errors.As(err, &lerr) {
+			t.Errorf("%s: ParseRankingPage() err = %v, want *LayoutChangedError", c.name, err)
+			continue
+		}
+		if lerr.Row != c.row {
+			t.Errorf("%s: ParseRankingPage() err = %v, want row %d", c.name, err, c.row)
+		}
+		if total != 0 || disppoint != -1 || eventranking != nil {
+			t.Errorf("%s: ParseRankingPage() = %d, %d, %v with an error, want 0, -1, nil", c.name, total, disppoint, eventranking)
+		}
+	}
+}
+
+func TestListenerIDFromURL(t *testing.T) {
+	cases := []struct {
+		href string
+		want int
+	}{
+		{"/user/profile?user_id=1234567", 1234567},
+		{"https://www.showroom-live.com/user/profile?user_id=1234567&foo=bar", 1234567},
+		{"/user/profile?viewer_id=7654321", 7654321},
+		{"/user/profile?user_id=abc&viewer_id=42", 42},
+		{"/user/profile", 0},
+		{"/user/profile?user_id=", 0},
+		{"/user/profile?user_id=abc", 0},
+		{"/user/profile?user_id=0", 0},
+		{"/user/profile?user_id=-5", 0},
+		{"%zz", 0},
+	}
+	for _, c := range cases {
+		if got := ListenerIDFromURL(c.href); got != c.want {
+			t.Errorf("ListenerIDFromURL(%q) = %d, want %d", c.href, got, c.want)
+		}
+	}
+}
+
+//	リスナーのプロフィールへのリンクとアバターの画像があればLsnIDとAvatarに入ること。
+func TestParseRankingPageListenerID(t *testing.T) {
+
+	page := rankingPage(`<tr><th>順位</th><th>ユーザー名</th><th>ポイント</th></tr>`,
+		`<tr><td>1</td><td><a href="/user/profile?user_id=1234567"><img src="https://image.example/avatar/1.png">リスナー1</a></td><td>500pt</td></tr>`,
+		`<tr><td>2</td><td>リスナー2</td><td>300pt</td></tr>`)
+	_, _, eventranking, err := ParseRankingPage(page)
+	if err != nil || len(eventranking) != 2 {
+		t.Fatalf("ParseRankingPage() = %d listener(s), %v, want 2", len(eventranking), err)
+	}
+	if evr := eventranking[0]; evr.Listner != "リスナー1" || evr.LsnID != 1234567 || evr.Avatar != "https://image.example/avatar/1.png" {
+		t.Errorf("ParseRankingPage() row 1 = %+v, want LsnID 1234567 and the avatar", evr)
+	}
+	if evr := eventranking[1]; evr.LsnID != 0 || evr.Avatar != "" {
+		t.Errorf("ParseRankingPage() row 2 = %+v, want no LsnID and no avatar", evr)
+	}
+}
+
+func TestCheckRoomPoint(t *testing.T) {
+	cases := []struct {
+		name                             string
+		sumpoint, disppoint, earnedpoint int
+		want                             int
+	}{
+		{"not recorded", 1000, 1000, -1, ShowroomDBlib.PointCheckNone},
+		{"same", 1000, 1000, 1000, ShowroomDBlib.PointCheckOK},
+		{"within tolerance", 900, -1, 1000, ShowroomDBlib.PointCheckOK},
+		{"sum diverged", 500, -1, 1000, ShowroomDBlib.PointCheckDiverged},
+		{"displayed diverged", 1000, 2000, 1000, ShowroomDBlib.PointCheckDiverged},
+		{"zero", 0, 0, 0, ShowroomDBlib.PointCheckOK},
+		{"zero not displayed", 0, -1, 0, ShowroomDBlib.PointCheckOK},
+		{"zero sum diverged", 100, -1, 0, ShowroomDBlib.PointCheckDiverged},
+		{"zero displayed diverged", 0, 100, 0, ShowroomDBlib.PointCheckDiverged},
+	}
+	for _, c := range cases {
+		if got, msg := CheckRoomPoint(c.sumpoint, c.disppoint, c.earnedpoint, 0.2); got != c.want {
+			t.Errorf("%s: CheckRoomPoint(%d, %d, %d) = %d (%s), want %d", c.name, c.sumpoint, c.disppoint, c.earnedpoint, got, msg, c.want)
+		}
+	}
+}
+
+//	監視プロセスが記録したポイントと貢献ランキングのポイントの合計を比較した結果がtimetableに記録されること。
+func TestProcessSamplePointCheck(t *testing.T) {
+	cases := []struct {
+		name        string
+		earnedpoint int
+		want        int
+	}{
+		{"not recorded", -1, ShowroomDBlib.PointCheckNone},
+		{"same", 1000, ShowroomDBlib.PointCheckOK},
+		{"diverged", 5000, ShowroomDBlib.PointCheckDiverged},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := openTestStore(t)
+			sample := ShowroomDBlib.Sample{Eventid: "test", Userid: 1, Sampletm1: time.Now().Add(-time.Hour).Truncate(time.Second)}
+
+			//	監視プロセスは配信を登録し、配信が終わったときのポイントを記録する。
+			if err := store.InsertSample(ctx, sample, -1); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.RecordEarnedPoint(ctx, sample, c.earnedpoint); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.ClaimSamples(ctx, "w1", 1, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+
+			environment := &Environment{LeaseTime: 60, PointTolerance: 20}
+			done, err := ProcessSample(ctx, environment, store, pageSource(testPage), nil, "w1", sample)
+			if err != nil || !done {
+				t.Fatalf("ProcessSample() = %v, %v", done, err)
+			}
+
+			var sumpoint, disppoint, pointcheck int
+			query := "select sumpoint, disppoint, pointcheck from timetable where eventid = ? and userid = ?"
+			if err = store.DB().QueryRow(query, sample.Eventid, sample.Userid).Scan(&sumpoint, &disppoint, &pointcheck); err != nil {
+				t.Fatal(err)
+			}
+			if sumpoint != 1000 || disppoint != 1000 || pointcheck != c.want {
+				t.Errorf("timetable sumpoint=%d disppoint=%d pointcheck=%d, want 1000, 1000, %d", sumpoint, disppoint, pointcheck, c.want)
+			}
+		})
+	}
+}